@@ -0,0 +1,369 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// cluster-autoscaler externalgrpc CloudProvider. Pools with a max_size are node groups: the
+// autoscaler changes their replica count and the pool controller creates VMs through the
+// create pipeline, while scale-down deletes the exact VMs the autoscaler picked.
+
+const autoscalerService = "clusterautoscaler.cloudprovider.v1.externalgrpc.CloudProvider"
+
+// providerIDPrefix starts the provider ID of deployer VMs, proxmox-talos://<node>/<vmid>. The
+// machine template sets it as the kubelet provider-id with {{ .ProviderID }}.
+const providerIDPrefix = "proxmox-talos://"
+
+// Instance states of NodeGroupNodes
+const (
+	instanceRunning  = 1
+	instanceCreating = 2
+	instanceDeleting = 3
+)
+
+func providerID(node string, vmid int) string {
+	return fmt.Sprintf("%s%s/%d", providerIDPrefix, node, vmid)
+}
+
+func parseProviderID(id string) (string, int, bool) {
+	rest, ok := strings.CutPrefix(id, providerIDPrefix)
+	if !ok {
+		return "", 0, false
+	}
+	node, vmid, ok := strings.Cut(rest, "/")
+	if !ok {
+		return "", 0, false
+	}
+	n, err := strconv.Atoi(vmid)
+	if err != nil {
+		return "", 0, false
+	}
+	return node, n, true
+}
+
+// validateAutoscalerProviderIDs checks that the machine config of every pool sets the provider
+// ID, without which the autoscaler can't map Kubernetes nodes to their node group
+func validateAutoscalerProviderIDs() error {
+	for _, pool := range config.Pools {
+		vmTemplate := findVmTemplate(pool.VmTemplate)
+		if vmTemplate == nil {
+			return fmt.Errorf("pool %s: unknown vm_template %s", pool.Name, pool.VmTemplate)
+		}
+		candidates, _ := placementCandidates(config.Nodes, pool.BaseTemplate)
+		for _, node := range candidates {
+			data := &MachineConfigData{
+				VMName:               fmt.Sprintf("%s-%s-100-preview", pool.Name, node.Suffix),
+				VMID:                 100,
+				ProviderID:           providerID(node.Name, 100),
+				VMIP:                 "192.0.2.10",
+				Role:                 vmTemplate.Role,
+				Node:                 node.Name,
+				Suffix:               node.Suffix,
+				VmTemplate:           *vmTemplate,
+				ControlPlaneEndpoint: talosControlPlaneEndpoint,
+				lenientVars:          true,
+			}
+			talosConfig, err := buildMachineConfig(*vmTemplate, nil, data)
+			if err != nil {
+				return fmt.Errorf("pool %s on node %s: %w", pool.Name, node.Name, err)
+			}
+			if !strings.Contains(talosConfig, data.ProviderID) {
+				return fmt.Errorf("pool %s: the machine config of vm_template %s doesn't render {{ .ProviderID }}, set it as the kubelet provider-id", pool.Name, vmTemplate.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// runAutoscalerServer serves the externalgrpc service on AUTOSCALER_GRPC_ADDR. gRPC needs HTTP/2,
+// which net/http only speaks over TLS, so a certificate is required.
+func runAutoscalerServer() error {
+	if appConfig.AutoscalerTLSCert == "" || appConfig.AutoscalerTLSKey == "" {
+		return errors.New("AUTOSCALER_TLS_CERT and AUTOSCALER_TLS_KEY are required")
+	}
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if appConfig.AutoscalerTLSClientCA != "" {
+		pem, err := os.ReadFile(appConfig.AutoscalerTLSClientCA)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates in %s", appConfig.AutoscalerTLSClientCA)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	server := &http.Server{
+		Addr:      appConfig.AutoscalerAddr,
+		TLSConfig: tlsConfig,
+		Handler: grpcHandler(autoscalerService, map[string]grpcMethod{
+			"NodeGroups":                  autoscalerNodeGroups,
+			"NodeGroupForNode":            autoscalerNodeGroupForNode,
+			"GPULabel":                    autoscalerEmpty, // no GPU label
+			"GetAvailableGPUTypes":        autoscalerEmpty,
+			"Cleanup":                     autoscalerEmpty,
+			"Refresh":                     autoscalerEmpty,
+			"NodeGroupTargetSize":         autoscalerTargetSize,
+			"NodeGroupIncreaseSize":       autoscalerIncreaseSize,
+			"NodeGroupDeleteNodes":        autoscalerDeleteNodes,
+			"NodeGroupDecreaseTargetSize": autoscalerDecreaseTargetSize,
+			"NodeGroupNodes":              autoscalerNodes,
+			// PricingNodePrice, PricingPodPrice, NodeGroupTemplateNodeInfo and NodeGroupGetOptions
+			// are optional and answer Unimplemented
+		}),
+	}
+	logger.Info("Autoscaler gRPC server starting on %s", appConfig.AutoscalerAddr)
+	return server.ListenAndServeTLS(appConfig.AutoscalerTLSCert, appConfig.AutoscalerTLSKey)
+}
+
+// autoscalerGroup returns the pool behind a node group id
+func autoscalerGroup(id string) (Pool, error) {
+	poolsMu.Lock()
+	defer poolsMu.Unlock()
+	state, ok := pools[id]
+	if !ok || state.MaxSize == 0 {
+		return Pool{}, &GRPCError{Code: grpcCodeNotFound, Message: "unknown node group " + id}
+	}
+	return state.Pool, nil
+}
+
+// encodeNodeGroup encodes a NodeGroup message: id=1, minSize=2, maxSize=3, debug=4
+func encodeNodeGroup(pool Pool) []byte {
+	var buf []byte
+	buf = protoAppendString(buf, 1, pool.Name)
+	buf = protoAppendVarint(buf, 2, uint64(pool.MinSize))
+	buf = protoAppendVarint(buf, 3, uint64(pool.MaxSize))
+	return protoAppendString(buf, 4, fmt.Sprintf("%s on %s, %d replicas", pool.VmTemplate, pool.BaseTemplate, pool.Replicas))
+}
+
+// parseGroupRequest decodes the node group id and delta of a request; the field numbers differ per message
+func parseGroupRequest(request []byte, idField int, deltaField int) (string, int, error) {
+	fields, err := protoParse(request)
+	if err != nil {
+		return "", 0, &GRPCError{Code: grpcCodeInvalidArgument, Message: err.Error()}
+	}
+	var id string
+	var delta int
+	for _, f := range fields {
+		switch {
+		case f.Num == idField && f.Type == protoBytes:
+			id = string(f.Bytes)
+		case f.Num == deltaField && f.Type == protoVarint:
+			delta = int(int32(f.Varint))
+		}
+	}
+	return id, delta, nil
+}
+
+// parseExternalGrpcNode decodes the providerID=1 and name=2 fields of an ExternalGrpcNode
+func parseExternalGrpcNode(data []byte) (string, string, error) {
+	fields, err := protoParse(data)
+	if err != nil {
+		return "", "", &GRPCError{Code: grpcCodeInvalidArgument, Message: err.Error()}
+	}
+	var id, name string
+	for _, f := range fields {
+		switch {
+		case f.Num == 1 && f.Type == protoBytes:
+			id = string(f.Bytes)
+		case f.Num == 2 && f.Type == protoBytes:
+			name = string(f.Bytes)
+		}
+	}
+	return id, name, nil
+}
+
+// resolveNode finds the VM of a Kubernetes node by its provider ID, or by name (the node
+// name is the VM hostname) for nodes registered without one
+func resolveNode(id string, name string) (InventoryVM, bool) {
+	if node, vmid, ok := parseProviderID(id); ok {
+		return inventory.findByID(node, vmid)
+	}
+	return inventory.get(name)
+}
+
+func autoscalerEmpty(request []byte) ([]byte, error) {
+	return nil, nil
+}
+
+func autoscalerNodeGroups(request []byte) ([]byte, error) {
+	var response []byte
+	for _, name := range poolNames() {
+		if pool, err := autoscalerGroup(name); err == nil {
+			response = protoAppendBytes(response, 1, encodeNodeGroup(pool))
+		}
+	}
+	return response, nil
+}
+
+// autoscalerNodeGroupForNode answers a NodeGroup with an empty id for nodes outside node groups
+func autoscalerNodeGroupForNode(request []byte) ([]byte, error) {
+	fields, err := protoParse(request)
+	if err != nil {
+		return nil, &GRPCError{Code: grpcCodeInvalidArgument, Message: err.Error()}
+	}
+	var id, name string
+	for _, f := range fields {
+		if f.Num == 1 && f.Type == protoBytes {
+			if id, name, err = parseExternalGrpcNode(f.Bytes); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	vm, ok := resolveNode(id, name)
+	if !ok || vm.Pool == "" {
+		return protoAppendBytes(nil, 1, nil), nil
+	}
+	pool, err := autoscalerGroup(vm.Pool)
+	if err != nil {
+		return protoAppendBytes(nil, 1, nil), nil
+	}
+	return protoAppendBytes(nil, 1, encodeNodeGroup(pool)), nil
+}
+
+func autoscalerTargetSize(request []byte) ([]byte, error) {
+	id, _, err := parseGroupRequest(request, 1, 0)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := autoscalerGroup(id)
+	if err != nil {
+		return nil, err
+	}
+	return protoAppendVarint(nil, 1, uint64(pool.Replicas)), nil
+}
+
+func autoscalerIncreaseSize(request []byte) ([]byte, error) {
+	id, delta, err := parseGroupRequest(request, 2, 1)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := autoscalerGroup(id)
+	if err != nil {
+		return nil, err
+	}
+	if delta <= 0 {
+		return nil, &GRPCError{Code: grpcCodeInvalidArgument, Message: "delta must be positive"}
+	}
+	if pool.Replicas+delta > pool.MaxSize {
+		return nil, &GRPCError{Code: grpcCodeInvalidArgument, Message: fmt.Sprintf("size %d would exceed max_size %d", pool.Replicas+delta, pool.MaxSize)}
+	}
+	if err := scalePool(id, pool.Replicas+delta); err != nil {
+		return nil, err
+	}
+	go syncPool(id)
+	return nil, nil
+}
+
+// autoscalerDecreaseTargetSize only lowers the target for VMs not created yet; existing VMs are
+// removed through NodeGroupDeleteNodes
+func autoscalerDecreaseTargetSize(request []byte) ([]byte, error) {
+	id, delta, err := parseGroupRequest(request, 2, 1)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := autoscalerGroup(id)
+	if err != nil {
+		return nil, err
+	}
+	if delta >= 0 {
+		return nil, &GRPCError{Code: grpcCodeInvalidArgument, Message: "delta must be negative"}
+	}
+	if existing := len(poolMembers(id)); pool.Replicas+delta < existing {
+		return nil, &GRPCError{Code: grpcCodeFailedPrecondition, Message: fmt.Sprintf("size %d would be below the %d existing VMs", pool.Replicas+delta, existing)}
+	}
+	if err := scalePool(id, pool.Replicas+delta); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+func autoscalerDeleteNodes(request []byte) ([]byte, error) {
+	id, _, err := parseGroupRequest(request, 2, 0)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := autoscalerGroup(id); err != nil {
+		return nil, err
+	}
+	fields, err := protoParse(request)
+	if err != nil {
+		return nil, &GRPCError{Code: grpcCodeInvalidArgument, Message: err.Error()}
+	}
+
+	var vms []InventoryVM
+	for _, f := range fields {
+		if f.Num != 1 || f.Type != protoBytes {
+			continue
+		}
+		nodeID, name, err := parseExternalGrpcNode(f.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		vm, ok := resolveNode(nodeID, name)
+		if !ok || vm.Pool != id {
+			return nil, &GRPCError{Code: grpcCodeInvalidArgument, Message: fmt.Sprintf("node %s (%s) doesn't belong to node group %s", name, nodeID, id)}
+		}
+		vms = append(vms, vm)
+	}
+
+	if err := deletePoolVMs(id, vms); err != nil {
+		if errors.Is(err, errPoolBelowMin) {
+			return nil, &GRPCError{Code: grpcCodeFailedPrecondition, Message: err.Error()}
+		}
+		return nil, err
+	}
+	return nil, nil
+}
+
+// autoscalerNodes lists the VMs of a node group as Instance{id=1, status=2{instanceState=1}}
+func autoscalerNodes(request []byte) ([]byte, error) {
+	id, _, err := parseGroupRequest(request, 1, 0)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := autoscalerGroup(id); err != nil {
+		return nil, err
+	}
+
+	var response []byte
+	listed := map[string]bool{}
+	appendInstance := func(node string, vmid int, state int) {
+		instance := protoAppendString(nil, 1, providerID(node, vmid))
+		instance = protoAppendBytes(instance, 2, protoAppendVarint(nil, 1, uint64(state)))
+		response = protoAppendBytes(response, 1, instance)
+		listed[providerID(node, vmid)] = true
+	}
+
+	for _, vm := range poolMembers(id) {
+		state := instanceRunning
+		switch {
+		case isPoolVMDeleting(id, vm.Name):
+			state = instanceDeleting
+		case vmBeingCreated(vm.Node, vm.VMID):
+			state = instanceCreating
+		}
+		appendInstance(vm.Node, vm.VMID, state)
+	}
+	// VMs whose pipeline is still running aren't in the inventory yet; the ones not cloned
+	// yet have no provider ID and only count towards the target size
+	for _, job := range poolCreatingJobs(id) {
+		job.mu.Lock()
+		node, vmid := job.Node, job.VMID
+		job.mu.Unlock()
+		if vmid != 0 && !listed[providerID(node, vmid)] {
+			appendInstance(node, vmid, instanceCreating)
+		}
+	}
+	return response, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestValidateAutoscalerProviderIDs(t *testing.T) {
+	setupTest(t)
+	config.Pools = []Pool{{Name: "workers", BaseTemplate: "talos", VmTemplate: "worker-small", MaxSize: 3}}
+
+	err := validateAutoscalerProviderIDs()
+	if err == nil || !strings.Contains(err.Error(), "ProviderID") {
+		t.Fatalf("expected an error for a template without the provider ID, got %v", err)
+	}
+
+	withProviderID := strings.Replace(testMachineTemplate, "    network:\n",
+		"    kubelet:\n        extraArgs:\n            provider-id: \"{{ .ProviderID }}\"\n    network:\n", 1)
+	if err := os.WriteFile(talosMachineTemplate, []byte(withProviderID), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := validateAutoscalerProviderIDs(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAutoscalerNodesCreating(t *testing.T) {
+	setupTest(t)
+	cloned, uncloned := newJob(), newJob()
+	cloned.Node, cloned.VMID = "pve1", 101
+	t.Cleanup(func() {
+		jobsMu.Lock()
+		delete(jobs, cloned.ID)
+		delete(jobs, uncloned.ID)
+		jobsMu.Unlock()
+	})
+	poolsMu.Lock()
+	pools = map[string]*poolState{"workers": {
+		Pool:     Pool{Name: "workers", BaseTemplate: "talos", VmTemplate: "worker-small", MaxSize: 3},
+		Creating: map[string]*Job{cloned.ID: cloned, uncloned.ID: uncloned},
+		Deleting: map[string]bool{"workers-a-102": true},
+	}}
+	poolsMu.Unlock()
+	t.Cleanup(func() { pools = map[string]*poolState{} })
+	for vmid, name := range map[int]string{100: "workers-a-100", 102: "workers-a-102"} {
+		inventory.put(InventoryVM{Name: name, Node: "pve1", VMID: vmid, Pool: "workers"})
+	}
+
+	response, err := autoscalerNodes(protoAppendString(nil, 1, "workers"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields, err := protoParse(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	states := map[string]uint64{}
+	for _, field := range fields {
+		instance, err := protoParse(field.Bytes)
+		if err != nil || len(instance) != 2 {
+			t.Fatalf("invalid instance %x: %v", field.Bytes, err)
+		}
+		status, err := protoParse(instance[1].Bytes)
+		if err != nil || len(status) != 1 {
+			t.Fatalf("invalid instance status %x: %v", instance[1].Bytes, err)
+		}
+		states[string(instance[0].Bytes)] = status[0].Varint
+	}
+
+	want := map[string]uint64{
+		"proxmox-talos://pve1/100": instanceRunning,
+		"proxmox-talos://pve1/101": instanceCreating,
+		"proxmox-talos://pve1/102": instanceDeleting,
+	}
+	if len(states) != len(want) {
+		t.Fatalf("instances = %v, want %v", states, want)
+	}
+	for id, state := range want {
+		if states[id] != state {
+			t.Errorf("%s: state %d, want %d", id, states[id], state)
+		}
+	}
+}
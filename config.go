@@ -1,5 +1,7 @@
 package main
 
+import "time"
+
 // YAML config types.
 type BaseTemplate struct {
 	Name string `yaml:"name"`
@@ -12,8 +14,9 @@ type CoreRange struct {
 }
 
 type NumaNode struct {
-	ID    int       `yaml:"id"`
-	Cores CoreRange `yaml:"cores"`
+	ID     int       `yaml:"id"`
+	Cores  CoreRange `yaml:"cores"`
+	Memory int       `yaml:"memory,omitempty"` // MB available to VMs, 0 disables the memory check
 }
 
 type NodeConfig struct {
@@ -27,33 +30,92 @@ type NodeConfig struct {
 }
 
 type VmTemplate struct {
-	Name     string `yaml:"name"`
-	CPU      int    `yaml:"cpu"`
-	Memory   int    `yaml:"memory"`
-	Disk     int    `yaml:"disk"`
-	CPUModel string `yaml:"cpu_model"`
-	Role     string `yaml:"role"` // worker or controlplane
-	NUMA     string `yaml:"numa,omitempty"`
-	PhyCores string `yaml:"phy,omitempty"`
-	HTCores  string `yaml:"ht,omitempty"`
+	Name     string   `yaml:"name"`
+	CPU      int      `yaml:"cpu"`
+	Memory   int      `yaml:"memory"`
+	Disk     int      `yaml:"disk"`
+	CPUModel string   `yaml:"cpu_model"`
+	Role     string   `yaml:"role"` // worker or controlplane
+	NUMA     string   `yaml:"numa,omitempty"`
+	PhyCores string   `yaml:"phy,omitempty"`
+	HTCores  string   `yaml:"ht,omitempty"`
+	Patches  []string `yaml:"patches,omitempty"` // Talos config patch files applied on top of the machine template
+}
+
+// Pool is a group of identical VMs kept at a desired replica count
+type Pool struct {
+	Name         string `yaml:"name"`
+	BaseTemplate string `yaml:"base_template"`
+	VmTemplate   string `yaml:"vm_template"`
+	Placement    string `yaml:"placement,omitempty"` // PLACEMENT if empty
+	Replicas     int    `yaml:"replicas"`
+	NamePrefix   string `yaml:"name_prefix,omitempty"` // vm_template if empty
+	MinSize      int    `yaml:"min_size,omitempty"`    // cluster-autoscaler bounds; the pool is a node group when max_size is set
+	MaxSize      int    `yaml:"max_size,omitempty"`
 }
 
 type Config struct {
 	Nodes       []NodeConfig `yaml:"nodes"`
 	VmTemplates []VmTemplate `yaml:"vm_templates"`
+	Pools       []Pool       `yaml:"pools,omitempty"`
 }
 
 type AppConfig struct {
-	ProxmoxBaseAddr           string `env:"PROXMOX_BASE_ADDR,required"`
-	ProxmoxToken              string `env:"PROXMOX_TOKEN,required"`
-	SentryDSN                 string `env:"SENTRY_DSN,required"`
-	ListenAddr                string `env:"LISTEN_ADDR,required"`
-	ListenPort                string `env:"LISTEN_PORT,required"`
-	ConfigPath                string `env:"CONFIG_PATH,required"`
-	AuthToken                 string `env:"AUTH_TOKEN,required"`
-	TalosMachineTemplate      string `env:"TALOS_MACHINE_TEMPLATE,required"`
-	TalosControlPlaneEndpoint string `env:"TALOS_CONTROLPLANE_ENDPOINT,required"`
-	Debug                     bool   `env:"DEBUG" envDefault:"false"`
-	LogLevel                  int    `env:"LOG_LEVEL" envDefault:"1"`     // 0: Debug, 1: Info, 2: Error
-	VerifySSL                 bool   `env:"VERIFY_SSL" envDefault:"true"` // Controls SSL certificate verification
+	ProxmoxBaseAddr           string        `env:"PROXMOX_BASE_ADDR,required"`
+	ProxmoxToken              string        `env:"PROXMOX_TOKEN,required"`
+	SentryDSN                 string        `env:"SENTRY_DSN,required"`
+	ListenAddr                string        `env:"LISTEN_ADDR,required"`
+	ListenPort                string        `env:"LISTEN_PORT,required"`
+	ConfigPath                string        `env:"CONFIG_PATH,required"`
+	AuthToken                 string        `env:"AUTH_TOKEN,required"`
+	TalosMachineTemplate      string        `env:"TALOS_MACHINE_TEMPLATE,required"`
+	TalosControlPlaneEndpoint string        `env:"TALOS_CONTROLPLANE_ENDPOINT,required"`
+	Debug                     bool          `env:"DEBUG" envDefault:"false"`
+	LogLevel                  int           `env:"LOG_LEVEL" envDefault:"1"`                      // 0: Debug, 1: Info, 2: Error
+	VerifySSL                 bool          `env:"VERIFY_SSL" envDefault:"true"`                  // Controls SSL certificate verification
+	ProxmoxFake               bool          `env:"PROXMOX_FAKE" envDefault:"false"`               // Use an in-memory fake Proxmox API instead of PROXMOX_BASE_ADDR, for local development
+	ProxmoxFakeGuestIP        string        `env:"PROXMOX_FAKE_GUEST_IP" envDefault:"192.0.2.10"` // IP the fake guest agent reports, e.g. of a Talos VM in maintenance mode
+	ProxmoxRetryMaxAttempts   int           `env:"PROXMOX_RETRY_MAX_ATTEMPTS" envDefault:"4"`     // Attempts per Proxmox API call, 1 disables retries
+	ProxmoxRetryBaseDelay     time.Duration `env:"PROXMOX_RETRY_BASE_DELAY" envDefault:"1s"`      // Delay before the first retry, doubled for every further one
+	ProxmoxRetryMaxDelay      time.Duration `env:"PROXMOX_RETRY_MAX_DELAY" envDefault:"30s"`
+	ProxmoxRetryOn            []string      `env:"PROXMOX_RETRY_ON" envDefault:"lock_timeout,unavailable,connection"` // Retryable error classes
+	InventoryPath             string        `env:"INVENTORY_PATH" envDefault:"inventory.json"`                        // File recording the VMs created by the deployer
+	ReconcileInterval         time.Duration `env:"RECONCILE_INTERVAL" envDefault:"5m"`                                // How often to compare the inventory with Proxmox, 0 disables
+	OrphanCleanup             bool          `env:"ORPHAN_CLEANUP" envDefault:"false"`                                 // Delete orphaned VMs after ORPHAN_GRACE_PERIOD
+	OrphanGracePeriod         time.Duration `env:"ORPHAN_GRACE_PERIOD" envDefault:"24h"`
+	PoolsStatePath            string        `env:"POOLS_STATE_PATH" envDefault:"pools.json"`       // Replica counts changed through the API
+	PoolSyncInterval          time.Duration `env:"POOL_SYNC_INTERVAL" envDefault:"30s"`            // How often pools are converged to their replicas
+	PoolRetryMaxDelay         time.Duration `env:"POOL_RETRY_MAX_DELAY" envDefault:"30m"`          // Longest backoff after failed pool creations
+	PoolMaxKeptVMs            int           `env:"POOL_MAX_KEPT_VMS" envDefault:"3"`               // Failed VMs a pool keeps with ON_FAILURE=keep before destroying further ones
+	IdempotencyPath           string        `env:"IDEMPOTENCY_PATH" envDefault:"idempotency.json"` // Idempotency keys of create requests and their responses
+	IdempotencyWindow         time.Duration `env:"IDEMPOTENCY_WINDOW" envDefault:"24h"`            // How long an idempotency key is remembered
+	JobRetention              time.Duration `env:"JOB_RETENTION" envDefault:"24h"`                 // How long finished jobs stay queryable
+	OnFailure                 string        `env:"ON_FAILURE" envDefault:"destroy"`                // keep or destroy VMs whose creation failed
+	MaxParallelism            int           `env:"MAX_PARALLELISM" envDefault:"4"`                 // Server-wide cap on concurrently created bulk VMs
+	Placement                 string        `env:"PLACEMENT" envDefault:"pack"`                    // Default placement strategy: pack, spread or weighted-per-vm
+	CapacityCheck             bool          `env:"CAPACITY_CHECK" envDefault:"true"`               // Skip nodes without enough free CPU/memory/storage
+	TalosApplyMode            string        `env:"TALOS_APPLY_MODE" envDefault:"auto"`             // Default apply mode: auto, reboot, no-reboot or staged
+	TalosConfigPath           string        `env:"TALOSCONFIG"`                                    // talosconfig with client credentials for configured nodes
+	WaitForReady              bool          `env:"WAIT_FOR_READY" envDefault:"false"`              // Wait for the Kubernetes node to become Ready by default
+	ReadyTimeout              time.Duration `env:"READY_TIMEOUT" envDefault:"15m"`                 // How long to wait for the node to join the cluster
+	CloneTimeout              time.Duration `env:"CLONE_TIMEOUT" envDefault:"15m"`                 // How long the clone of the base template may take
+	StartTimeout              time.Duration `env:"START_TIMEOUT" envDefault:"2m"`                  // How long starting (and resetting) the VM may take
+	IPTimeout                 time.Duration `env:"IP_TIMEOUT" envDefault:"5m"`                     // How long to wait for the guest agent to report an IP
+	TalosReadyTimeout         time.Duration `env:"TALOS_READY_TIMEOUT" envDefault:"5m"`            // How long to wait for the Talos maintenance API
+	RollbackTimeout           time.Duration `env:"ROLLBACK_TIMEOUT" envDefault:"5m"`               // How long destroying a failed VM may take
+	TaskLogLines              int           `env:"TASK_LOG_LINES" envDefault:"20"`                 // Lines of a failed Proxmox task log reported with the error
+	TaskLogStream             bool          `env:"TASK_LOG_STREAM" envDefault:"false"`             // Show the log of running Proxmox tasks in the job status
+	GracefulDelete            bool          `env:"GRACEFUL_DELETE" envDefault:"false"`             // Remove nodes from the cluster before deleting VMs by default
+	DrainTimeout              time.Duration `env:"DRAIN_TIMEOUT" envDefault:"5m"`
+	ResetTimeout              time.Duration `env:"RESET_TIMEOUT" envDefault:"5m"` // How long to wait for a Talos reset to power the VM off
+	KubeAPIServer             string        `env:"KUBE_API_SERVER"`               // Kubernetes API URL, in-cluster service account if empty
+	KubeTokenFile             string        `env:"KUBE_TOKEN_FILE"`
+	KubeCAFile                string        `env:"KUBE_CA_FILE"`
+	Controller                bool          `env:"CONTROLLER" envDefault:"false"`             // Manage TalosProxmoxMachine(Set) resources
+	ControllerNamespace       string        `env:"CONTROLLER_NAMESPACE"`                      // Namespace to watch, all namespaces if empty
+	ControllerSyncInterval    time.Duration `env:"CONTROLLER_SYNC_INTERVAL" envDefault:"15s"` // How often resources are synced
+	AutoscalerAddr            string        `env:"AUTOSCALER_GRPC_ADDR"`                      // Listen address of the cluster-autoscaler externalgrpc service, disabled if empty
+	AutoscalerTLSCert         string        `env:"AUTOSCALER_TLS_CERT"`
+	AutoscalerTLSKey          string        `env:"AUTOSCALER_TLS_KEY"`
+	AutoscalerTLSClientCA     string        `env:"AUTOSCALER_TLS_CLIENT_CA"` // Require client certificates signed by this CA
 }
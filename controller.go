@@ -0,0 +1,622 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Controller mode: TalosProxmoxMachine resources are created and deleted through the create
+// pipeline and the delete path, TalosProxmoxMachineSets keep a number of machines. The CRDs are
+// in deploy/crds.yaml.
+
+const (
+	crdGroup         = "deployer.talos-proxmox.io"
+	crdAPIVersion    = crdGroup + "/v1alpha1"
+	machineFinalizer = crdGroup + "/vm"         // removed once the VM is deleted
+	machineSetLabel  = crdGroup + "/machineset" // name of the owning TalosProxmoxMachineSet
+)
+
+// TalosProxmoxMachine phases
+const (
+	MachinePending      = "Pending" // waiting for capacity
+	MachineProvisioning = "Provisioning"
+	MachineReady        = "Ready"
+	MachineFailed       = "Failed"
+	MachineDeleting     = "Deleting"
+)
+
+// Conditions set from the pipeline steps of the creation job
+var stepConditions = map[string]string{
+	StepCloning:        "Cloned",
+	StepConfiguring:    "Configured",
+	StepResizing:       "Resized",
+	StepStarting:       "Started",
+	StepResetting:      "Reset",
+	StepWaitingIP:      "AddressAssigned",
+	StepApplyingConfig: "ConfigApplied",
+	StepWaitingReady:   "NodeReady",
+	StepRollingBack:    "RolledBack",
+}
+
+type KubeObjectMeta struct {
+	Name              string               `json:"name"`
+	GenerateName      string               `json:"generateName,omitempty"`
+	Namespace         string               `json:"namespace,omitempty"`
+	UID               string               `json:"uid,omitempty"`
+	ResourceVersion   string               `json:"resourceVersion,omitempty"`
+	Labels            map[string]string    `json:"labels,omitempty"`
+	Finalizers        []string             `json:"finalizers,omitempty"`
+	OwnerReferences   []KubeOwnerReference `json:"ownerReferences,omitempty"`
+	CreationTimestamp *time.Time           `json:"creationTimestamp,omitempty"`
+	DeletionTimestamp *time.Time           `json:"deletionTimestamp,omitempty"`
+}
+
+type KubeOwnerReference struct {
+	APIVersion         string `json:"apiVersion"`
+	Kind               string `json:"kind"`
+	Name               string `json:"name"`
+	UID                string `json:"uid"`
+	Controller         bool   `json:"controller,omitempty"`
+	BlockOwnerDeletion bool   `json:"blockOwnerDeletion,omitempty"`
+}
+
+type KubeCondition struct {
+	Type               string    `json:"type"`
+	Status             string    `json:"status"` // True, False or Unknown
+	Reason             string    `json:"reason,omitempty"`
+	Message            string    `json:"message,omitempty"`
+	LastTransitionTime time.Time `json:"lastTransitionTime"`
+}
+
+// TalosProxmoxMachineSpec mirrors the parameters of /api/v1/create
+type TalosProxmoxMachineSpec struct {
+	BaseTemplate   string            `json:"baseTemplate"`
+	VmTemplate     string            `json:"vmTemplate"`
+	Node           string            `json:"node,omitempty"`
+	Placement      string            `json:"placement,omitempty"`
+	VMName         string            `json:"vmName,omitempty"`
+	NUMA           string            `json:"numa,omitempty"`
+	PhyCores       string            `json:"phy,omitempty"`
+	HTCores        string            `json:"ht,omitempty"`
+	PhyOnly        bool              `json:"phyOnly,omitempty"`
+	HTOnly         bool              `json:"htOnly,omitempty"`
+	OnFailure      string            `json:"onFailure,omitempty"`
+	ApplyMode      string            `json:"applyMode,omitempty"`
+	WaitReady      *bool             `json:"waitReady,omitempty"`
+	GracefulDelete *bool             `json:"gracefulDelete,omitempty"`
+	Vars           map[string]string `json:"vars,omitempty"`
+	Patches        []string          `json:"patches,omitempty"`
+}
+
+type TalosProxmoxMachineStatus struct {
+	Phase      string          `json:"phase,omitempty"`
+	Message    string          `json:"message"`
+	JobID      string          `json:"jobID,omitempty"`
+	Node       string          `json:"node,omitempty"`
+	VMID       int             `json:"vmID,omitempty"`
+	VMName     string          `json:"vmName,omitempty"`
+	IP         string          `json:"ip,omitempty"`
+	Conditions []KubeCondition `json:"conditions,omitempty"`
+}
+
+type TalosProxmoxMachine struct {
+	APIVersion string                    `json:"apiVersion"`
+	Kind       string                    `json:"kind"`
+	Metadata   KubeObjectMeta            `json:"metadata"`
+	Spec       TalosProxmoxMachineSpec   `json:"spec"`
+	Status     TalosProxmoxMachineStatus `json:"status"`
+}
+
+type TalosProxmoxMachineSet struct {
+	Metadata KubeObjectMeta `json:"metadata"`
+	Spec     struct {
+		Replicas int `json:"replicas"`
+		Template struct {
+			Metadata struct {
+				Labels map[string]string `json:"labels,omitempty"`
+			} `json:"metadata"`
+			Spec TalosProxmoxMachineSpec `json:"spec"`
+		} `json:"template"`
+	} `json:"spec"`
+	Status struct {
+		Replicas      int `json:"replicas"`
+		ReadyReplicas int `json:"readyReplicas"`
+	} `json:"status"`
+}
+
+var (
+	machineDeletionsMu sync.Mutex
+	machineDeletions   = map[string]bool{} // UIDs of machines whose VM is being deleted
+)
+
+// runController syncs all machine sets and machines every CONTROLLER_SYNC_INTERVAL
+func runController() {
+	namespace := appConfig.ControllerNamespace
+	if namespace == "" {
+		namespace = "all namespaces"
+	}
+	logger.Info("Controller watching TalosProxmoxMachines in %s every %v", namespace, appConfig.ControllerSyncInterval)
+	ctx := context.Background()
+	for {
+		if err := syncController(ctx); err != nil {
+			logger.Error("Controller sync failed: %s", err.Error())
+			reportError(err)
+			incErrorCounterHandler("controller")
+		}
+		time.Sleep(appConfig.ControllerSyncInterval)
+	}
+}
+
+func syncController(ctx context.Context) error {
+	var sets struct {
+		Items []TalosProxmoxMachineSet `json:"items"`
+	}
+	if err := kubeRequest(ctx, "GET", crdPath("", "talosproxmoxmachinesets", ""), "", nil, &sets); err != nil {
+		return fmt.Errorf("failed to list TalosProxmoxMachineSets: %w", err)
+	}
+	machines, err := listMachines(ctx)
+	if err != nil {
+		return err
+	}
+	for i := range sets.Items {
+		if err := syncMachineSet(ctx, &sets.Items[i], machines); err != nil {
+			logger.Error("TalosProxmoxMachineSet %s/%s: %s", sets.Items[i].Metadata.Namespace, sets.Items[i].Metadata.Name, err.Error())
+			reportError(err)
+		}
+	}
+
+	// Machines created by the sets above are picked up by the next sync
+	for i := range machines {
+		if err := syncMachine(ctx, &machines[i]); err != nil {
+			logger.Error("TalosProxmoxMachine %s/%s: %s", machines[i].Metadata.Namespace, machines[i].Metadata.Name, err.Error())
+			reportError(err)
+		}
+	}
+	return nil
+}
+
+// crdPath builds the API path of a resource collection, or of one resource with name, in
+// namespace (or CONTROLLER_NAMESPACE, or all namespaces when both are empty)
+func crdPath(namespace string, resource string, name string) string {
+	if namespace == "" {
+		namespace = appConfig.ControllerNamespace
+	}
+	path := "/apis/" + crdAPIVersion
+	if namespace != "" {
+		path += "/namespaces/" + namespace
+	}
+	path += "/" + resource
+	if name != "" {
+		path += "/" + name
+	}
+	return path
+}
+
+func listMachines(ctx context.Context) ([]TalosProxmoxMachine, error) {
+	var list struct {
+		Items []TalosProxmoxMachine `json:"items"`
+	}
+	if err := kubeRequest(ctx, "GET", crdPath("", "talosproxmoxmachines", ""), "", nil, &list); err != nil {
+		return nil, fmt.Errorf("failed to list TalosProxmoxMachines: %w", err)
+	}
+	return list.Items, nil
+}
+
+// form turns the spec into /api/v1/create parameters, so it is validated like a request
+func (s *TalosProxmoxMachineSpec) form() url.Values {
+	form := url.Values{}
+	set := func(key string, value string) {
+		if value != "" {
+			form.Set(key, value)
+		}
+	}
+	set("base_template", s.BaseTemplate)
+	set("vm_template", s.VmTemplate)
+	set("node", s.Node)
+	set("placement", s.Placement)
+	set("name", s.VMName)
+	set("numa", s.NUMA)
+	set("phy", s.PhyCores)
+	set("ht", s.HTCores)
+	set("on_failure", s.OnFailure)
+	set("apply_mode", s.ApplyMode)
+	if s.PhyOnly {
+		form.Set("phy_only", "1")
+	}
+	if s.HTOnly {
+		form.Set("ht_only", "1")
+	}
+	if s.WaitReady != nil && *s.WaitReady {
+		form.Set("wait_ready", "1")
+	} else if s.WaitReady != nil {
+		form.Set("wait_ready", "0")
+	}
+	for name, value := range s.Vars {
+		form.Set("var_"+name, value)
+	}
+	form["patch"] = s.Patches
+	return form
+}
+
+// syncMachine drives one machine: adds the finalizer, starts the creation, mirrors the job into
+// the status and deletes the VM once the machine is deleted
+func syncMachine(ctx context.Context, m *TalosProxmoxMachine) error {
+	if m.Metadata.DeletionTimestamp != nil {
+		return finalizeMachine(ctx, m)
+	}
+	if !hasFinalizer(m) {
+		if err := setMachineFinalizers(ctx, m, append(m.Metadata.Finalizers, machineFinalizer)); err != nil {
+			return fmt.Errorf("failed to add finalizer: %w", err)
+		}
+	}
+
+	status := m.Status
+	switch {
+	case status.JobID == "" && (status.Phase == "" || status.Phase == MachinePending):
+		return startMachine(ctx, m)
+	case status.Phase == MachineProvisioning:
+		job := getJob(status.JobID)
+		if job == nil {
+			// The deployer restarted during the creation
+			if vm, ok := findInventoryJob(status.JobID); ok {
+				status.Phase, status.Message = MachineReady, ""
+				status.Node, status.VMID, status.VMName, status.IP = vm.Node, vm.VMID, vm.Name, vm.IP
+				status.Conditions = setCondition(status.Conditions, KubeCondition{Type: "Ready", Status: "True", Reason: "Created", LastTransitionTime: vm.CreatedAt})
+			} else {
+				status.Phase, status.Message = MachineFailed, "creation interrupted by a restart of the deployer"
+				status.Conditions = setCondition(status.Conditions, KubeCondition{Type: "Ready", Status: "False", Reason: "Interrupted", Message: status.Message, LastTransitionTime: time.Now()})
+			}
+			return patchMachineStatus(ctx, m, status)
+		}
+		return patchMachineStatus(ctx, m, machineStatusFromJob(status, job.snapshot()))
+	}
+	return nil
+}
+
+// startMachine validates the spec, places the VM and starts the create pipeline
+func startMachine(ctx context.Context, m *TalosProxmoxMachine) error {
+	status := m.Status
+	p, err := createParamsFromForm(m.Spec.form())
+	if err == nil {
+		p.Requestor = "machine/" + m.Metadata.Namespace + "/" + m.Metadata.Name
+		var placed []*createParams
+		placed, err = placeVMs(ctx, p, 1)
+		if err == nil {
+			err = checkMachineConfigs(placed)
+		}
+		if err == nil {
+			p = placed[0]
+		}
+	}
+
+	var reqErr *requestError
+	switch {
+	case errors.As(err, &reqErr) && reqErr.Status == http.StatusConflict:
+		// No node has room right now, try again on the next sync
+		status.Phase, status.Message = MachinePending, reqErr.Message
+		return patchMachineStatus(ctx, m, status)
+	case errors.As(err, &reqErr):
+		status.Phase, status.Message = MachineFailed, reqErr.Message
+		status.Conditions = setCondition(status.Conditions, KubeCondition{Type: "Ready", Status: "False", Reason: "InvalidSpec", Message: reqErr.Message, LastTransitionTime: time.Now()})
+		return patchMachineStatus(ctx, m, status)
+	case err != nil:
+		return err
+	}
+
+	job := newJob()
+	status.Phase, status.Message, status.JobID = MachineProvisioning, "", job.ID
+	if err := patchMachineStatus(ctx, m, status); err != nil {
+		return err
+	}
+	logger.Info("TalosProxmoxMachine %s/%s: creating VM on node %s, job=%s", m.Metadata.Namespace, m.Metadata.Name, p.Node.Name, job.ID)
+	go func() {
+		bulkSlots <- struct{}{}
+		defer func() { <-bulkSlots }()
+		if _, err := runCreatePipeline(context.Background(), p, job); err != nil {
+			logger.Error("TalosProxmoxMachine %s/%s: VM creation failed: job=%s: %s", m.Metadata.Namespace, m.Metadata.Name, job.ID, err.Error())
+		}
+	}()
+	return nil
+}
+
+// machineStatusFromJob mirrors the job into the status, with one condition per pipeline step
+func machineStatusFromJob(status TalosProxmoxMachineStatus, job *Job) TalosProxmoxMachineStatus {
+	status.Node, status.VMID = job.Node, job.VMID
+	for _, step := range job.Steps {
+		condition := KubeCondition{Type: stepConditions[step.Name], Status: "Unknown", Reason: "InProgress", Message: step.Detail, LastTransitionTime: step.StartedAt}
+		if step.FinishedAt != nil {
+			condition.Status, condition.Reason, condition.LastTransitionTime = "True", "Done", *step.FinishedAt
+			if step.Error != "" {
+				condition.Status, condition.Reason, condition.Message = "False", "Failed", step.Error
+			}
+		}
+		status.Conditions = setCondition(status.Conditions, condition)
+	}
+
+	ready := KubeCondition{Type: "Ready", Status: "Unknown", Reason: "Provisioning", Message: job.Step, LastTransitionTime: job.CreatedAt}
+	switch job.Status {
+	case JobSucceeded:
+		status.Phase, status.Message = MachineReady, ""
+		status.VMName, status.IP = job.Result.Name, job.Result.IP
+		ready = KubeCondition{Type: "Ready", Status: "True", Reason: "Created", LastTransitionTime: *job.FinishedAt}
+	case JobFailed, JobCanceled:
+		status.Phase, status.Message = MachineFailed, job.Error
+		ready = KubeCondition{Type: "Ready", Status: "False", Reason: "CreationFailed", Message: job.Error, LastTransitionTime: *job.FinishedAt}
+		if job.Result != nil && job.Result.Rollback != nil && job.Result.Rollback.Action == RollbackDestroyed {
+			status.VMID = 0 // nothing left to delete
+		}
+	}
+	status.Conditions = setCondition(status.Conditions, ready)
+	return status
+}
+
+// setCondition replaces the condition of the same type, keeping its transition time if the status didn't change
+func setCondition(conditions []KubeCondition, condition KubeCondition) []KubeCondition {
+	conditions = append([]KubeCondition(nil), conditions...)
+	condition.LastTransitionTime = condition.LastTransitionTime.UTC().Truncate(time.Second)
+	for i, c := range conditions {
+		if c.Type == condition.Type {
+			if c.Status == condition.Status {
+				condition.LastTransitionTime = c.LastTransitionTime
+			}
+			conditions[i] = condition
+			return conditions
+		}
+	}
+	return append(conditions, condition)
+}
+
+func findInventoryJob(jobID string) (InventoryVM, bool) {
+	vms := inventory.list(func(vm *InventoryVM) bool { return vm.JobID == jobID && vm.State != InventoryKept })
+	if len(vms) == 0 {
+		return InventoryVM{}, false
+	}
+	return vms[0], true
+}
+
+// patchMachineStatus writes status through the status subresource if it changed
+func patchMachineStatus(ctx context.Context, m *TalosProxmoxMachine, status TalosProxmoxMachineStatus) error {
+	before, _ := json.Marshal(m.Status)
+	after, err := json.Marshal(status)
+	if err != nil || bytes.Equal(before, after) {
+		return err
+	}
+	patch := map[string]interface{}{"status": status}
+	path := crdPath(m.Metadata.Namespace, "talosproxmoxmachines", m.Metadata.Name) + "/status"
+	if err := kubeRequest(ctx, "PATCH", path, "application/merge-patch+json", patch, nil); err != nil {
+		return fmt.Errorf("failed to update status: %w", err)
+	}
+	m.Status = status
+	return nil
+}
+
+func hasFinalizer(m *TalosProxmoxMachine) bool {
+	for _, f := range m.Metadata.Finalizers {
+		if f == machineFinalizer {
+			return true
+		}
+	}
+	return false
+}
+
+// setMachineFinalizers replaces the finalizers; the resourceVersion makes the patch fail if the
+// machine changed since it was read
+func setMachineFinalizers(ctx context.Context, m *TalosProxmoxMachine, finalizers []string) error {
+	if finalizers == nil {
+		finalizers = []string{}
+	}
+	patch := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"finalizers":      finalizers,
+			"resourceVersion": m.Metadata.ResourceVersion,
+		},
+	}
+	var updated TalosProxmoxMachine
+	path := crdPath(m.Metadata.Namespace, "talosproxmoxmachines", m.Metadata.Name)
+	if err := kubeRequest(ctx, "PATCH", path, "application/merge-patch+json", patch, &updated); err != nil {
+		return err
+	}
+	m.Metadata = updated.Metadata
+	return nil
+}
+
+// finalizeMachine deletes the VM of a deleted machine in the background and removes the
+// finalizer once it is gone
+func finalizeMachine(ctx context.Context, m *TalosProxmoxMachine) error {
+	if !hasFinalizer(m) {
+		return nil
+	}
+	if job := getJob(m.Status.JobID); job != nil {
+		if snapshot := job.snapshot(); snapshot.FinishedAt == nil {
+			// Stop the pipeline and delete the VM once it finished
+			if job.cancelJob() {
+				logger.Info("TalosProxmoxMachine %s/%s: deleted while provisioning, canceling job %s", m.Metadata.Namespace, m.Metadata.Name, job.ID)
+			}
+			return patchMachineStatus(ctx, m, machineStatusFromJob(m.Status, snapshot))
+		}
+		m.Status = machineStatusFromJob(m.Status, job.snapshot())
+	}
+
+	machineDeletionsMu.Lock()
+	running := machineDeletions[m.Metadata.UID]
+	machineDeletionsMu.Unlock()
+	if running {
+		return nil
+	}
+
+	status := m.Status
+	status.Phase = MachineDeleting
+	if err := patchMachineStatus(ctx, m, status); err != nil {
+		return err
+	}
+
+	machineDeletionsMu.Lock()
+	machineDeletions[m.Metadata.UID] = true
+	machineDeletionsMu.Unlock()
+	go func(m TalosProxmoxMachine) {
+		defer func() {
+			machineDeletionsMu.Lock()
+			delete(machineDeletions, m.Metadata.UID)
+			machineDeletionsMu.Unlock()
+		}()
+
+		if err := deleteMachineVM(ctx, &m); err != nil {
+			logger.Error("TalosProxmoxMachine %s/%s: failed to delete VM: %s", m.Metadata.Namespace, m.Metadata.Name, err.Error())
+			reportError(err)
+			incErrorCounterHandler("controller")
+			status := m.Status
+			status.Message = err.Error()
+			patchMachineStatus(ctx, &m, status)
+			return
+		}
+
+		var finalizers []string
+		for _, f := range m.Metadata.Finalizers {
+			if f != machineFinalizer {
+				finalizers = append(finalizers, f)
+			}
+		}
+		if err := setMachineFinalizers(ctx, &m, finalizers); err != nil && !isKubeNotFound(err) {
+			logger.Error("TalosProxmoxMachine %s/%s: failed to remove finalizer: %s", m.Metadata.Namespace, m.Metadata.Name, err.Error())
+			reportError(err)
+		}
+	}(*m)
+	return nil
+}
+
+// deleteMachineVM deletes the VM of a machine through the delete path, unless it is already gone
+func deleteMachineVM(ctx context.Context, m *TalosProxmoxMachine) error {
+	if m.Status.VMID == 0 {
+		return nil
+	}
+	vms, err := listVMs(ctx, m.Status.Node)
+	if err != nil {
+		return fmt.Errorf("failed to list VMs on node %s: %w", m.Status.Node, err)
+	}
+	exists := false
+	for _, vm := range vms {
+		exists = exists || vm.VMID == m.Status.VMID
+	}
+	if !exists {
+		logger.Info("TalosProxmoxMachine %s/%s: VM %d is already gone", m.Metadata.Namespace, m.Metadata.Name, m.Status.VMID)
+		if m.Status.VMName != "" {
+			return inventory.remove(m.Status.VMName)
+		}
+		return nil
+	}
+
+	graceful := appConfig.GracefulDelete
+	if m.Spec.GracefulDelete != nil {
+		graceful = *m.Spec.GracefulDelete
+	}
+	d := &deletion{Node: m.Status.Node, VMID: m.Status.VMID, VMName: m.Status.VMName}
+	return d.execute(ctx, "shutdown", graceful)
+}
+
+// syncMachineSet creates or deletes machines owned by set to reach its replica count and
+// updates its status. Owned machines are deleted by the Kubernetes garbage collector when
+// the set is deleted.
+func syncMachineSet(ctx context.Context, set *TalosProxmoxMachineSet, machines []TalosProxmoxMachine) error {
+	if set.Metadata.DeletionTimestamp != nil {
+		return nil
+	}
+
+	var active []TalosProxmoxMachine
+	ready := 0
+	for _, m := range machines {
+		if !ownedBy(m.Metadata, set.Metadata.UID) || m.Metadata.DeletionTimestamp != nil {
+			continue
+		}
+		active = append(active, m)
+		if m.Status.Phase == MachineReady {
+			ready++
+		}
+	}
+
+	switch {
+	case len(active) < set.Spec.Replicas:
+		for i := len(active); i < set.Spec.Replicas; i++ {
+			if err := createSetMachine(ctx, set); err != nil {
+				return fmt.Errorf("failed to create TalosProxmoxMachine: %w", err)
+			}
+		}
+	case len(active) > set.Spec.Replicas:
+		// Machines that aren't ready go first, then the newest
+		sort.SliceStable(active, func(i, j int) bool {
+			iReady, jReady := active[i].Status.Phase == MachineReady, active[j].Status.Phase == MachineReady
+			if iReady != jReady {
+				return !iReady
+			}
+			return active[i].Metadata.CreationTimestamp.After(*active[j].Metadata.CreationTimestamp)
+		})
+		for _, m := range active[:len(active)-set.Spec.Replicas] {
+			logger.Info("TalosProxmoxMachineSet %s/%s: deleting surplus machine %s", set.Metadata.Namespace, set.Metadata.Name, m.Metadata.Name)
+			path := crdPath(m.Metadata.Namespace, "talosproxmoxmachines", m.Metadata.Name)
+			if err := kubeRequest(ctx, "DELETE", path, "", nil, nil); err != nil && !isKubeNotFound(err) {
+				return fmt.Errorf("failed to delete TalosProxmoxMachine %s: %w", m.Metadata.Name, err)
+			}
+		}
+	}
+
+	if set.Status.Replicas == len(active) && set.Status.ReadyReplicas == ready {
+		return nil
+	}
+	patch := map[string]interface{}{"status": map[string]int{"replicas": len(active), "readyReplicas": ready}}
+	path := crdPath(set.Metadata.Namespace, "talosproxmoxmachinesets", set.Metadata.Name) + "/status"
+	return kubeRequest(ctx, "PATCH", path, "application/merge-patch+json", patch, nil)
+}
+
+func ownedBy(meta KubeObjectMeta, uid string) bool {
+	for _, owner := range meta.OwnerReferences {
+		if owner.UID == uid {
+			return true
+		}
+	}
+	return false
+}
+
+// createSetMachine creates a machine from the template of set. Generated VM names are used,
+// since replicas can't share spec.vmName.
+func createSetMachine(ctx context.Context, set *TalosProxmoxMachineSet) error {
+	labels := map[string]string{}
+	for k, v := range set.Spec.Template.Metadata.Labels {
+		labels[k] = v
+	}
+	labels[machineSetLabel] = set.Metadata.Name
+
+	spec := set.Spec.Template.Spec
+	spec.VMName = ""
+	machine := TalosProxmoxMachine{
+		APIVersion: crdAPIVersion,
+		Kind:       "TalosProxmoxMachine",
+		Metadata: KubeObjectMeta{
+			GenerateName: set.Metadata.Name + "-",
+			Namespace:    set.Metadata.Namespace,
+			Labels:       labels,
+			Finalizers:   []string{machineFinalizer},
+			OwnerReferences: []KubeOwnerReference{{
+				APIVersion:         crdAPIVersion,
+				Kind:               "TalosProxmoxMachineSet",
+				Name:               set.Metadata.Name,
+				UID:                set.Metadata.UID,
+				Controller:         true,
+				BlockOwnerDeletion: true,
+			}},
+		},
+		Spec: spec,
+	}
+	var created TalosProxmoxMachine
+	if err := kubeRequest(ctx, "POST", crdPath(set.Metadata.Namespace, "talosproxmoxmachines", ""), "", machine, &created); err != nil {
+		return err
+	}
+	logger.Info("TalosProxmoxMachineSet %s/%s: created machine %s", set.Metadata.Namespace, set.Metadata.Name, created.Metadata.Name)
+	return nil
+}
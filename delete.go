@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Phases of a VM deletion, in the order they run. Everything before PhaseStop only runs
+// for graceful deletes.
+const (
+	PhaseCordon     = "cordon"
+	PhaseDrain      = "drain"
+	PhaseEtcdLeave  = "etcd_leave"
+	PhaseTalosReset = "talos_reset"
+	PhaseDeleteNode = "delete_node"
+	PhaseStop       = "stop"
+	PhaseDelete     = "delete"
+)
+
+// Outcomes of a deletion phase
+const (
+	PhaseDone    = "done"
+	PhaseSkipped = "skipped"
+	PhaseFailed  = "failed"
+)
+
+type DeletePhase struct {
+	Name            string  `json:"name"`
+	Status          string  `json:"status"`
+	Reason          string  `json:"reason,omitempty"` // why the phase was skipped
+	Error           string  `json:"error,omitempty"`
+	DurationSeconds float64 `json:"duration_seconds"`
+}
+
+// phaseError is a deletion phase that failed and stopped the deletion
+type phaseError struct {
+	Phase   string
+	Message string
+	Err     error
+}
+
+func (e *phaseError) Error() string {
+	return e.Message + ": " + e.Err.Error()
+}
+
+func (e *phaseError) Unwrap() error {
+	return e.Err
+}
+
+// deletion records the phases of one VM deletion
+type deletion struct {
+	Node      string
+	VMID      int
+	VMName    string
+	Force     bool // continue with the next phase when a graceful phase fails
+	Phases    []DeletePhase
+	VMStopped bool
+}
+
+// execute removes the node from the cluster (if graceful), stops and deletes the VM
+// and forgets it in the inventory
+func (d *deletion) execute(ctx context.Context, stopMethod string, graceful bool) error {
+	logger.Info("Starting VM deletion: node=%s, vm_id=%d, stop_method=%s, graceful=%t", d.Node, d.VMID, stopMethod, graceful)
+	if d.VMName == "" {
+		if vm, ok := inventory.findByID(d.Node, d.VMID); ok {
+			d.VMName = vm.Name
+		}
+	}
+	if graceful {
+		if d.VMName == "" {
+			vmConfig, err := getVMConfig(ctx, d.Node, d.VMID)
+			if err != nil {
+				return fmt.Errorf("failed to get VM config: %w", err)
+			}
+			d.VMName, _ = vmConfig["name"].(string)
+		}
+		if err := d.removeFromCluster(ctx); err != nil {
+			return err
+		}
+	}
+
+	if err := d.run(PhaseStop, "Failed to stop VM", func() (string, error) {
+		if d.VMStopped {
+			return "powered off by Talos reset", nil
+		}
+		stopTask, err := stopVM(ctx, d.Node, d.VMID, stopMethod)
+		if err != nil {
+			return "", err
+		}
+		if stopTask == "" {
+			logger.Info("VM stop completed synchronously")
+			return "", nil
+		}
+		return "", trackTask(ctx, d.Node, stopTask)
+	}); err != nil {
+		return err
+	}
+
+	if err := d.run(PhaseDelete, "Failed to delete VM", func() (string, error) {
+		deleteTask, err := deleteVM(ctx, d.Node, d.VMID)
+		if err != nil || deleteTask == "" {
+			return "", err
+		}
+		return "", trackTask(ctx, d.Node, deleteTask)
+	}); err != nil {
+		return err
+	}
+
+	deletedCounter.With(prometheus.Labels{
+		"node": d.Node,
+	}).Inc()
+	if err := inventory.remove(d.VMName); err != nil {
+		logger.Error("Failed to remove VM %s from inventory: %s", d.VMName, err.Error())
+		reportError(err)
+	}
+	return nil
+}
+
+// run executes one phase. fn returns a non-empty reason to mark the phase skipped.
+// A failed phase stops the deletion unless it is a graceful phase and Force is set.
+func (d *deletion) run(name string, message string, fn func() (string, error)) error {
+	start := time.Now()
+	reason, err := fn()
+	phase := DeletePhase{Name: name, Status: PhaseDone, DurationSeconds: time.Since(start).Seconds()}
+	switch {
+	case err != nil:
+		phase.Status = PhaseFailed
+		phase.Error = err.Error()
+	case reason != "":
+		phase.Status = PhaseSkipped
+		phase.Reason = reason
+	}
+	d.Phases = append(d.Phases, phase)
+
+	if err == nil {
+		if reason != "" {
+			logger.Info("Deletion of %s: %s skipped: %s", d.VMName, name, reason)
+		}
+		return nil
+	}
+	if d.Force && name != PhaseStop && name != PhaseDelete {
+		logger.Error("Deletion of %s: %s failed, continuing: %s", d.VMName, name, err.Error())
+		reportError(err)
+		return nil
+	}
+	return &phaseError{Phase: name, Message: message, Err: err}
+}
+
+// removeFromCluster cordons and drains the Kubernetes node, removes control plane nodes
+// from etcd, resets Talos and deletes the Node object before the VM is destroyed
+func (d *deletion) removeFromCluster(ctx context.Context) error {
+	var kubeNode *KubeNode
+	if err := d.run(PhaseCordon, "Failed to cordon node", func() (string, error) {
+		node, err := getKubeNode(ctx, d.VMName)
+		if isKubeNotFound(err) {
+			return "node not registered in Kubernetes", nil
+		}
+		if err != nil {
+			return "", err
+		}
+		kubeNode = node
+		return "", cordonKubeNode(ctx, d.VMName)
+	}); err != nil {
+		return err
+	}
+
+	if err := d.run(PhaseDrain, "Failed to drain node", func() (string, error) {
+		if kubeNode == nil {
+			return "node not registered in Kubernetes", nil
+		}
+		return "", drainKubeNode(ctx, d.VMName, appConfig.DrainTimeout)
+	}); err != nil {
+		return err
+	}
+
+	var nodeIP string
+	if kubeNode != nil {
+		nodeIP = kubeNode.internalIP()
+	}
+
+	if err := d.run(PhaseEtcdLeave, "Failed to remove etcd member", func() (string, error) {
+		if kubeNode == nil {
+			return "role unknown, node not registered in Kubernetes", nil
+		}
+		if !kubeNode.isControlPlane() {
+			return "not a control plane node", nil
+		}
+		if talosClient == nil {
+			return "", fmt.Errorf("TALOSCONFIG is required to remove control plane nodes from etcd")
+		}
+		if nodeIP != "" {
+			err := talosEtcdLeave(ctx, nodeIP)
+			if err == nil {
+				return "", nil
+			}
+			logger.Error("Node %s failed to leave etcd, removing the member through another control plane: %s", d.VMName, err.Error())
+		}
+		return "", talosEtcdRemoveMember(ctx, d.VMName, nodeIP)
+	}); err != nil {
+		return err
+	}
+
+	if err := d.run(PhaseTalosReset, "Failed to reset Talos", func() (string, error) {
+		if talosClient == nil {
+			return "TALOSCONFIG not configured", nil
+		}
+		if nodeIP == "" {
+			return "node address unknown", nil
+		}
+		if err := talosReset(ctx, nodeIP); err != nil {
+			return "", err
+		}
+		return "", d.waitForPowerOff(ctx, appConfig.ResetTimeout)
+	}); err != nil {
+		return err
+	}
+
+	return d.run(PhaseDeleteNode, "Failed to delete Kubernetes node", func() (string, error) {
+		if kubeNode == nil {
+			return "node not registered in Kubernetes", nil
+		}
+		return "", deleteKubeNode(ctx, d.VMName)
+	})
+}
+
+// waitForPowerOff waits for the VM to power itself off after a Talos reset
+func (d *deletion) waitForPowerOff(ctx context.Context, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		status, err := getVMStatus(ctx, d.Node, d.VMID)
+		if err == nil && status == "stopped" {
+			d.VMStopped = true
+			return nil
+		}
+		if time.Now().After(deadline) {
+			if err != nil {
+				return err
+			}
+			return fmt.Errorf("VM still %s %v after reset", status, timeout)
+		}
+		if err := sleepContext(ctx, 5*time.Second); err != nil {
+			return err
+		}
+	}
+}
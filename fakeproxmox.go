@@ -0,0 +1,411 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FakeProxmox is an in-memory stand-in for the parts of the Proxmox VE API the deployer uses,
+// for tests and for local development without a cluster (PROXMOX_FAKE). Requests take effect
+// right away; their tasks report running for TaskDuration. Failures and delays are scripted
+// with Fault.
+type FakeProxmox struct {
+	mu       sync.Mutex
+	vms      map[string]map[int]*FakeVM // by node and vmid
+	tasks    map[string]*fakeTask       // by UPID
+	faults   []*FakeFault
+	requests []string
+	taskSeq  int
+
+	TaskDuration time.Duration // how long tasks report running
+	GuestIP      string        // address reported by the guest agent of running VMs
+}
+
+// FakeVM is a VM (or template) of the fake cluster
+type FakeVM struct {
+	Node     string
+	VMID     int
+	Name     string
+	Status   string // running or stopped
+	Template bool
+	Config   map[string]string
+}
+
+type fakeTask struct {
+	exitStatus string
+	log        []string
+	endsAt     time.Time
+}
+
+// FakeFault scripts the answer to matching requests
+type FakeFault struct {
+	Method     string        // any method if empty
+	Path       string        // suffix of the API path, e.g. "/clone", "/status/start" or "/cluster/nextid"
+	Times      int           // number of requests it applies to, 0 for all
+	Delay      time.Duration // before the request is answered
+	Status     int           // answer with this HTTP status instead of handling the request
+	Message    string        // error message of Status
+	TaskStatus string        // the task started by the request fails with this exit status and has no effect
+	TaskLog    []string      // log lines of the failed task
+}
+
+// fakeAPIError is an error response of the fake API
+type fakeAPIError struct {
+	status  int
+	message string
+}
+
+func NewFakeProxmox() *FakeProxmox {
+	return &FakeProxmox{
+		vms:     map[string]map[int]*FakeVM{},
+		tasks:   map[string]*fakeTask{},
+		GuestIP: "192.0.2.10",
+	}
+}
+
+// newFakeProxmoxFromConfig creates a fake cluster with the nodes and base templates of cfg
+func newFakeProxmoxFromConfig(cfg Config) *FakeProxmox {
+	f := NewFakeProxmox()
+	for _, node := range cfg.Nodes {
+		for _, template := range node.BaseTemplates {
+			f.AddVM(FakeVM{Node: node.Name, VMID: template.ID, Name: template.Name, Template: true})
+		}
+	}
+	return f
+}
+
+// AddVM puts a VM on the fake cluster; it gets a virtio0 disk and net0 if its config doesn't have them
+func (f *FakeProxmox) AddVM(vm FakeVM) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if vm.Status == "" {
+		vm.Status = "stopped"
+	}
+	config := map[string]string{
+		"name":    vm.Name,
+		"virtio0": fmt.Sprintf("local-lvm:vm-%d-disk-0,size=10G", vm.VMID),
+		"net0":    "virtio=BC:24:11:00:00:01,bridge=vmbr0",
+	}
+	if vm.Template {
+		config["template"] = "1"
+	}
+	for key, value := range vm.Config {
+		config[key] = value
+	}
+	vm.Config = config
+	if f.vms[vm.Node] == nil {
+		f.vms[vm.Node] = map[int]*FakeVM{}
+	}
+	f.vms[vm.Node][vm.VMID] = &vm
+}
+
+// VM returns a copy of a VM of the fake cluster
+func (f *FakeProxmox) VM(node string, vmid int) (FakeVM, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	vm, ok := f.vms[node][vmid]
+	if !ok {
+		return FakeVM{}, false
+	}
+	cp := *vm
+	cp.Config = map[string]string{}
+	for key, value := range vm.Config {
+		cp.Config[key] = value
+	}
+	return cp, true
+}
+
+// VMs returns the VMs (not templates) on node, ordered by vmid
+func (f *FakeProxmox) VMs(node string) []FakeVM {
+	f.mu.Lock()
+	ids := []int{}
+	for vmid, vm := range f.vms[node] {
+		if !vm.Template {
+			ids = append(ids, vmid)
+		}
+	}
+	f.mu.Unlock()
+	sort.Ints(ids)
+	var vms []FakeVM
+	for _, vmid := range ids {
+		if vm, ok := f.VM(node, vmid); ok {
+			vms = append(vms, vm)
+		}
+	}
+	return vms
+}
+
+// Fault scripts the answer to requests matching fault.Method and fault.Path
+func (f *FakeProxmox) Fault(fault FakeFault) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.faults = append(f.faults, &fault)
+}
+
+// Requests returns the requests received so far as "METHOD path"
+func (f *FakeProxmox) Requests() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.requests...)
+}
+
+// matchFault returns the first fault that applies to the request, using it up; callers hold f.mu
+func (f *FakeProxmox) matchFault(method string, path string) *FakeFault {
+	for i, fault := range f.faults {
+		if (fault.Method != "" && fault.Method != method) || !strings.HasSuffix(path, fault.Path) {
+			continue
+		}
+		if fault.Times > 0 {
+			fault.Times--
+			if fault.Times == 0 {
+				f.faults = append(f.faults[:i:i], f.faults[i+1:]...)
+			}
+		}
+		return fault
+	}
+	return nil
+}
+
+func (f *FakeProxmox) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/api2/json")
+	if err := r.ParseForm(); err != nil {
+		writeFakeError(w, &fakeAPIError{http.StatusBadRequest, err.Error()})
+		return
+	}
+
+	f.mu.Lock()
+	f.requests = append(f.requests, r.Method+" "+path)
+	fault := f.matchFault(r.Method, path)
+	f.mu.Unlock()
+
+	if fault != nil && fault.Delay > 0 {
+		select {
+		case <-time.After(fault.Delay):
+		case <-r.Context().Done():
+			return
+		}
+	}
+	if fault != nil && fault.Status != 0 {
+		writeFakeError(w, &fakeAPIError{fault.Status, fault.Message})
+		return
+	}
+
+	f.mu.Lock()
+	data, apiErr := f.handle(r.Method, path, r.Form, fault)
+	f.mu.Unlock()
+	if apiErr != nil {
+		writeFakeError(w, apiErr)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+}
+
+func writeFakeError(w http.ResponseWriter, apiErr *fakeAPIError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(apiErr.status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"data": nil, "message": apiErr.message})
+}
+
+// handle serves a request; callers hold f.mu
+func (f *FakeProxmox) handle(method string, path string, form url.Values, fault *FakeFault) (interface{}, *fakeAPIError) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	route := method + " " + strings.Join(parts, "/")
+	switch {
+	case route == "GET cluster/nextid":
+		vmid := 100
+		for f.vmExists(vmid) {
+			vmid++
+		}
+		return strconv.Itoa(vmid), nil
+	case len(parts) < 2 || parts[0] != "nodes":
+		return nil, &fakeAPIError{http.StatusNotImplemented, "Method '" + route + "' not implemented"}
+	}
+
+	node := parts[1]
+	rest := strings.Join(parts[2:], "/")
+	switch {
+	case method == "GET" && rest == "status":
+		return map[string]interface{}{
+			"cpuinfo": map[string]int{"cpus": 64},
+			"memory":  map[string]int64{"total": 256 << 30, "used": 0, "free": 256 << 30},
+		}, nil
+	case method == "GET" && len(parts) == 5 && parts[2] == "storage" && parts[4] == "status":
+		return map[string]int64{"total": 10 << 40, "used": 0, "avail": 10 << 40}, nil
+	case method == "GET" && rest == "qemu":
+		list := []map[string]interface{}{}
+		for _, vm := range f.vms[node] {
+			template := 0
+			if vm.Template {
+				template = 1
+			}
+			list = append(list, map[string]interface{}{"vmid": vm.VMID, "name": vm.Name, "status": vm.Status, "template": template})
+		}
+		return list, nil
+	case len(parts) == 5 && parts[2] == "tasks":
+		return f.handleTask(method, parts[3], parts[4], form)
+	case len(parts) >= 4 && parts[2] == "qemu":
+		vmid, err := strconv.Atoi(parts[3])
+		if err != nil {
+			return nil, &fakeAPIError{http.StatusBadRequest, "invalid vmid " + parts[3]}
+		}
+		return f.handleVM(method, node, vmid, strings.Join(parts[4:], "/"), form, fault)
+	}
+	return nil, &fakeAPIError{http.StatusNotImplemented, "Method '" + route + "' not implemented"}
+}
+
+func (f *FakeProxmox) handleTask(method string, upid string, action string, form url.Values) (interface{}, *fakeAPIError) {
+	task, ok := f.tasks[upid]
+	if !ok || method != "GET" {
+		return nil, &fakeAPIError{http.StatusInternalServerError, "no such task"}
+	}
+	switch action {
+	case "status":
+		if time.Now().Before(task.endsAt) {
+			return map[string]string{"status": "running"}, nil
+		}
+		return map[string]string{"status": "stopped", "exitstatus": task.exitStatus}, nil
+	case "log":
+		start, _ := strconv.Atoi(form.Get("start"))
+		limit, err := strconv.Atoi(form.Get("limit"))
+		if err != nil || limit <= 0 {
+			limit = 50
+		}
+		var lines []map[string]interface{}
+		for i := start; i < len(task.log) && len(lines) < limit; i++ {
+			lines = append(lines, map[string]interface{}{"n": i + 1, "t": task.log[i]})
+		}
+		if len(lines) == 0 {
+			lines = append(lines, map[string]interface{}{"n": start + 1, "t": "no content"})
+		}
+		return lines, nil
+	}
+	return nil, &fakeAPIError{http.StatusNotImplemented, "unknown task action " + action}
+}
+
+func (f *FakeProxmox) handleVM(method string, node string, vmid int, action string, form url.Values, fault *FakeFault) (interface{}, *fakeAPIError) {
+	vm, ok := f.vms[node][vmid]
+	if !ok {
+		return nil, &fakeAPIError{http.StatusInternalServerError, fmt.Sprintf("Configuration file 'nodes/%s/qemu-server/%d.conf' does not exist", node, vmid)}
+	}
+	// A task failed by a fault leaves the VM as it was
+	succeeds := fault == nil || fault.TaskStatus == ""
+
+	switch method + " " + action {
+	case "POST clone":
+		newid, err := strconv.Atoi(form.Get("newid"))
+		if err != nil {
+			return nil, &fakeAPIError{http.StatusBadRequest, "invalid newid"}
+		}
+		if f.vmExists(newid) {
+			return nil, &fakeAPIError{http.StatusInternalServerError, fmt.Sprintf("unable to create VM %d: config file already exists", newid)}
+		}
+		if succeeds {
+			clone := &FakeVM{Node: node, VMID: newid, Name: form.Get("name"), Status: "stopped", Config: map[string]string{}}
+			for key, value := range vm.Config {
+				clone.Config[key] = value
+			}
+			delete(clone.Config, "template")
+			clone.Config["name"] = clone.Name
+			clone.Config["virtio0"] = strings.Replace(clone.Config["virtio0"], fmt.Sprintf("-%d-", vmid), fmt.Sprintf("-%d-", newid), 1)
+			f.vms[node][newid] = clone
+		}
+		return f.newTask(node, "qmclone", vmid, fault), nil
+	case "GET config":
+		return vm.Config, nil
+	case "POST config", "PUT config":
+		if succeeds {
+			for key, values := range form {
+				if key == "delete" {
+					for _, deleted := range strings.Split(values[0], ",") {
+						delete(vm.Config, deleted)
+					}
+				} else {
+					vm.Config[key] = values[0]
+				}
+			}
+		}
+		if method == "PUT" {
+			return nil, nil
+		}
+		return f.newTask(node, "qmconfig", vmid, fault), nil
+	case "PUT resize":
+		disk := form.Get("disk")
+		if _, ok := vm.Config[disk]; !ok {
+			return nil, &fakeAPIError{http.StatusBadRequest, "disk '" + disk + "' does not exist"}
+		}
+		if succeeds {
+			options := strings.Split(vm.Config[disk], ",")
+			for i, option := range options {
+				if strings.HasPrefix(option, "size=") {
+					options[i] = "size=" + form.Get("size")
+				}
+			}
+			vm.Config[disk] = strings.Join(options, ",")
+		}
+		return nil, nil
+	case "GET status/current":
+		return map[string]string{"status": vm.Status}, nil
+	case "POST status/start", "POST status/stop", "POST status/shutdown", "POST status/reset":
+		kind := "qm" + strings.TrimPrefix(action, "status/")
+		if action == "status/reset" && vm.Status != "running" {
+			return nil, &fakeAPIError{http.StatusInternalServerError, fmt.Sprintf("VM %d not running", vmid)}
+		}
+		if succeeds {
+			vm.Status = "stopped"
+			if action == "status/start" || action == "status/reset" {
+				vm.Status = "running"
+			}
+		}
+		return f.newTask(node, kind, vmid, fault), nil
+	case "DELETE ":
+		if vm.Status == "running" {
+			fault = &FakeFault{TaskStatus: fmt.Sprintf("VM %d is running - destroy failed", vmid)}
+		} else if succeeds {
+			delete(f.vms[node], vmid)
+		}
+		return f.newTask(node, "qmdestroy", vmid, fault), nil
+	case "GET agent/network-get-interfaces":
+		if vm.Status != "running" {
+			return nil, &fakeAPIError{http.StatusInternalServerError, fmt.Sprintf("VM %d is not running", vmid)}
+		}
+		return map[string]interface{}{"result": []map[string]interface{}{
+			{"name": "lo", "ip-addresses": []map[string]string{{"ip-address": "127.0.0.1", "ip-address-type": "ipv4"}}},
+			{"name": "eth0", "ip-addresses": []map[string]string{{"ip-address": f.GuestIP, "ip-address-type": "ipv4"}}},
+		}}, nil
+	}
+	return nil, &fakeAPIError{http.StatusNotImplemented, "Method '" + method + " " + action + "' not implemented"}
+}
+
+// newTask starts a task that stops after TaskDuration, failed if fault says so; callers hold f.mu
+func (f *FakeProxmox) newTask(node string, kind string, vmid int, fault *FakeFault) string {
+	f.taskSeq++
+	upid := fmt.Sprintf("UPID:%s:%08X:00000000:%08X:%s:%d:root@pam:", node, f.taskSeq, time.Now().Unix(), kind, vmid)
+	task := &fakeTask{exitStatus: "OK", log: []string{kind + " " + strconv.Itoa(vmid)}, endsAt: time.Now().Add(f.TaskDuration)}
+	if fault != nil && fault.TaskStatus != "" {
+		task.exitStatus = fault.TaskStatus
+		task.log = append(task.log, fault.TaskLog...)
+		task.log = append(task.log, "TASK ERROR: "+fault.TaskStatus)
+	} else {
+		task.log = append(task.log, "TASK OK")
+	}
+	f.tasks[upid] = task
+	return upid
+}
+
+// vmExists reports whether vmid is used on any node; callers hold f.mu
+func (f *FakeProxmox) vmExists(vmid int) bool {
+	for _, vms := range f.vms {
+		if _, ok := vms[vmid]; ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Minimal gRPC-over-HTTP/2 and protobuf wire helpers. The deployer only needs a handful of
+// unary calls, as a client and as a server, so messages are encoded by hand instead of
+// pulling in generated code.
+
+// gRPC status codes
+var grpcCodeNames = []string{
+	"OK", "Canceled", "Unknown", "InvalidArgument", "DeadlineExceeded", "NotFound", "AlreadyExists",
+	"PermissionDenied", "ResourceExhausted", "FailedPrecondition", "Aborted", "OutOfRange",
+	"Unimplemented", "Internal", "Unavailable", "DataLoss", "Unauthenticated",
+}
+
+const (
+	grpcCodeInvalidArgument    = 3
+	grpcCodeNotFound           = 5
+	grpcCodeFailedPrecondition = 9
+	grpcCodeUnimplemented      = 12
+	grpcCodeInternal           = 13
+)
+
+// GRPCError is a non-OK status returned by a gRPC server
+type GRPCError struct {
+	Method  string
+	Code    int
+	Message string
+}
+
+func (e *GRPCError) CodeName() string {
+	if e.Code >= 0 && e.Code < len(grpcCodeNames) {
+		return grpcCodeNames[e.Code]
+	}
+	return "Code(" + strconv.Itoa(e.Code) + ")"
+}
+
+func (e *GRPCError) Error() string {
+	return fmt.Sprintf("%s: %s: %s", e.Method, e.CodeName(), e.Message)
+}
+
+// grpcInvoke performs a unary gRPC call against baseURL (e.g. https://10.0.0.5:50000) and returns the response message
+func grpcInvoke(ctx context.Context, client *http.Client, baseURL string, method string, message []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", baseURL+method, bytes.NewReader(grpcFrame(message)))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: unexpected HTTP status %s", method, resp.Status)
+	}
+
+	// Errors may come as trailers or, without a body, as headers ("Trailers-Only")
+	status := resp.Trailer.Get("Grpc-Status")
+	statusMessage := resp.Trailer.Get("Grpc-Message")
+	if status == "" {
+		status = resp.Header.Get("Grpc-Status")
+		statusMessage = resp.Header.Get("Grpc-Message")
+	}
+	if status == "" {
+		return nil, fmt.Errorf("%s: response without grpc-status", method)
+	}
+	if status != "0" {
+		code, err := strconv.Atoi(status)
+		if err != nil {
+			code = 2
+		}
+		if unescaped, err := url.PathUnescape(statusMessage); err == nil {
+			statusMessage = unescaped
+		}
+		return nil, &GRPCError{Method: method, Code: code, Message: statusMessage}
+	}
+
+	messages, err := grpcUnframe(body)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", method, err)
+	}
+	if len(messages) == 0 {
+		return nil, nil
+	}
+	return messages[0], nil
+}
+
+// grpcMethod handles one unary call; a *GRPCError return sets the status code, other errors are Internal
+type grpcMethod func(request []byte) ([]byte, error)
+
+// grpcHandler serves the unary methods of a gRPC service over HTTP/2. Methods missing from
+// the map answer Unimplemented.
+func grpcHandler(service string, methods map[string]grpcMethod) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.ProtoMajor != 2 || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+			http.Error(w, "gRPC over HTTP/2 only", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		response, err := grpcDispatch(r, service, methods)
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		w.WriteHeader(http.StatusOK)
+		if err != nil {
+			w.Header().Set("Grpc-Status", strconv.Itoa(err.Code))
+			w.Header().Set("Grpc-Message", url.PathEscape(err.Message))
+			return
+		}
+		w.Write(grpcFrame(response))
+		w.Header().Set("Grpc-Status", "0")
+	})
+}
+
+// grpcDispatch reads the request message and calls the method named by the request path
+func grpcDispatch(r *http.Request, service string, methods map[string]grpcMethod) ([]byte, *GRPCError) {
+	name, ok := strings.CutPrefix(r.URL.Path, "/"+service+"/")
+	method := methods[name]
+	if !ok || method == nil {
+		return nil, &GRPCError{Method: r.URL.Path, Code: grpcCodeUnimplemented, Message: "unknown method " + r.URL.Path}
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, &GRPCError{Method: r.URL.Path, Code: grpcCodeInternal, Message: err.Error()}
+	}
+	messages, err := grpcUnframe(body)
+	if err != nil || len(messages) != 1 {
+		return nil, &GRPCError{Method: r.URL.Path, Code: grpcCodeInvalidArgument, Message: "expected exactly one request message"}
+	}
+
+	response, err := method(messages[0])
+	if err != nil {
+		var grpcErr *GRPCError
+		if errors.As(err, &grpcErr) {
+			return nil, grpcErr
+		}
+		return nil, &GRPCError{Method: r.URL.Path, Code: grpcCodeInternal, Message: err.Error()}
+	}
+	return response, nil
+}
+
+// grpcFrame prefixes an uncompressed message with the gRPC length-prefixed header
+func grpcFrame(message []byte) []byte {
+	frame := make([]byte, 5+len(message))
+	binary.BigEndian.PutUint32(frame[1:5], uint32(len(message)))
+	copy(frame[5:], message)
+	return frame
+}
+
+// grpcUnframe splits a gRPC body into messages
+func grpcUnframe(body []byte) ([][]byte, error) {
+	var messages [][]byte
+	for len(body) > 0 {
+		if len(body) < 5 {
+			return nil, errors.New("truncated gRPC frame header")
+		}
+		if body[0] != 0 {
+			return nil, errors.New("compressed gRPC messages are not supported")
+		}
+		length := binary.BigEndian.Uint32(body[1:5])
+		if uint32(len(body)-5) < length {
+			return nil, errors.New("truncated gRPC message")
+		}
+		messages = append(messages, body[5:5+length])
+		body = body[5+length:]
+	}
+	return messages, nil
+}
+
+// Protobuf wire types
+const (
+	protoVarint = 0
+	protoBytes  = 2
+)
+
+type protoField struct {
+	Num    int
+	Type   int
+	Varint uint64
+	Bytes  []byte
+}
+
+func protoAppendTag(buf []byte, num int, wireType int) []byte {
+	return binary.AppendUvarint(buf, uint64(num)<<3|uint64(wireType))
+}
+
+func protoAppendVarint(buf []byte, num int, value uint64) []byte {
+	if value == 0 {
+		return buf
+	}
+	buf = protoAppendTag(buf, num, protoVarint)
+	return binary.AppendUvarint(buf, value)
+}
+
+func protoAppendBool(buf []byte, num int, value bool) []byte {
+	if !value {
+		return buf
+	}
+	return protoAppendVarint(buf, num, 1)
+}
+
+func protoAppendBytes(buf []byte, num int, value []byte) []byte {
+	buf = protoAppendTag(buf, num, protoBytes)
+	buf = binary.AppendUvarint(buf, uint64(len(value)))
+	return append(buf, value...)
+}
+
+func protoAppendString(buf []byte, num int, value string) []byte {
+	if value == "" {
+		return buf
+	}
+	return protoAppendBytes(buf, num, []byte(value))
+}
+
+// protoParse decodes the top-level fields of a message; fixed32/fixed64 fields are skipped
+func protoParse(data []byte) ([]protoField, error) {
+	var fields []protoField
+	for len(data) > 0 {
+		tag, n := binary.Uvarint(data)
+		if n <= 0 {
+			return nil, errors.New("invalid protobuf tag")
+		}
+		data = data[n:]
+		field := protoField{Num: int(tag >> 3), Type: int(tag & 7)}
+
+		switch field.Type {
+		case protoVarint:
+			value, n := binary.Uvarint(data)
+			if n <= 0 {
+				return nil, errors.New("invalid protobuf varint")
+			}
+			field.Varint = value
+			data = data[n:]
+		case protoBytes:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < length {
+				return nil, errors.New("invalid protobuf length")
+			}
+			field.Bytes = data[n : n+int(length)]
+			data = data[n+int(length):]
+		case 1: // fixed64
+			if len(data) < 8 {
+				return nil, errors.New("truncated protobuf fixed64")
+			}
+			data = data[8:]
+			continue
+		case 5: // fixed32
+			if len(data) < 4 {
+				return nil, errors.New("truncated protobuf fixed32")
+			}
+			data = data[4:]
+			continue
+		default:
+			return nil, fmt.Errorf("unsupported protobuf wire type %d", field.Type)
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGRPCFrame(t *testing.T) {
+	frame := grpcFrame([]byte("abc"))
+	if want := []byte{0, 0, 0, 0, 3, 'a', 'b', 'c'}; !bytes.Equal(frame, want) {
+		t.Fatalf("grpcFrame = %v, want %v", frame, want)
+	}
+
+	messages, err := grpcUnframe(append(frame, grpcFrame(nil)...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 2 || string(messages[0]) != "abc" || len(messages[1]) != 0 {
+		t.Errorf("grpcUnframe = %q", messages)
+	}
+
+	for name, body := range map[string][]byte{
+		"truncated header":  {0, 0, 0},
+		"truncated message": {0, 0, 0, 0, 5, 'a'},
+		"compressed":        {1, 0, 0, 0, 1, 'a'},
+	} {
+		if _, err := grpcUnframe(body); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestProtoEncoding(t *testing.T) {
+	var message []byte
+	message = protoAppendVarint(message, 4, 300)
+	message = protoAppendVarint(message, 5, 0) // zero values are omitted, as in proto3
+	message = protoAppendBool(message, 6, true)
+	message = protoAppendString(message, 1, "hi")
+	message = protoAppendString(message, 2, "")
+	want := []byte{0x20, 0xac, 0x02, 0x30, 0x01, 0x0a, 0x02, 'h', 'i'}
+	if !bytes.Equal(message, want) {
+		t.Fatalf("encoded %x, want %x", message, want)
+	}
+
+	fields, err := protoParse(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fields) != 3 ||
+		fields[0].Num != 4 || fields[0].Type != protoVarint || fields[0].Varint != 300 ||
+		fields[1].Num != 6 || fields[1].Varint != 1 ||
+		fields[2].Num != 1 || fields[2].Type != protoBytes || string(fields[2].Bytes) != "hi" {
+		t.Errorf("protoParse = %+v", fields)
+	}
+
+	if _, err := protoParse([]byte{0x0a, 0x05, 'a'}); err == nil {
+		t.Error("expected an error for a truncated field")
+	}
+}
+
+// newGRPCTestServer serves handler over HTTP/2 with TLS, like a Talos node
+func newGRPCTestServer(t *testing.T, handler http.Handler) *httptest.Server {
+	t.Helper()
+	server := httptest.NewUnstartedServer(handler)
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestGRPCInvoke(t *testing.T) {
+	server := newGRPCTestServer(t, grpcHandler("test.Service", map[string]grpcMethod{
+		"Echo": func(request []byte) ([]byte, error) { return request, nil },
+		"Fail": func(request []byte) ([]byte, error) {
+			return nil, &GRPCError{Code: grpcCodeInvalidArgument, Message: "bad config: 100% wrong"}
+		},
+		"Crash": func(request []byte) ([]byte, error) { return nil, errors.New("boom") },
+	}))
+	ctx := context.Background()
+
+	response, err := grpcInvoke(ctx, server.Client(), server.URL, "/test.Service/Echo", []byte("ping"))
+	if err != nil || string(response) != "ping" {
+		t.Errorf("Echo = %q, %v", response, err)
+	}
+
+	for method, want := range map[string]GRPCError{
+		"/test.Service/Fail":    {Code: grpcCodeInvalidArgument, Message: "bad config: 100% wrong"},
+		"/test.Service/Crash":   {Code: grpcCodeInternal, Message: "boom"},
+		"/test.Service/Missing": {Code: grpcCodeUnimplemented, Message: "unknown method /test.Service/Missing"},
+	} {
+		_, err := grpcInvoke(ctx, server.Client(), server.URL, method, []byte("ping"))
+		var grpcErr *GRPCError
+		if !errors.As(err, &grpcErr) || grpcErr.Code != want.Code || grpcErr.Message != want.Message {
+			t.Errorf("%s: got %v, want code %d message %q", method, err, want.Code, want.Message)
+		}
+	}
+}
+
+func TestGRPCInvokeTrailersOnly(t *testing.T) {
+	server := newGRPCTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/grpc")
+		if r.URL.Path == "/test.Service/NoStatus" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.Header().Set("Grpc-Status", "7")
+		w.Header().Set("Grpc-Message", "not%20allowed")
+		w.WriteHeader(http.StatusOK)
+	}))
+	ctx := context.Background()
+
+	_, err := grpcInvoke(ctx, server.Client(), server.URL, "/test.Service/Denied", nil)
+	var grpcErr *GRPCError
+	if !errors.As(err, &grpcErr) || grpcErr.CodeName() != "PermissionDenied" || grpcErr.Message != "not allowed" {
+		t.Errorf("expected PermissionDenied, got %v", err)
+	}
+
+	if _, err := grpcInvoke(ctx, server.Client(), server.URL, "/test.Service/NoStatus", nil); err == nil {
+		t.Error("expected an error for a response without grpc-status")
+	}
+}
@@ -1,14 +1,14 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
-	"time"
-
-	"github.com/prometheus/client_golang/prometheus"
+	"strings"
+	"sync"
 )
 
 func createVMHandler(w http.ResponseWriter, r *http.Request) {
@@ -34,7 +34,37 @@ func createVMHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// 2. Check if bulk creation is requested
+	// 2. Repeated requests with the same idempotency key get the original jobs or response
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+	if idempotencyKey == "" {
+		idempotencyKey = r.FormValue("request_id")
+	}
+	if idempotencyKey != "" {
+		fingerprint := requestFingerprint(r.Form)
+		record, running, err := idempotency.begin(idempotencyKey, fingerprint)
+		if err != nil {
+			logger.Error("Failed to record idempotency key: %s", err.Error())
+			reportError(err)
+			incErrorCounterHandler(handlerName)
+			http.Error(w, "Failed to record idempotency key", http.StatusInternalServerError)
+			return
+		}
+		if record != nil {
+			logger.Info("Replaying create request with idempotency key %s", idempotencyKey)
+			replayIdempotent(w, record, running, fingerprint)
+			return
+		}
+		rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		defer func() {
+			if err := idempotency.finish(idempotencyKey, rec); err != nil {
+				logger.Error("Failed to record response for idempotency key %s: %s", idempotencyKey, err.Error())
+				reportError(err)
+			}
+		}()
+		w = rec
+	}
+
+	// 3. Check if bulk creation is requested, and how many VMs to create at once
 	countStr := r.FormValue("count")
 	count := 1
 	if countStr != "" {
@@ -50,554 +80,225 @@ func createVMHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	if count > 1 {
-		logger.Info("Bulk VM creation requested: count=%d", count)
-		handleBulkVMCreation(w, r, count)
-		return
-	}
-
-	createSingleVM(w, r)
-}
-
-func createSingleVM(w http.ResponseWriter, r *http.Request) {
-	handlerName := "/api/v1/create"
-	startTime := time.Now()
-
-	// 1. Validate user input
-	baseTemplateName := r.FormValue("base_template")
-	vmTemplateName := r.FormValue("vm_template")
-	vmName := r.FormValue("name")
-	nodeName := r.FormValue("node")
-
-	if baseTemplateName == "" || vmTemplateName == "" {
-		errMsg := "base_template and vm_template are required"
-		logger.Error(errMsg)
-		reportError(errors.New(errMsg))
-		incErrorCounterHandler(handlerName)
-		http.Error(w, errMsg, http.StatusBadRequest)
-		return
-	}
-
-	// 2. Node selection
-	var selectedNode NodeConfig
-	// 2.1 Validate user chosen node
-	if nodeName != "" {
-		found := false
-		for _, n := range config.Nodes {
-			if n.Name == nodeName {
-				selectedNode = n
-				found = true
-				break
-			}
-		}
-		if !found {
-			errMsg := "Invalid node: " + nodeName
+	parallelism := 1
+	if parallelismStr := r.FormValue("parallelism"); parallelismStr != "" {
+		var err error
+		parallelism, err = strconv.Atoi(parallelismStr)
+		if err != nil || parallelism < 1 {
+			errMsg := "Invalid parallelism parameter. Must be a positive integer"
 			logger.Error(errMsg)
 			reportError(errors.New(errMsg))
 			incErrorCounterHandler(handlerName)
 			http.Error(w, errMsg, http.StatusBadRequest)
 			return
 		}
-	} else {
-		// 2.2 Choose node by algo
-		selected := selectWeightedNode(config.Nodes)
-		if selected == nil {
-			errMsg := "No nodes available for selection"
-			logger.Error(errMsg)
-			reportError(errors.New(errMsg))
-			incErrorCounterHandler(handlerName)
-			http.Error(w, errMsg, http.StatusInternalServerError)
-			return
-		}
-		selectedNode = *selected
-		nodeName = selectedNode.Name
-	}
-
-	// 3. Chosen template validation
-	var baseTemplateID int
-	found := false
-	for _, t := range selectedNode.BaseTemplates {
-		if t.Name == baseTemplateName {
-			baseTemplateID = t.ID
-			found = true
-			break
-		}
-	}
-	if !found {
-		errMsg := fmt.Sprintf("Invalid base_template: %s for node: %s", baseTemplateName, selectedNode.Name)
-		logger.Error(errMsg)
-		reportError(errors.New(errMsg))
-		incErrorCounterHandler(handlerName)
-		http.Error(w, errMsg, http.StatusBadRequest)
-		return
 	}
-
-	var vmTemplateConfig VmTemplate
-	found = false
-	for _, t := range config.VmTemplates {
-		if t.Name == vmTemplateName {
-			vmTemplateConfig = t
-			found = true
-			break
-		}
-	}
-	if !found {
-		errMsg := "Invalid vm_template: " + vmTemplateName
-		logger.Error(errMsg)
-		reportError(errors.New(errMsg))
-		incErrorCounterHandler(handlerName)
-		http.Error(w, errMsg, http.StatusBadRequest)
-		return
+	if parallelism > appConfig.MaxParallelism {
+		logger.Info("Requested parallelism %d exceeds MAX_PARALLELISM, using %d", parallelism, appConfig.MaxParallelism)
+		parallelism = appConfig.MaxParallelism
 	}
 
-	// 4. Get "next-id" for VM
-	vmid, err := getNextID()
-	if err != nil {
-		logger.Error("Failed to get next VM id: %s", err.Error())
-		reportError(err)
-		incErrorCounterHandler(handlerName)
-		http.Error(w, "Failed to get VM id", http.StatusInternalServerError)
+	if count > 1 {
+		logger.Info("Bulk VM creation requested: count=%d", count)
+		handleBulkVMCreation(w, r, count, parallelism, idempotencyKey)
 		return
 	}
 
-	// 5. Set VM name
-	if vmName == "" {
-		randomSuffix := generateRandomString(6)
-		vmName = fmt.Sprintf("%s-%s-%d-%s", vmTemplateName, selectedNode.Suffix, vmid, randomSuffix)
-	}
-
-	logger.Info("Starting VM creation: node=%s, base_template=%s, vm_template=%s, vm_name=%s",
-		nodeName, baseTemplateName, vmTemplateName, vmName)
+	createSingleVM(w, r, idempotencyKey)
+}
 
-	// 6. Call & validate vm cloning
-	cloneTask, err := cloneVM(nodeName, baseTemplateID, vmid, vmName)
-	if err != nil {
-		logger.Error("Failed to clone VM: %s", err.Error())
-		reportError(err)
-		incErrorCounterHandler(handlerName)
-		http.Error(w, "Failed to clone VM", http.StatusInternalServerError)
+// recordIdempotentJobs attaches the started jobs to the idempotency key of the request, if any
+func recordIdempotentJobs(idempotencyKey string, jobIDs []string) {
+	if idempotencyKey == "" {
 		return
 	}
-	if err = trackTask(nodeName, cloneTask); err != nil {
-		logger.Error("Clone task failed: %s", err.Error())
+	if err := idempotency.setJobs(idempotencyKey, jobIDs); err != nil {
+		logger.Error("Failed to record jobs for idempotency key %s: %s", idempotencyKey, err.Error())
 		reportError(err)
-		incErrorCounterHandler(handlerName)
-		http.Error(w, "Clone task failed", http.StatusInternalServerError)
-		return
-	}
-
-	// 7. Configure CPU & memory for cloned VM
-	numa := r.FormValue("numa")
-	phyCores := r.FormValue("phy")
-	htCores := r.FormValue("ht")
-
-	phyOnlyStr := r.FormValue("phy_only")
-	htOnlyStr := r.FormValue("ht_only")
-
-	phyOnly := phyOnlyStr == "1"
-	htOnly := htOnlyStr == "1"
-
-	if phyOnly && htOnly {
-		errMsg := "Both phy_only and ht_only cannot be set at the same time"
-		logger.Error(errMsg)
-		reportError(errors.New(errMsg))
-		incErrorCounterHandler(handlerName)
-		http.Error(w, errMsg, http.StatusBadRequest)
-		return
 	}
+}
 
-	configTask, err := configureVM(nodeName, vmid, vmTemplateConfig.CPU, vmTemplateConfig.Memory, vmTemplateConfig.CPUModel, numa, phyCores, htCores, phyOnly, htOnly, &selectedNode)
-	if err != nil {
-		logger.Error("Failed to configure VM: %s", err.Error())
-		reportError(err)
-		incErrorCounterHandler(handlerName)
-		http.Error(w, "Failed to configure VM", http.StatusInternalServerError)
-		return
-	}
-	if err = trackTask(nodeName, configTask); err != nil {
-		logger.Error("Configuration task failed: %s", err.Error())
-		reportError(err)
-		incErrorCounterHandler(handlerName)
-		http.Error(w, "Configuration task failed", http.StatusInternalServerError)
-		return
-	}
+func createSingleVM(w http.ResponseWriter, r *http.Request, idempotencyKey string) {
+	handlerName := "/api/v1/create"
 
-	// 8. Configure disk size
-	resizeTask, err := resizeDisk(nodeName, vmid, vmTemplateConfig.Disk)
+	// 1. Validate user input
+	requested, err := parseCreateParams(r)
 	if err != nil {
-		logger.Error("Failed to resize disk: %s", err.Error())
-		reportError(err)
-		incErrorCounterHandler(handlerName)
-		http.Error(w, "Failed to resize disk", http.StatusInternalServerError)
+		respondRequestError(w, handlerName, err)
 		return
 	}
-	if resizeTask != "" {
-		if err = trackTask(nodeName, resizeTask); err != nil {
-			logger.Error("Resize disk task failed: %s", err.Error())
-			reportError(err)
-			incErrorCounterHandler(handlerName)
-			http.Error(w, "Resize disk task failed", http.StatusInternalServerError)
-			return
-		}
-	}
-
-	// 9. Start VM
-	startTask, err := startVM(nodeName, vmid)
+	placed, err := placeVMs(r.Context(), requested, 1)
 	if err != nil {
-		logger.Error("Failed to start VM: %s", err.Error())
-		reportError(err)
-		incErrorCounterHandler(handlerName)
-		http.Error(w, "Failed to start VM", http.StatusInternalServerError)
+		respondRequestError(w, handlerName, err)
 		return
 	}
-	if err = trackTask(nodeName, startTask); err != nil {
-		logger.Error("Start VM task failed: %s", err.Error())
-		reportError(err)
-		incErrorCounterHandler(handlerName)
-		http.Error(w, "Start VM task failed", http.StatusInternalServerError)
+	if err := checkMachineConfigs(placed); err != nil {
+		respondRequestError(w, handlerName, err)
 		return
 	}
+	params := placed[0]
 
-	// 10. Check if reset is requested (to fix kernel panic on first run)
-	resetRequested := r.FormValue("reset") == "1"
-	if resetRequested {
-		logger.Info("Reset requested for VM: id=%d, node=%s, name=%s", vmid, nodeName, vmName)
-		// Sleep for 3 seconds before resetting to allow VM to boot
-		time.Sleep(3 * time.Second)
+	job := newJob()
+	recordIdempotentJobs(idempotencyKey, []string{job.ID})
 
-		// Reset the VM
-		resetTask, err := resetVM(nodeName, vmid)
-		if err != nil {
-			logger.Error("Failed to reset VM: %s", err.Error())
-			reportError(err)
-			incErrorCounterHandler(handlerName)
-			http.Error(w, "Failed to reset VM", http.StatusInternalServerError)
-			return
-		}
-		if err = trackTask(nodeName, resetTask); err != nil {
-			logger.Error("Reset VM task failed: %s", err.Error())
-			reportError(err)
-			incErrorCounterHandler(handlerName)
-			http.Error(w, "Reset VM task failed", http.StatusInternalServerError)
-			return
-		}
-		logger.Info("VM reset successful: id=%d, node=%s, name=%s", vmid, nodeName, vmName)
-	}
+	// 2. Async mode: return the job right away and let the client poll it
+	if r.FormValue("async") == "1" {
+		logger.Info("Async VM creation requested: job=%s, node=%s, base_template=%s, vm_template=%s",
+			job.ID, params.Node.Name, params.BaseTemplateName, params.VmTemplate.Name)
+		go runCreatePipeline(context.Background(), params, job)
 
-	// 11. Get VM IP address for Talos registration
-	logger.Info("Getting VM IP address for Talos registration...")
-	vmIP, err := getVMIPAddress(nodeName, vmid)
-	if err != nil {
-		logger.Error("Failed to get VM IP address: %s", err.Error())
-		reportError(err)
-		incErrorCounterHandler(handlerName)
-		http.Error(w, "Failed to get VM IP address", http.StatusInternalServerError)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", "/api/v1/jobs/"+job.ID)
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"job_id": job.ID,
+			"status": JobPending,
+		})
 		return
 	}
-	logger.Info("VM IP address obtained: %s", vmIP)
 
-	// 12. Generate Talos configuration
-	logger.Info("Generating Talos configuration...")
-	talosConfig, err := generateTalosConfig(talosMachineTemplate, vmName, vmIP, vmTemplateConfig.Role, nodeName, vmTemplateName, vmTemplateConfig.CPUModel, vmTemplateConfig.Memory, selectedNode.Suffix, vmTemplateConfig.CPU, fmt.Sprintf("%d", vmTemplateConfig.Disk))
+	// 3. Sync mode: run the pipeline within the request, a client disconnect stops it
+	result, err := runCreatePipeline(r.Context(), params, job)
 	if err != nil {
-		logger.Error("Failed to generate Talos config: %s", err.Error())
-		reportError(err)
-		incErrorCounterHandler(handlerName)
-		http.Error(w, "Failed to generate Talos config", http.StatusInternalServerError)
-		return
-	}
-
-	// 13. Wait for Talos node to be ready
-	logger.Info("Waiting for Talos node to be ready...")
-	if err := waitForTalosNode(vmIP); err != nil {
-		logger.Error("Talos node not ready: %s", err.Error())
-		reportError(err)
-		incErrorCounterHandler(handlerName)
-		http.Error(w, "Talos node not ready", http.StatusInternalServerError)
-		return
-	}
-
-	// 14. Register node with Talos cluster
-	logger.Info("Registering node with Talos cluster...")
-	if err := registerTalosNode(vmIP, talosConfig, talosControlPlaneEndpoint); err != nil {
-		logger.Error("Failed to register Talos node: %s", err.Error())
-		reportError(err)
-		incErrorCounterHandler(handlerName)
-		http.Error(w, "Failed to register Talos node", http.StatusInternalServerError)
+		respondPipelineError(w, result, err)
 		return
 	}
 
-	// 15. Log success with timing
-	totalDuration := time.Since(startTime)
-	logger.Info("Talos VM creation and registration successful: id=%d, node=%s, name=%s, ip=%s, role=%s, duration=%v",
-		vmid, nodeName, vmName, vmIP, vmTemplateConfig.Role, totalDuration)
-	createdCounter.With(prometheus.Labels{
-		"node":          nodeName,
-		"base_template": baseTemplateName,
-		"vm_template":   vmTemplateName,
-	}).Inc()
 	respData := map[string]interface{}{
-		"vm_id":            vmid,
-		"node":             nodeName,
-		"name":             vmName,
-		"ip":               vmIP,
-		"role":             vmTemplateConfig.Role,
-		"reset":            resetRequested,
-		"duration_seconds": totalDuration.Seconds(),
+		"vm_id":            result.ID,
+		"node":             result.Node,
+		"name":             result.Name,
+		"ip":               result.IP,
+		"role":             result.Role,
+		"reset":            result.Reset,
+		"duration_seconds": result.DurationSeconds,
+		"job_id":           job.ID,
 	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(respData)
 }
 
 type VMResult struct {
-	ID    int    `json:"vm_id"`
-	Node  string `json:"node"`
-	Name  string `json:"name"`
-	IP    string `json:"ip,omitempty"`
-	Role  string `json:"role,omitempty"`
-	Reset bool   `json:"reset"`
-	Error string `json:"error,omitempty"`
+	ID              int               `json:"vm_id"`
+	Node            string            `json:"node"`
+	Name            string            `json:"name"`
+	IP              string            `json:"ip,omitempty"`
+	Role            string            `json:"role,omitempty"`
+	Reset           bool              `json:"reset"`
+	DurationSeconds float64           `json:"duration_seconds,omitempty"`
+	JobID           string            `json:"job_id,omitempty"`
+	Error           string            `json:"error,omitempty"`
+	Rollback        *RollbackResult   `json:"rollback,omitempty"`
+	TalosApply      *TalosApplyResult `json:"talos_apply,omitempty"`
 }
 
-func handleBulkVMCreation(w http.ResponseWriter, r *http.Request, count int) {
+func handleBulkVMCreation(w http.ResponseWriter, r *http.Request, count int, parallelism int, idempotencyKey string) {
 	handlerName := "/api/v1/create"
 
-	baseTemplateName := r.FormValue("base_template")
-	vmTemplateName := r.FormValue("vm_template")
-	nodeName := r.FormValue("node")
-
-	if baseTemplateName == "" || vmTemplateName == "" {
-		errMsg := "base_template and vm_template are required"
-		logger.Error(errMsg)
-		reportError(errors.New(errMsg))
-		incErrorCounterHandler(handlerName)
-		http.Error(w, errMsg, http.StatusBadRequest)
+	params, err := parseCreateParams(r)
+	if err != nil {
+		respondRequestError(w, handlerName, err)
 		return
 	}
+	// Names are always generated in bulk mode
+	params.Name = ""
 
-	var selectedNode NodeConfig
-	if nodeName != "" {
-		found := false
-		for _, n := range config.Nodes {
-			if n.Name == nodeName {
-				selectedNode = n
-				found = true
-				break
-			}
-		}
-		if !found {
-			errMsg := "Invalid node: " + nodeName
-			logger.Error(errMsg)
-			reportError(errors.New(errMsg))
-			incErrorCounterHandler(handlerName)
-			http.Error(w, errMsg, http.StatusBadRequest)
-			return
-		}
-	} else {
-		selected := selectWeightedNode(config.Nodes)
-		if selected == nil {
-			errMsg := "No nodes available for selection"
-			logger.Error(errMsg)
-			reportError(errors.New(errMsg))
-			incErrorCounterHandler(handlerName)
-			http.Error(w, errMsg, http.StatusInternalServerError)
-			return
-		}
-		selectedNode = *selected
-		nodeName = selectedNode.Name
-	}
-
-	var baseTemplateID int
-	found := false
-	for _, t := range selectedNode.BaseTemplates {
-		if t.Name == baseTemplateName {
-			baseTemplateID = t.ID
-			found = true
-			break
-		}
-	}
-	if !found {
-		errMsg := fmt.Sprintf("Invalid base_template: %s for node: %s", baseTemplateName, selectedNode.Name)
-		logger.Error(errMsg)
-		reportError(errors.New(errMsg))
-		incErrorCounterHandler(handlerName)
-		http.Error(w, errMsg, http.StatusBadRequest)
+	placed, err := placeVMs(r.Context(), params, count)
+	if err != nil {
+		respondRequestError(w, handlerName, err)
 		return
 	}
-
-	var vmTemplateConfig VmTemplate
-	found = false
-	for _, t := range config.VmTemplates {
-		if t.Name == vmTemplateName {
-			vmTemplateConfig = t
-			found = true
-			break
-		}
-	}
-	if !found {
-		errMsg := "Invalid vm_template: " + vmTemplateName
-		logger.Error(errMsg)
-		reportError(errors.New(errMsg))
-		incErrorCounterHandler(handlerName)
-		http.Error(w, errMsg, http.StatusBadRequest)
+	if err := checkMachineConfigs(placed); err != nil {
+		respondRequestError(w, handlerName, err)
 		return
 	}
 
-	numa := r.FormValue("numa")
-	phyCores := r.FormValue("phy")
-	htCores := r.FormValue("ht")
-	phyOnlyStr := r.FormValue("phy_only")
-	htOnlyStr := r.FormValue("ht_only")
-	phyOnly := phyOnlyStr == "1"
-	htOnly := htOnlyStr == "1"
+	logger.Info("Starting bulk creation of %d VMs: placement=%s, base_template=%s, vm_template=%s, parallelism=%d",
+		count, params.Placement, params.BaseTemplateName, params.VmTemplate.Name, parallelism)
 
-	if phyOnly && htOnly {
-		errMsg := "Both phy_only and ht_only cannot be set at the same time"
-		logger.Error(errMsg)
-		reportError(errors.New(errMsg))
-		incErrorCounterHandler(handlerName)
-		http.Error(w, errMsg, http.StatusBadRequest)
-		return
+	bulkJobs := make([]*Job, count)
+	jobIDs := make([]string, count)
+	for i := range bulkJobs {
+		bulkJobs[i] = newJob()
+		jobIDs[i] = bulkJobs[i].ID
 	}
+	recordIdempotentJobs(idempotencyKey, jobIDs)
 
-	resetRequested := r.FormValue("reset") == "1"
-
-	var results []VMResult
-
-	logger.Info("Starting bulk creation of %d VMs: node=%s, base_template=%s, vm_template=%s",
-		count, nodeName, baseTemplateName, vmTemplateName)
+	// Async mode: hand out one job per VM
+	if r.FormValue("async") == "1" {
+		go runBulkPipelines(context.Background(), placed, bulkJobs, parallelism)
 
-	for i := 0; i < count; i++ {
-		result := VMResult{
-			Node:  nodeName,
-			Reset: resetRequested,
-		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"count":   count,
+			"job_ids": jobIDs,
+			"status":  JobPending,
+		})
+		return
+	}
 
-		// 1. Get next VM ID
-		vmid, err := getNextID()
-		if err != nil {
-			logger.Error("[VM %d] Failed to get next VM id: %s", i+1, err.Error())
-			result.Error = "Failed to get VM id: " + err.Error()
-			results = append(results, result)
-			continue
+	results := runBulkPipelines(r.Context(), placed, bulkJobs, parallelism)
+	failed := 0
+	for _, result := range results {
+		if result.Error != "" {
+			failed++
 		}
-		result.ID = vmid
-
-		// 2. Generate VM name
-		randomSuffix := generateRandomString(6)
-		vmName := fmt.Sprintf("%s-%s-%d-%s", vmTemplateName, selectedNode.Suffix, vmid, randomSuffix)
-		result.Name = vmName
+	}
 
-		logger.Info("[VM %d] Starting VM creation: node=%s, base_template=%s, vm_template=%s, vm_name=%s",
-			i+1, nodeName, baseTemplateName, vmTemplateName, vmName)
+	respData := map[string]interface{}{
+		"count": count,
+		"vms":   results,
+	}
 
-		// 3. Clone VM
-		cloneTask, err := cloneVM(nodeName, baseTemplateID, vmid, vmName)
-		if err != nil {
-			logger.Error("[VM %d] Failed to clone VM: %s", i+1, err.Error())
-			result.Error = "Failed to clone VM: " + err.Error()
-			results = append(results, result)
-			continue
-		}
-		if err = trackTask(nodeName, cloneTask); err != nil {
-			logger.Error("[VM %d] Clone task failed: %s", i+1, err.Error())
-			result.Error = "Clone task failed: " + err.Error()
-			results = append(results, result)
-			continue
-		}
+	// 207 when only some VMs failed, 500 when none was created
+	status := http.StatusOK
+	switch {
+	case failed == count:
+		status = http.StatusInternalServerError
+		incErrorCounterHandler(handlerName)
+	case failed > 0:
+		status = http.StatusMultiStatus
+	}
 
-		// 4. Configure VM
-		configTask, err := configureVM(nodeName, vmid, vmTemplateConfig.CPU, vmTemplateConfig.Memory, vmTemplateConfig.CPUModel, numa, phyCores, htCores, phyOnly, htOnly, &selectedNode)
-		if err != nil {
-			logger.Error("[VM %d] Failed to configure VM: %s", i+1, err.Error())
-			result.Error = "Failed to configure VM: " + err.Error()
-			results = append(results, result)
-			continue
-		}
-		if err = trackTask(nodeName, configTask); err != nil {
-			logger.Error("[VM %d] Configuration task failed: %s", i+1, err.Error())
-			result.Error = "Configuration task failed: " + err.Error()
-			results = append(results, result)
-			continue
-		}
+	logger.Info("Bulk VM creation completed: created %d of %d VMs", count-failed, count)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(respData)
+}
 
-		// 5. Resize disk
-		resizeTask, err := resizeDisk(nodeName, vmid, vmTemplateConfig.Disk)
-		if err != nil {
-			logger.Error("[VM %d] Failed to resize disk: %s", i+1, err.Error())
-			result.Error = "Failed to resize disk: " + err.Error()
-			results = append(results, result)
-			continue
-		}
-		if resizeTask != "" {
-			if err = trackTask(nodeName, resizeTask); err != nil {
-				logger.Error("[VM %d] Resize disk task failed: %s", i+1, err.Error())
-				result.Error = "Resize disk task failed: " + err.Error()
-				results = append(results, result)
-				continue
+// runBulkPipelines creates the VM placed[i] for bulkJobs[i] with at most parallelism pipelines running at once
+// (and never more than MAX_PARALLELISM server-wide). Results keep the order of jobs.
+func runBulkPipelines(ctx context.Context, placed []*createParams, bulkJobs []*Job, parallelism int) []VMResult {
+	results := make([]VMResult, len(bulkJobs))
+	requestSlots := make(chan struct{}, parallelism)
+	var wg sync.WaitGroup
+
+	for i, job := range bulkJobs {
+		requestSlots <- struct{}{}
+		wg.Add(1)
+		go func(i int, job *Job) {
+			defer wg.Done()
+			defer func() { <-requestSlots }()
+
+			// Once ctx is done the pipeline fails right away, no need to wait for a slot
+			select {
+			case bulkSlots <- struct{}{}:
+				defer func() { <-bulkSlots }()
+			case <-ctx.Done():
 			}
-		}
 
-		// 6. Start VM
-		startTask, err := startVM(nodeName, vmid)
-		if err != nil {
-			logger.Error("[VM %d] Failed to start VM: %s", i+1, err.Error())
-			result.Error = "Failed to start VM: " + err.Error()
-			results = append(results, result)
-			continue
-		}
-		if err = trackTask(nodeName, startTask); err != nil {
-			logger.Error("[VM %d] Start VM task failed: %s", i+1, err.Error())
-			result.Error = "Start VM task failed: " + err.Error()
-			results = append(results, result)
-			continue
-		}
-
-		// 7. Reset VM if requested
-		if resetRequested {
-			logger.Info("[VM %d] Reset requested for VM: id=%d, node=%s, name=%s",
-				i+1, vmid, nodeName, vmName)
-			// Sleep for 3 seconds before resetting to allow VM to boot
-			time.Sleep(3 * time.Second)
-
-			// Reset the VM
-			resetTask, err := resetVM(nodeName, vmid)
+			logger.Info("[VM %d] Starting VM creation: job=%s, node=%s", i+1, job.ID, placed[i].Node.Name)
+			result, err := runCreatePipeline(ctx, placed[i], job)
 			if err != nil {
-				logger.Error("[VM %d] Failed to reset VM: %s", i+1, err.Error())
-				result.Error = "Reset VM failed: " + err.Error()
-				results = append(results, result)
-				continue
-			}
-			if err = trackTask(nodeName, resetTask); err != nil {
-				logger.Error("[VM %d] Reset VM task failed: %s", i+1, err.Error())
-				result.Error = "Reset VM task failed: " + err.Error()
-				results = append(results, result)
-				continue
+				logger.Error("[VM %d] VM creation failed: %s", i+1, err.Error())
 			}
-			logger.Info("[VM %d] VM reset successful: id=%d, node=%s, name=%s",
-				i+1, vmid, nodeName, vmName)
-		}
-
-		// 8. VM created successfully
-		logger.Info("[VM %d] VM creation successful: id=%d, node=%s, name=%s",
-			i+1, vmid, nodeName, vmName)
-		createdCounter.With(prometheus.Labels{
-			"node":          nodeName,
-			"base_template": baseTemplateName,
-			"vm_template":   vmTemplateName,
-		}).Inc()
-
-		results = append(results, result)
+			results[i] = *result
+		}(i, job)
 	}
 
-	respData := map[string]interface{}{
-		"count": count,
-		"vms":   results,
-	}
-
-	logger.Info("Bulk VM creation completed: created %d VMs", count)
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(respData)
+	wg.Wait()
+	return results
 }
 
 func deleteVMHandler(w http.ResponseWriter, r *http.Request) {
@@ -629,14 +330,26 @@ func deleteVMHandler(w http.ResponseWriter, r *http.Request) {
 	var vmid int
 	// 2.1 vm_name is set and that's all
 	if vmName != "" {
-		found := false
-		for _, n := range config.Nodes {
-			id, err := findVMByName(n.Name, vmName)
-			if err == nil {
-				targetNodeName = n.Name
-				vmid = id
-				found = true
-				break
+		// VMs created by the deployer are in the inventory, others are searched on every node. So are
+		// recorded VMs that aren't where the inventory says anymore, e.g. after an HA migration.
+		vm, found := inventory.get(vmName)
+		if found {
+			if id, err := findVMByName(r.Context(), vm.Node, vmName); err == nil && id == vm.VMID {
+				targetNodeName, vmid = vm.Node, vm.VMID
+			} else {
+				logger.Info("VM %s is not on node %s with id %d as recorded, searching all nodes", vmName, vm.Node, vm.VMID)
+				found = false
+			}
+		}
+		if !found {
+			for _, n := range config.Nodes {
+				id, err := findVMByName(r.Context(), n.Name, vmName)
+				if err == nil {
+					targetNodeName = n.Name
+					vmid = id
+					found = true
+					break
+				}
 			}
 		}
 		if !found {
@@ -678,56 +391,114 @@ func deleteVMHandler(w http.ResponseWriter, r *http.Request) {
 		stopMethod = "shutdown"
 	}
 
-	// 4. Stop VM
-	logger.Info("Starting VM deletion: node=%s, vm_id=%d, stop_method=%s", targetNodeName, vmid, stopMethod)
-	stopTask, err := stopVM(targetNodeName, vmid, stopMethod)
-	if err != nil {
-		logger.Error("Failed to stop VM: %s", err.Error())
-		reportError(err)
+	// 4. Graceful removal from the cluster
+	graceful := appConfig.GracefulDelete
+	if gracefulStr := r.FormValue("graceful"); gracefulStr != "" {
+		graceful = gracefulStr == "1"
+	}
+	if graceful && !kubeEnabled() {
+		errMsg := "graceful delete requires access to the Kubernetes API"
+		logger.Error(errMsg)
 		incErrorCounterHandler(handlerName)
-		http.Error(w, "Failed to stop VM", http.StatusInternalServerError)
+		http.Error(w, errMsg, http.StatusBadRequest)
 		return
 	}
-	if stopTask != "" {
-		if err = trackTask(targetNodeName, stopTask); err != nil {
-			logger.Error("Stop VM task failed: %s", err.Error())
-			reportError(err)
-			incErrorCounterHandler(handlerName)
-			http.Error(w, "Stop VM task failed", http.StatusInternalServerError)
-			return
-		}
-	} else {
-		logger.Info("VM stop completed synchronously")
+
+	d := &deletion{
+		Node:   targetNodeName,
+		VMID:   vmid,
+		VMName: vmName,
+		Force:  r.FormValue("force") == "1",
+	}
+	if err := d.execute(r.Context(), stopMethod, graceful); err != nil {
+		respondDeleteError(w, handlerName, d, err)
+		return
+	}
+	logger.Info("VM deletion successful: node=%s, vm_id=%d", targetNodeName, vmid)
+	respData := map[string]interface{}{
+		"node":   targetNodeName,
+		"vm_id":  vmid,
+		"phases": d.Phases,
 	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(respData)
+}
 
-	// 5. Delete VM
-	deleteTask, err := deleteVM(targetNodeName, vmid)
-	if err != nil {
-		logger.Error("Failed to delete VM: %s", err.Error())
-		reportError(err)
+// respondDeleteError reports the phase that stopped a deletion along with all phases run so far
+func respondDeleteError(w http.ResponseWriter, handlerName string, d *deletion, err error) {
+	logger.Error("VM deletion failed: node=%s, vm_id=%d: %s", d.Node, d.VMID, err.Error())
+	reportError(err)
+	incErrorCounterHandler(handlerName)
+
+	respData := map[string]interface{}{
+		"error":  err.Error(),
+		"node":   d.Node,
+		"vm_id":  d.VMID,
+		"phases": d.Phases,
+	}
+	var phaseErr *phaseError
+	if errors.As(err, &phaseErr) {
+		respData["error"] = phaseErr.Message
+		respData["phase"] = phaseErr.Phase
+		respData["details"] = phaseErr.Err.Error()
+	}
+	if details := proxmoxErrorDetails(err); details != nil {
+		respData["proxmox_error"] = details
+	}
+	if details := proxmoxTaskDetails(err); details != nil {
+		respData["proxmox_task"] = details
+	}
+	if d.VMName != "" {
+		respData["vm_name"] = d.VMName
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusInternalServerError)
+	json.NewEncoder(w).Encode(respData)
+}
+
+// jobStatusHandler serves GET /api/v1/jobs/{id} and POST /api/v1/jobs/{id}/cancel
+func jobStatusHandler(w http.ResponseWriter, r *http.Request) {
+	handlerName := "/api/v1/jobs"
+	jobID, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/v1/jobs/"), "/")
+	if (action == "" && r.Method != "GET") || (action == "cancel" && r.Method != "POST") {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if r.Header.Get("X-Auth-Token") != authToken {
+		logger.Error("Unauthorized access to %s", handlerName)
 		incErrorCounterHandler(handlerName)
-		http.Error(w, "Failed to delete VM", http.StatusInternalServerError)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
-	if deleteTask != "" {
-		if err = trackTask(targetNodeName, deleteTask); err != nil {
-			logger.Error("Delete VM task failed: %s", err.Error())
-			reportError(err)
-			incErrorCounterHandler(handlerName)
-			http.Error(w, "Delete VM task failed", http.StatusInternalServerError)
+
+	if jobID == "" || (action != "" && action != "cancel") {
+		http.Error(w, "Job id is required", http.StatusBadRequest)
+		return
+	}
+
+	job := getJob(jobID)
+	if job == nil {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+
+	// Canceling stops the pipeline at its next Proxmox or Talos call; the job finishes
+	// as canceled once the rollback (if any) is done
+	if action == "cancel" {
+		if !job.cancelJob() {
+			http.Error(w, "Job already finished", http.StatusConflict)
 			return
 		}
+		logger.Info("Job %s cancellation requested", jobID)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(job.snapshot())
+		return
 	}
-	deletedCounter.With(prometheus.Labels{
-		"node": targetNodeName,
-	}).Inc()
-	logger.Info("VM deletion successful: node=%s, vm_id=%d", targetNodeName, vmid)
-	respData := map[string]interface{}{
-		"node":  targetNodeName,
-		"vm_id": vmid,
-	}
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(respData)
+	json.NewEncoder(w).Encode(job.snapshot())
 }
 
 // The best health-check ever
@@ -0,0 +1,619 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caarlos0/env/v6"
+)
+
+const testMachineTemplate = `version: v1alpha1
+machine:
+    type: {role}
+    token: test-machine-token
+    ca:
+        crt: dGVzdA==
+    network:
+        hostname: {vm_name}
+    install:
+        disk: /dev/vda
+cluster:
+    controlPlane:
+        endpoint: https://10.0.0.1:6443
+    token: test-cluster-token
+    ca:
+        crt: dGVzdA==
+`
+
+// setupTest points the deployer at a fresh fake Proxmox cluster (node pve1 with base template
+// talos) and a fake Talos maintenance API, and returns the fake cluster
+func setupTest(t *testing.T) *FakeProxmox {
+	t.Helper()
+	dir := t.TempDir()
+	templatePath := filepath.Join(dir, "machine.yaml")
+	if err := os.WriteFile(templatePath, []byte(testMachineTemplate), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for key, value := range map[string]string{
+		"PROXMOX_BASE_ADDR":           "http://proxmox.invalid/api2/json",
+		"PROXMOX_TOKEN":               "root@pam!test=secret",
+		"SENTRY_DSN":                  "",
+		"LISTEN_ADDR":                 "127.0.0.1",
+		"LISTEN_PORT":                 "0",
+		"CONFIG_PATH":                 filepath.Join(dir, "config.yaml"),
+		"AUTH_TOKEN":                  "test-token",
+		"TALOS_MACHINE_TEMPLATE":      templatePath,
+		"TALOS_CONTROLPLANE_ENDPOINT": "https://10.0.0.1:6443",
+		"PROXMOX_RETRY_BASE_DELAY":    "10ms",
+		"PROXMOX_RETRY_MAX_DELAY":     "50ms",
+		"IP_TIMEOUT":                  "10s",
+		"TALOS_READY_TIMEOUT":         "10s",
+		"ROLLBACK_TIMEOUT":            "10s",
+	} {
+		t.Setenv(key, value)
+	}
+	appConfig = AppConfig{}
+	if err := env.Parse(&appConfig); err != nil {
+		t.Fatal(err)
+	}
+	logger = &Logger{Level: LevelError}
+	authToken = appConfig.AuthToken
+	talosMachineTemplate = appConfig.TalosMachineTemplate
+	talosControlPlaneEndpoint = appConfig.TalosControlPlaneEndpoint
+	bulkSlots = make(chan struct{}, appConfig.MaxParallelism)
+	lastReconcile, findingsFirstAt = nil, map[string]time.Time{}
+
+	config = Config{
+		Nodes: []NodeConfig{{
+			Name:          "pve1",
+			Weight:        1,
+			Suffix:        "a",
+			NUMA:          []NumaNode{{ID: 0, Cores: CoreRange{Phy: "0-15"}}},
+			BaseTemplates: []BaseTemplate{{Name: "talos", ID: 9000}},
+		}},
+		VmTemplates: []VmTemplate{{Name: "worker-small", CPU: 2, Memory: 2048, Disk: 20, CPUModel: "host", Role: "worker"}},
+	}
+
+	var err error
+	if inventory, err = openInventory(filepath.Join(dir, "inventory.json")); err != nil {
+		t.Fatal(err)
+	}
+	if idempotency, err = openIdempotencyStore(filepath.Join(dir, "idempotency.json")); err != nil {
+		t.Fatal(err)
+	}
+
+	fake := newFakeProxmoxFromConfig(config)
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	retryPolicy, err := newRetryPolicy(appConfig.ProxmoxRetryMaxAttempts, appConfig.ProxmoxRetryBaseDelay, appConfig.ProxmoxRetryMaxDelay, appConfig.ProxmoxRetryOn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxmox = &ProxmoxClient{BaseURL: server.URL + "/api2/json", Token: appConfig.ProxmoxToken, HTTP: server.Client(), Retry: retryPolicy}
+
+	talosApplies = nil
+	talos := httptest.NewUnstartedServer(grpcHandler("machine.MachineService", map[string]grpcMethod{
+		"ApplyConfiguration": talosStubApply,
+	}))
+	talos.EnableHTTP2 = true
+	talos.StartTLS()
+	t.Cleanup(talos.Close)
+	defaultDialer := talosDialer
+	talosDialer = talosStubDialer{addr: talos.Listener.Addr().String()}
+	t.Cleanup(func() { talosDialer = defaultDialer })
+	return fake
+}
+
+// talosStubDialer connects the Talos API address of every VM to the Talos stub
+type talosStubDialer struct {
+	addr string
+}
+
+func (d talosStubDialer) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	if _, port, err := net.SplitHostPort(address); err != nil || port != talosAPIPort {
+		return nil, fmt.Errorf("unexpected Talos API address %s", address)
+	}
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, network, d.addr)
+}
+
+// talosApply is an ApplyConfiguration request received by the Talos stub
+type talosApply struct {
+	Config string
+	Mode   uint64
+}
+
+var (
+	talosAppliesMu sync.Mutex
+	talosApplies   []talosApply
+)
+
+// talosStubApply decodes ApplyConfigurationRequest{data = 1, mode = 4}, rejects it like Talos
+// if the config is invalid and records it
+func talosStubApply(request []byte) ([]byte, error) {
+	fields, err := protoParse(request)
+	if err != nil {
+		return nil, &GRPCError{Code: grpcCodeInvalidArgument, Message: err.Error()}
+	}
+	var apply talosApply
+	for _, field := range fields {
+		switch {
+		case field.Num == 1 && field.Type == protoBytes:
+			apply.Config = string(field.Bytes)
+		case field.Num == 4 && field.Type == protoVarint:
+			apply.Mode = field.Varint
+		default:
+			return nil, &GRPCError{Code: grpcCodeInvalidArgument, Message: fmt.Sprintf("unexpected field %d", field.Num)}
+		}
+	}
+	if err := validateMachineConfig(apply.Config, ""); err != nil {
+		return nil, &GRPCError{Code: grpcCodeInvalidArgument, Message: err.Error()}
+	}
+
+	talosAppliesMu.Lock()
+	talosApplies = append(talosApplies, apply)
+	talosAppliesMu.Unlock()
+	return nil, nil
+}
+
+// post sends an authenticated form request to handler
+func post(handler http.HandlerFunc, path string, form url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-Auth-Token", authToken)
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	return rec
+}
+
+func decodeResponse(t *testing.T, rec *httptest.ResponseRecorder) map[string]interface{} {
+	t.Helper()
+	var resp map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid response %d %q: %v", rec.Code, rec.Body.String(), err)
+	}
+	return resp
+}
+
+func createForm(extra ...string) url.Values {
+	form := url.Values{"base_template": {"talos"}, "vm_template": {"worker-small"}}
+	for i := 0; i+1 < len(extra); i += 2 {
+		form.Set(extra[i], extra[i+1])
+	}
+	return form
+}
+
+func TestCreateVM(t *testing.T) {
+	fake := setupTest(t)
+
+	rec := post(createVMHandler, "/api/v1/create", createForm("name", "test-vm"))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	resp := decodeResponse(t, rec)
+	if resp["vm_id"] != float64(100) || resp["name"] != "test-vm" || resp["ip"] != "192.0.2.10" {
+		t.Errorf("unexpected response: %v", resp)
+	}
+
+	vm, ok := fake.VM("pve1", 100)
+	if !ok {
+		t.Fatal("VM 100 was not created")
+	}
+	if vm.Status != "running" || vm.Config["cores"] != "2" || vm.Config["memory"] != "2048" {
+		t.Errorf("unexpected VM: status=%s config=%v", vm.Status, vm.Config)
+	}
+	if !strings.Contains(vm.Config["virtio0"], ",size=20G") {
+		t.Errorf("disk not resized: %s", vm.Config["virtio0"])
+	}
+	if _, found := inventory.get("test-vm"); !found {
+		t.Error("VM not recorded in the inventory")
+	}
+
+	if len(talosApplies) != 1 {
+		t.Fatalf("expected 1 ApplyConfiguration request, got %d", len(talosApplies))
+	}
+	apply := talosApplies[0]
+	if apply.Mode != talosApplyModes["auto"] || !strings.Contains(apply.Config, "hostname: test-vm") || !strings.Contains(apply.Config, "type: worker") {
+		t.Errorf("unexpected ApplyConfiguration request: mode=%d config=%q", apply.Mode, apply.Config)
+	}
+}
+
+func TestCreateVMCloneTaskFailure(t *testing.T) {
+	fake := setupTest(t)
+	fake.Fault(FakeFault{Path: "/clone", TaskStatus: "clone failed: no space left on device", TaskLog: []string{"create full clone of drive virtio0"}})
+
+	rec := post(createVMHandler, "/api/v1/create", createForm())
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("expected 500, got %d: %s", rec.Code, rec.Body.String())
+	}
+	resp := decodeResponse(t, rec)
+	if resp["step"] != StepCloning || resp["rollback"] != nil {
+		t.Errorf("unexpected response: %v", resp)
+	}
+	task, _ := resp["proxmox_task"].(map[string]interface{})
+	if task["exit_status"] != "clone failed: no space left on device" || !strings.Contains(rec.Body.String(), "create full clone of drive virtio0") {
+		t.Errorf("task log not reported: %v", resp["proxmox_task"])
+	}
+	if vms := fake.VMs("pve1"); len(vms) != 0 {
+		t.Errorf("expected no VMs, got %v", vms)
+	}
+}
+
+func TestCreateVMStartFailureRollsBack(t *testing.T) {
+	fake := setupTest(t)
+	fake.Fault(FakeFault{Path: "/status/start", TaskStatus: "start failed: QEMU exited with code 1"})
+
+	rec := post(createVMHandler, "/api/v1/create", createForm())
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("expected 500, got %d: %s", rec.Code, rec.Body.String())
+	}
+	resp := decodeResponse(t, rec)
+	rollback, _ := resp["rollback"].(map[string]interface{})
+	if resp["step"] != StepStarting || rollback["action"] != RollbackDestroyed {
+		t.Errorf("unexpected response: %v", resp)
+	}
+	if vms := fake.VMs("pve1"); len(vms) != 0 {
+		t.Errorf("failed VM was not destroyed: %v", vms)
+	}
+}
+
+func TestCreateVMRetriesLockTimeout(t *testing.T) {
+	fake := setupTest(t)
+	fake.Fault(FakeFault{Method: "POST", Path: "/config", Times: 2, Status: http.StatusInternalServerError,
+		Message: "can't lock file '/var/lock/qemu-server/lock-100.conf' - got timeout"})
+
+	rec := post(createVMHandler, "/api/v1/create", createForm())
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	attempts := 0
+	for _, request := range fake.Requests() {
+		if request == "POST /nodes/pve1/qemu/100/config" {
+			attempts++
+		}
+	}
+	if attempts != 3 {
+		t.Errorf("expected 3 config attempts, got %d", attempts)
+	}
+}
+
+func TestCreateVMAsync(t *testing.T) {
+	setupTest(t)
+
+	rec := post(createVMHandler, "/api/v1/create", createForm("async", "1"))
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d: %s", rec.Code, rec.Body.String())
+	}
+	jobID, _ := decodeResponse(t, rec)["job_id"].(string)
+	if jobID == "" {
+		t.Fatal("no job_id in response")
+	}
+
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		req := httptest.NewRequest("GET", "/api/v1/jobs/"+jobID, nil)
+		req.Header.Set("X-Auth-Token", authToken)
+		rec := httptest.NewRecorder()
+		jobStatusHandler(rec, req)
+		var job Job
+		if err := json.Unmarshal(rec.Body.Bytes(), &job); err != nil {
+			t.Fatalf("invalid job %q: %v", rec.Body.String(), err)
+		}
+		if job.Status == JobSucceeded {
+			if job.VMID != 100 || job.Result == nil || job.Result.IP != "192.0.2.10" {
+				t.Errorf("unexpected job: %s", rec.Body.String())
+			}
+			break
+		}
+		if job.Status == JobFailed || time.Now().After(deadline) {
+			t.Fatalf("job did not succeed: %s", rec.Body.String())
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestBulkCreate(t *testing.T) {
+	fake := setupTest(t)
+
+	rec := post(createVMHandler, "/api/v1/create", createForm("count", "3", "parallelism", "2"))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var resp struct {
+		Count int        `json:"count"`
+		VMs   []VMResult `json:"vms"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	ids := map[int]bool{}
+	for _, vm := range resp.VMs {
+		if vm.Error != "" {
+			t.Errorf("VM %s failed: %s", vm.Name, vm.Error)
+		}
+		ids[vm.ID] = true
+	}
+	if resp.Count != 3 || len(ids) != 3 {
+		t.Errorf("expected 3 distinct VMs, got %+v", resp)
+	}
+	if vms := fake.VMs("pve1"); len(vms) != 3 {
+		t.Errorf("expected 3 VMs on pve1, got %d", len(vms))
+	}
+}
+
+func TestBulkCreateInvalidParallelism(t *testing.T) {
+	fake := setupTest(t)
+
+	for _, parallelism := range []string{"0", "-1", "two"} {
+		rec := post(createVMHandler, "/api/v1/create", createForm("count", "3", "parallelism", parallelism))
+		if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "Invalid parallelism") {
+			t.Errorf("parallelism=%s: expected 400, got %d: %s", parallelism, rec.Code, rec.Body.String())
+		}
+	}
+	if requests := fake.Requests(); len(requests) != 0 {
+		t.Errorf("expected no Proxmox requests, got %v", requests)
+	}
+}
+
+func TestBulkCreatePartialFailure(t *testing.T) {
+	fake := setupTest(t)
+	fake.Fault(FakeFault{Path: "/status/start", Times: 1, TaskStatus: "start failed: QEMU exited with code 1"})
+
+	rec := post(createVMHandler, "/api/v1/create", createForm("count", "3", "parallelism", "1"))
+	if rec.Code != http.StatusMultiStatus {
+		t.Fatalf("expected 207, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var resp struct {
+		VMs []VMResult `json:"vms"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	failed := 0
+	for _, vm := range resp.VMs {
+		if vm.Error != "" {
+			failed++
+			if vm.Rollback == nil || vm.Rollback.Action != RollbackDestroyed {
+				t.Errorf("failed VM %s was not destroyed: %+v", vm.Name, vm.Rollback)
+			}
+		}
+	}
+	if failed != 1 {
+		t.Errorf("expected 1 failed VM, got %d", failed)
+	}
+	if vms := fake.VMs("pve1"); len(vms) != 2 {
+		t.Errorf("expected 2 VMs on pve1, got %d", len(vms))
+	}
+}
+
+func TestBulkCreateAllFailed(t *testing.T) {
+	fake := setupTest(t)
+	fake.Fault(FakeFault{Path: "/clone", TaskStatus: "clone failed: no space left on device"})
+
+	rec := post(createVMHandler, "/api/v1/create", createForm("count", "2"))
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("expected 500, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var resp struct {
+		VMs []VMResult `json:"vms"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	for _, vm := range resp.VMs {
+		if vm.Error == "" {
+			t.Errorf("VM %s should have failed", vm.Name)
+		}
+	}
+}
+
+func TestCreateVMIdempotencyKey(t *testing.T) {
+	fake := setupTest(t)
+
+	// A failed request doesn't use up its key
+	fake.Fault(FakeFault{Path: "/clone", Times: 1, TaskStatus: "clone failed: no space left on device"})
+	rec := post(createVMHandler, "/api/v1/create", createForm("name", "test-vm", "request_id", "key-1"))
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("expected 500, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	rec = post(createVMHandler, "/api/v1/create", createForm("name", "test-vm", "request_id", "key-1"))
+	if rec.Code != http.StatusOK || rec.Header().Get("Idempotent-Replayed") != "" {
+		t.Fatalf("expected the retry to run, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	// A successful one is replayed
+	replay := post(createVMHandler, "/api/v1/create", createForm("name", "test-vm", "request_id", "key-1"))
+	if replay.Code != http.StatusOK || replay.Header().Get("Idempotent-Replayed") != "true" || replay.Body.String() != rec.Body.String() {
+		t.Errorf("expected the response to be replayed, got %d: %s", replay.Code, replay.Body.String())
+	}
+	if vms := fake.VMs("pve1"); len(vms) != 1 {
+		t.Errorf("expected 1 VM, got %v", vms)
+	}
+}
+
+func TestCreateVMIdempotencyKeyKeptVM(t *testing.T) {
+	fake := setupTest(t)
+	fake.Fault(FakeFault{Path: "/status/start", TaskStatus: "start failed: QEMU exited with code 1"})
+
+	// The failed VM is kept, so a retry must not create another one
+	form := createForm("on_failure", "keep", "request_id", "key-1")
+	rec := post(createVMHandler, "/api/v1/create", form)
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("expected 500, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	replay := post(createVMHandler, "/api/v1/create", form)
+	if replay.Code != http.StatusInternalServerError || replay.Header().Get("Idempotent-Replayed") != "true" || replay.Body.String() != rec.Body.String() {
+		t.Errorf("expected the failure to be replayed, got %d: %s", replay.Code, replay.Body.String())
+	}
+	if vms := fake.VMs("pve1"); len(vms) != 1 {
+		t.Errorf("expected only the kept VM, got %v", vms)
+	}
+}
+
+func TestDeleteVM(t *testing.T) {
+	fake := setupTest(t)
+	fake.AddVM(FakeVM{Node: "pve1", VMID: 200, Name: "old-vm", Status: "running"})
+
+	rec := post(deleteVMHandler, "/api/v1/delete", url.Values{"vm_name": {"old-vm"}, "stop_method": {"stop"}})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var resp struct {
+		VMID   int           `json:"vm_id"`
+		Phases []DeletePhase `json:"phases"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.VMID != 200 || len(resp.Phases) != 2 || resp.Phases[0].Name != PhaseStop || resp.Phases[1].Name != PhaseDelete {
+		t.Errorf("unexpected response: %s", rec.Body.String())
+	}
+	if _, ok := fake.VM("pve1", 200); ok {
+		t.Error("VM 200 was not deleted")
+	}
+}
+
+func TestDeleteVMMovedSinceRecorded(t *testing.T) {
+	fake := setupTest(t)
+	config.Nodes = append(config.Nodes, NodeConfig{Name: "pve2", Weight: 1, Suffix: "b"})
+	fake.AddVM(FakeVM{Node: "pve2", VMID: 200, Name: "moved-vm"})
+	fake.AddVM(FakeVM{Node: "pve1", VMID: 150, Name: "other-vm"})
+	inventory.put(InventoryVM{Name: "moved-vm", Node: "pve1", VMID: 150})
+
+	rec := post(deleteVMHandler, "/api/v1/delete", url.Values{"vm_name": {"moved-vm"}})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if _, ok := fake.VM("pve2", 200); ok {
+		t.Error("moved VM was not deleted")
+	}
+	if _, ok := fake.VM("pve1", 150); !ok {
+		t.Error("VM now using the recorded id was deleted")
+	}
+	if _, found := inventory.get("moved-vm"); found {
+		t.Error("VM still in the inventory")
+	}
+}
+
+func TestDeleteVMNotFound(t *testing.T) {
+	setupTest(t)
+
+	rec := post(deleteVMHandler, "/api/v1/delete", url.Values{"vm_name": {"missing-vm"}})
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestDeleteVMTaskFailure(t *testing.T) {
+	fake := setupTest(t)
+	fake.AddVM(FakeVM{Node: "pve1", VMID: 200, Name: "old-vm"})
+	fake.Fault(FakeFault{Method: "DELETE", TaskStatus: "unable to remove disk", TaskLog: []string{"lvremove 'pve/vm-200-disk-0' error"}})
+
+	rec := post(deleteVMHandler, "/api/v1/delete", url.Values{"node": {"pve1"}, "vm_id": {"200"}})
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("expected 500, got %d: %s", rec.Code, rec.Body.String())
+	}
+	resp := decodeResponse(t, rec)
+	if resp["phase"] != PhaseDelete || resp["proxmox_task"] == nil {
+		t.Errorf("unexpected response: %v", resp)
+	}
+	if _, ok := fake.VM("pve1", 200); !ok {
+		t.Error("VM 200 should still exist")
+	}
+}
+
+func TestKeptVMIsNotCleanedUpAsOrphan(t *testing.T) {
+	fake := setupTest(t)
+	appConfig.OrphanCleanup = true
+	appConfig.OrphanGracePeriod = 0
+	fake.Fault(FakeFault{Path: "/status/start", TaskStatus: "start failed: QEMU exited with code 1"})
+
+	rec := post(createVMHandler, "/api/v1/create", createForm("on_failure", "keep"))
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("expected 500, got %d: %s", rec.Code, rec.Body.String())
+	}
+	name, _ := decodeResponse(t, rec)["name"].(string)
+	if vm, found := inventory.get(name); !found || vm.State != InventoryKept {
+		t.Fatalf("kept VM %s not recorded in the inventory: %+v", name, vm)
+	}
+
+	reconcile(context.Background()) // tracking starts
+	fake.AddVM(FakeVM{Node: "pve1", VMID: 300, Name: "worker-small-a-300-orphan"})
+
+	report := reconcile(context.Background())
+	if len(report.CleanedUp) != 1 || report.CleanedUp[0].VMID != 300 {
+		t.Errorf("expected only the orphan to be cleaned up, got %+v", report.CleanedUp)
+	}
+	if _, ok := fake.VM("pve1", 100); !ok {
+		t.Error("kept VM was deleted")
+	}
+}
+
+func TestReconcileAdoptsVMsWhenTrackingStarts(t *testing.T) {
+	fake := setupTest(t)
+	appConfig.OrphanCleanup = true
+	appConfig.OrphanGracePeriod = 0
+	fake.AddVM(FakeVM{Node: "pve1", VMID: 300, Name: "worker-small-a-300-before"})
+
+	// VMs created before the inventory existed are adopted, not deleted
+	report := reconcile(context.Background())
+	if len(report.Adopted) != 1 || report.Adopted[0].VMID != 300 || len(report.CleanedUp) != 0 {
+		t.Fatalf("expected VM 300 to be adopted, got %+v", report)
+	}
+	if vm, found := inventory.get("worker-small-a-300-before"); !found || vm.State != InventoryAdopted {
+		t.Errorf("adopted VM not recorded in the inventory: %+v", vm)
+	}
+
+	// Orphans showing up later are cleaned up
+	fake.AddVM(FakeVM{Node: "pve1", VMID: 301, Name: "worker-small-a-301-orphan"})
+	report = reconcile(context.Background())
+	if len(report.CleanedUp) != 1 || report.CleanedUp[0].VMID != 301 {
+		t.Errorf("expected only VM 301 to be cleaned up, got %+v", report.CleanedUp)
+	}
+	if _, ok := fake.VM("pve1", 300); !ok {
+		t.Error("adopted VM was deleted")
+	}
+}
+
+func TestReconcileSkipsCleanupWithEmptyInventory(t *testing.T) {
+	fake := setupTest(t)
+	appConfig.OrphanCleanup = true
+	appConfig.OrphanGracePeriod = 0
+	reconcile(context.Background()) // tracking starts
+
+	fake.AddVM(FakeVM{Node: "pve1", VMID: 300, Name: "worker-small-a-300-orphan"})
+	report := reconcile(context.Background())
+	if len(report.Orphaned) != 1 || len(report.CleanedUp) != 0 {
+		t.Errorf("expected the orphan to be reported only, got %+v", report)
+	}
+	if _, ok := fake.VM("pve1", 300); !ok {
+		t.Error("orphan deleted with an empty inventory")
+	}
+}
+
+func TestReconcileUpdatesDriftedVMs(t *testing.T) {
+	fake := setupTest(t)
+	fake.AddVM(FakeVM{Node: "pve1", VMID: 300, Name: "moved"})
+	inventory.put(InventoryVM{Name: "moved", Node: "pve2", VMID: 150})
+
+	report := reconcile(context.Background())
+	if len(report.Drifted) != 1 || report.Drifted[0].Details != "node pve2 -> pve1, vm_id 150 -> 300" {
+		t.Fatalf("expected the drift to be reported, got %+v", report.Drifted)
+	}
+	if vm, _ := inventory.get("moved"); vm.Node != "pve1" || vm.VMID != 300 {
+		t.Errorf("inventory not updated: %+v", vm)
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// IdempotencyRecord is a create request made with an Idempotency-Key header (or request_id
+// parameter) and, once it finished, the response to replay for repeated requests
+type IdempotencyRecord struct {
+	Key         string    `json:"key"`
+	Fingerprint string    `json:"fingerprint"` // hash of the request parameters
+	JobIDs      []string  `json:"job_ids,omitempty"`
+	StatusCode  int       `json:"status_code,omitempty"` // 0 while the request runs
+	ContentType string    `json:"content_type,omitempty"`
+	Body        string    `json:"body,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// idempotencyStore keeps the records of the last IDEMPOTENCY_WINDOW, persisted like the inventory
+type idempotencyStore struct {
+	mu      sync.Mutex
+	path    string
+	records map[string]*IdempotencyRecord
+	running map[string]bool // keys of requests running in this process
+}
+
+var idempotency *idempotencyStore
+
+func openIdempotencyStore(path string) (*idempotencyStore, error) {
+	store := &idempotencyStore{path: path, records: map[string]*IdempotencyRecord{}, running: map[string]bool{}}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var records []*IdempotencyRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, err
+	}
+	for _, record := range records {
+		store.records[record.Key] = record
+	}
+	return store, nil
+}
+
+// save writes the records to disk; callers hold s.mu
+func (s *idempotencyStore) save() error {
+	records := make([]*IdempotencyRecord, 0, len(s.records))
+	for _, record := range s.records {
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].CreatedAt.Before(records[j].CreatedAt) })
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data)
+}
+
+// begin claims key for a new request. If the key was already used within the window, the
+// existing record is returned instead and the request must not run.
+func (s *idempotencyStore) begin(key string, fingerprint string) (*IdempotencyRecord, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, record := range s.records {
+		if time.Since(record.CreatedAt) > appConfig.IdempotencyWindow && !s.running[k] {
+			delete(s.records, k)
+		}
+	}
+
+	if record, ok := s.records[key]; ok {
+		cp := *record
+		return &cp, s.running[key], nil
+	}
+	s.records[key] = &IdempotencyRecord{Key: key, Fingerprint: fingerprint, CreatedAt: time.Now().UTC()}
+	s.running[key] = true
+	return nil, false, s.save()
+}
+
+// setJobs records the jobs started for key, so repeated requests can be pointed at them
+func (s *idempotencyStore) setJobs(key string, jobIDs []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if record, ok := s.records[key]; ok {
+		record.JobIDs = jobIDs
+	}
+	return s.save()
+}
+
+// finish stores the response of the request for key. Requests that failed before any job
+// was started created nothing, so their key is released and can be retried. So is the key of
+// 5xx responses (e.g. a failed pipeline, or a sync request whose client went away), unless a
+// VM was left behind by on_failure=keep or a failed rollback: a retry would duplicate it.
+func (s *idempotencyStore) finish(key string, rec *responseRecorder) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.running, key)
+	record, ok := s.records[key]
+	if !ok {
+		return nil
+	}
+	if len(record.JobIDs) == 0 || (rec.status >= http.StatusInternalServerError && !jobsLeftVMs(record.JobIDs)) {
+		delete(s.records, key)
+	} else {
+		record.StatusCode = rec.status
+		record.ContentType = rec.Header().Get("Content-Type")
+		record.Body = rec.body.String()
+	}
+	return s.save()
+}
+
+// jobsLeftVMs tells whether any of the jobs left a VM in Proxmox: succeeded, kept or not rolled
+// back. Jobs that are gone already count as having left one.
+func jobsLeftVMs(jobIDs []string) bool {
+	for _, id := range jobIDs {
+		job := getJob(id)
+		if job == nil {
+			return true
+		}
+		snapshot := job.snapshot()
+		if snapshot.Status == JobSucceeded {
+			return true
+		}
+		if result := snapshot.Result; result != nil && result.Rollback != nil && result.Rollback.Action != RollbackDestroyed {
+			return true
+		}
+	}
+	return false
+}
+
+// requestFingerprint hashes the request parameters, so a key reused for another request is detected
+func requestFingerprint(form url.Values) string {
+	keys := make([]string, 0, len(form))
+	for key := range form {
+		if key != "request_id" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	hash := sha256.New()
+	for _, key := range keys {
+		for _, value := range form[key] {
+			hash.Write([]byte(key + "=" + value + "\n"))
+		}
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// responseRecorder passes a response through while keeping a copy of it
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(data []byte) (int, error) {
+	r.body.Write(data)
+	return r.ResponseWriter.Write(data)
+}
+
+// replayIdempotent answers a repeated request: with the stored response once the original
+// request finished, or with its jobs while it still runs
+func replayIdempotent(w http.ResponseWriter, record *IdempotencyRecord, running bool, fingerprint string) {
+	w.Header().Set("Idempotent-Replayed", "true")
+	switch {
+	case record.Fingerprint != fingerprint:
+		http.Error(w, "Idempotency-Key was already used with different parameters", http.StatusUnprocessableEntity)
+	case record.StatusCode != 0:
+		if record.ContentType != "" {
+			w.Header().Set("Content-Type", record.ContentType)
+		}
+		w.WriteHeader(record.StatusCode)
+		w.Write([]byte(record.Body))
+	case running && len(record.JobIDs) == 0:
+		http.Error(w, "A request with this Idempotency-Key is being validated, retry shortly", http.StatusConflict)
+	case running:
+		w.Header().Set("Content-Type", "application/json")
+		if len(record.JobIDs) == 1 {
+			w.Header().Set("Location", "/api/v1/jobs/"+record.JobIDs[0])
+		}
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"job_ids": record.JobIDs,
+			"status":  JobRunning,
+		})
+	default:
+		// The deployer restarted while the request ran; its VMs may or may not exist
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":   "The request with this Idempotency-Key was interrupted by a restart, check /api/v1/vms for its VMs",
+			"job_ids": record.JobIDs,
+		})
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Inventory states; VMs the deployer created successfully have none
+const (
+	InventoryKept    = "kept"    // creation failed and the VM was kept with on_failure=keep
+	InventoryAdopted = "adopted" // named like a deployer VM and found when tracking started
+)
+
+// InventoryVM is a VM created by the deployer
+type InventoryVM struct {
+	VMID         int       `json:"vm_id"`
+	Node         string    `json:"node"`
+	Name         string    `json:"name"`
+	IP           string    `json:"ip"`
+	Role         string    `json:"role"`
+	BaseTemplate string    `json:"base_template"`
+	VmTemplate   string    `json:"vm_template"`
+	Affinity     string    `json:"affinity,omitempty"` // pinned host cores
+	NUMA         []int     `json:"numa,omitempty"`     // host NUMA nodes the VM is bound to
+	CreatedAt    time.Time `json:"created_at"`
+	Requestor    string    `json:"requestor,omitempty"`
+	Pool         string    `json:"pool,omitempty"` // node pool managing the VM
+	JobID        string    `json:"job_id,omitempty"`
+	State        string    `json:"state,omitempty"` // InventoryKept or InventoryAdopted
+}
+
+// inventoryStore keeps the deployed VMs in memory, keyed by name, and persists every change
+// to a JSON file (written with writeFileAtomic, so a crash never leaves it half written)
+type inventoryStore struct {
+	mu    sync.Mutex
+	path  string
+	vms   map[string]*InventoryVM
+	fresh bool // the file didn't exist, and the VMs created before it haven't been adopted yet
+}
+
+var inventory *inventoryStore
+
+func openInventory(path string) (*inventoryStore, error) {
+	store := &inventoryStore{path: path, vms: map[string]*InventoryVM{}}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		store.fresh = true
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var vms []*InventoryVM
+	if err := json.Unmarshal(data, &vms); err != nil {
+		return nil, err
+	}
+	for _, vm := range vms {
+		store.vms[vm.Name] = vm
+	}
+	return store, nil
+}
+
+// save writes the inventory to disk; callers hold s.mu
+func (s *inventoryStore) save() error {
+	vms := make([]*InventoryVM, 0, len(s.vms))
+	for _, vm := range s.vms {
+		vms = append(vms, vm)
+	}
+	sort.Slice(vms, func(i, j int) bool { return vms[i].Name < vms[j].Name })
+	data, err := json.MarshalIndent(vms, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(s.path, data)
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames it over path
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (s *inventoryStore) put(vm InventoryVM) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.vms[vm.Name] = &vm
+	return s.save()
+}
+
+// update changes a VM in place; unknown names are ignored, so a VM deleted meanwhile isn't recreated
+func (s *inventoryStore) update(name string, change func(vm *InventoryVM)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	vm, ok := s.vms[name]
+	if !ok {
+		return nil
+	}
+	change(vm)
+	return s.save()
+}
+
+// isFresh tells whether tracking just started: the file didn't exist and adoption isn't done
+func (s *inventoryStore) isFresh() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.fresh
+}
+
+// adopted records that the VMs which existed before tracking started are in the inventory
+func (s *inventoryStore) adopted() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fresh = false
+	return s.save()
+}
+
+// remove forgets a VM; unknown names are ignored
+func (s *inventoryStore) remove(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.vms[name]; !ok {
+		return nil
+	}
+	delete(s.vms, name)
+	return s.save()
+}
+
+func (s *inventoryStore) get(name string) (InventoryVM, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	vm, ok := s.vms[name]
+	if !ok {
+		return InventoryVM{}, false
+	}
+	return *vm, true
+}
+
+// findByID returns the VM with vmid on node
+func (s *inventoryStore) findByID(node string, vmid int) (InventoryVM, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, vm := range s.vms {
+		if vm.Node == node && vm.VMID == vmid {
+			return *vm, true
+		}
+	}
+	return InventoryVM{}, false
+}
+
+// list returns the VMs matching filter (all with a nil filter), sorted by name
+func (s *inventoryStore) list(filter func(*InventoryVM) bool) []InventoryVM {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	vms := []InventoryVM{}
+	for _, vm := range s.vms {
+		if filter == nil || filter(vm) {
+			vms = append(vms, *vm)
+		}
+	}
+	sort.Slice(vms, func(i, j int) bool { return vms[i].Name < vms[j].Name })
+	return vms
+}
+
+// requestor identifies who asked for a VM: the X-Requestor header, or the client address
+func requestor(r *http.Request) string {
+	if name := r.Header.Get("X-Requestor"); name != "" {
+		return name
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// vmsHandler serves GET /api/v1/vms (filtered by node, role, vm_template, base_template and pool)
+// and GET /api/v1/vms/{name}
+func vmsHandler(w http.ResponseWriter, r *http.Request) {
+	handlerName := "/api/v1/vms"
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if r.Header.Get("X-Auth-Token") != authToken {
+		logger.Error("Unauthorized access to %s", handlerName)
+		incErrorCounterHandler(handlerName)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/vms"), "/")
+	if name != "" {
+		vm, ok := inventory.get(name)
+		if !ok {
+			http.Error(w, "VM not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(vm)
+		return
+	}
+
+	query := r.URL.Query()
+	node, role := query.Get("node"), query.Get("role")
+	vmTemplate, baseTemplate := query.Get("vm_template"), query.Get("base_template")
+	pool, state := query.Get("pool"), query.Get("state")
+	vms := inventory.list(func(vm *InventoryVM) bool {
+		return (state == "" || vm.State == state) &&
+			(node == "" || vm.Node == node) &&
+			(role == "" || vm.Role == role) &&
+			(vmTemplate == "" || vm.VmTemplate == vmTemplate) &&
+			(baseTemplate == "" || vm.BaseTemplate == baseTemplate) &&
+			(pool == "" || vm.Pool == pool)
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"count": len(vms),
+		"vms":   vms,
+	})
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Job statuses
+const (
+	JobPending   = "pending"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+	JobCanceled  = "canceled"
+)
+
+// Pipeline steps reported in job status
+const (
+	StepCloning        = "cloning"
+	StepConfiguring    = "configuring"
+	StepResizing       = "resizing"
+	StepStarting       = "starting"
+	StepResetting      = "resetting"
+	StepWaitingIP      = "waiting_ip"
+	StepApplyingConfig = "applying_config"
+	StepWaitingReady   = "waiting_ready"
+	StepRollingBack    = "rolling_back"
+)
+
+// on_failure policies
+const (
+	OnFailureKeep    = "keep"
+	OnFailureDestroy = "destroy"
+)
+
+// Rollback outcomes
+const (
+	RollbackKept      = "kept"
+	RollbackDestroyed = "destroyed"
+	RollbackFailed    = "failed"
+)
+
+type RollbackResult struct {
+	Action string `json:"action"`
+	Error  string `json:"error,omitempty"`
+}
+
+type JobStep struct {
+	Name            string     `json:"name"`
+	StartedAt       time.Time  `json:"started_at"`
+	FinishedAt      *time.Time `json:"finished_at,omitempty"`
+	DurationSeconds float64    `json:"duration_seconds"`
+	Detail          string     `json:"detail,omitempty"`
+	Error           string     `json:"error,omitempty"`
+	Log             []string   `json:"log,omitempty"` // last lines of the Proxmox task log
+}
+
+type Job struct {
+	mu sync.Mutex
+
+	ID         string     `json:"id"`
+	Status     string     `json:"status"`
+	Step       string     `json:"step,omitempty"`
+	Node       string     `json:"node,omitempty"`  // Proxmox node of the VM, once cloning started
+	VMID       int        `json:"vm_id,omitempty"` // id of the VM, once cloning started
+	Steps      []JobStep  `json:"steps"`
+	Result     *VMResult  `json:"result,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+
+	cancel   context.CancelFunc // cancels the running pipeline
+	canceled bool               // cancellation was requested, possibly before the pipeline started
+}
+
+var (
+	jobsMu sync.Mutex
+	jobs   = map[string]*Job{}
+)
+
+// newJob registers a pending job and drops finished jobs older than the retention window
+func newJob() *Job {
+	job := &Job{
+		ID:        generateRandomString(16),
+		Status:    JobPending,
+		Steps:     []JobStep{},
+		CreatedAt: time.Now(),
+	}
+
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	for id, j := range jobs {
+		j.mu.Lock()
+		expired := j.FinishedAt != nil && time.Since(*j.FinishedAt) > appConfig.JobRetention
+		j.mu.Unlock()
+		if expired {
+			delete(jobs, id)
+		}
+	}
+	jobs[job.ID] = job
+	return job
+}
+
+func getJob(id string) *Job {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	return jobs[id]
+}
+
+// start derives the context of the pipeline run for the job, which is canceled by cancelJob
+func (j *Job) start(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.cancel = cancel
+	if j.canceled {
+		cancel()
+	}
+	return ctx, cancel
+}
+
+// cancelJob stops the pipeline of the job; it reports false if the job already finished
+func (j *Job) cancelJob() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.FinishedAt != nil {
+		return false
+	}
+	j.canceled = true
+	if j.cancel != nil {
+		j.cancel()
+	}
+	return true
+}
+
+// beginStep closes the current step (if any) and starts a new one
+func (j *Job) beginStep(name string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.closeStep(nil)
+	j.Status = JobRunning
+	j.Step = name
+	j.Steps = append(j.Steps, JobStep{Name: name, StartedAt: time.Now()})
+}
+
+// setVM records the VM the job is creating
+func (j *Job) setVM(node string, vmid int) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.Node = node
+	j.VMID = vmid
+}
+
+// vmBeingCreated reports whether an unfinished job is creating VM vmid on node
+func vmBeingCreated(node string, vmid int) bool {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	for _, job := range jobs {
+		job.mu.Lock()
+		active := job.FinishedAt == nil && job.Node == node && job.VMID == vmid
+		job.mu.Unlock()
+		if active {
+			return true
+		}
+	}
+	return false
+}
+
+// setStepDetail records progress within the current step, e.g. the readiness stage
+func (j *Job) setStepDetail(detail string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if len(j.Steps) > 0 {
+		j.Steps[len(j.Steps)-1].Detail = detail
+	}
+}
+
+// addStepLog appends task log lines to the current step, keeping the last TASK_LOG_LINES
+func (j *Job) addStepLog(lines []string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if len(j.Steps) == 0 {
+		return
+	}
+	step := &j.Steps[len(j.Steps)-1]
+	// Snapshots share the slice, so it is never modified in place
+	log := append(append([]string(nil), step.Log...), lines...)
+	if len(log) > appConfig.TaskLogLines {
+		log = log[len(log)-appConfig.TaskLogLines:]
+	}
+	step.Log = log
+}
+
+// endStep closes the current step, recording err if the step failed
+func (j *Job) endStep(err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.closeStep(err)
+}
+
+// finish closes the current step and records the final result or error
+func (j *Job) finish(result *VMResult, err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.closeStep(err)
+	now := time.Now()
+	j.FinishedAt = &now
+	j.Result = result
+	if err != nil {
+		j.Status = JobFailed
+		if errors.Is(err, context.Canceled) {
+			j.Status = JobCanceled
+		}
+		j.Error = err.Error()
+		return
+	}
+	j.Status = JobSucceeded
+	j.Step = ""
+}
+
+// closeStep must be called with j.mu held
+func (j *Job) closeStep(err error) {
+	if len(j.Steps) == 0 {
+		return
+	}
+	last := &j.Steps[len(j.Steps)-1]
+	if last.FinishedAt != nil {
+		return
+	}
+	now := time.Now()
+	last.FinishedAt = &now
+	last.DurationSeconds = now.Sub(last.StartedAt).Seconds()
+	if err != nil {
+		last.Error = err.Error()
+	}
+}
+
+// snapshot returns a copy of the job that is safe to encode while the pipeline runs
+func (j *Job) snapshot() *Job {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	cp := &Job{
+		ID:         j.ID,
+		Status:     j.Status,
+		Step:       j.Step,
+		Node:       j.Node,
+		VMID:       j.VMID,
+		Steps:      append([]JobStep(nil), j.Steps...),
+		Error:      j.Error,
+		CreatedAt:  j.CreatedAt,
+		FinishedAt: j.FinishedAt,
+	}
+	if j.Result != nil {
+		result := *j.Result
+		if result.Rollback != nil {
+			rollback := *result.Rollback
+			result.Rollback = &rollback
+		}
+		cp.Result = &result
+	}
+	return cp
+}
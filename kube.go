@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	inClusterTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	inClusterCAFile    = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+)
+
+var (
+	kubeAPIServer  string
+	kubeTokenFile  string
+	kubeHTTPClient *http.Client
+)
+
+// KubeAPIError is a non-2xx response from the Kubernetes API
+type KubeAPIError struct {
+	Status  int
+	Reason  string
+	Message string
+}
+
+func (e *KubeAPIError) Error() string {
+	return fmt.Sprintf("Kubernetes API returned %d %s: %s", e.Status, e.Reason, e.Message)
+}
+
+func isKubeNotFound(err error) bool {
+	var kubeErr *KubeAPIError
+	return errors.As(err, &kubeErr) && kubeErr.Status == http.StatusNotFound
+}
+
+// initKubeClient configures access to the Kubernetes API from KUBE_* variables,
+// falling back to the in-cluster service account. Kubernetes features stay disabled without either.
+func initKubeClient() error {
+	kubeAPIServer = appConfig.KubeAPIServer
+	kubeTokenFile = appConfig.KubeTokenFile
+	caFile := appConfig.KubeCAFile
+
+	if kubeAPIServer == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			logger.Info("Kubernetes API not configured, Kubernetes features are disabled")
+			return nil
+		}
+		kubeAPIServer = "https://" + net.JoinHostPort(host, port)
+		if kubeTokenFile == "" {
+			kubeTokenFile = inClusterTokenFile
+		}
+		if caFile == "" {
+			caFile = inClusterCAFile
+		}
+	}
+	kubeAPIServer = strings.TrimSuffix(kubeAPIServer, "/")
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: !appConfig.VerifySSL}
+	if caFile != "" {
+		caData, err := os.ReadFile(caFile)
+		if err != nil {
+			return fmt.Errorf("failed to read Kubernetes CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caData) {
+			return fmt.Errorf("no certificates found in Kubernetes CA file %s", caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	kubeHTTPClient = &http.Client{
+		Timeout:   30 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	}
+	logger.Info("Kubernetes API configured: %s", kubeAPIServer)
+	return nil
+}
+
+func kubeEnabled() bool {
+	return kubeHTTPClient != nil
+}
+
+// kubeRequest sends body (if any) as JSON and decodes the response into out (if any)
+func kubeRequest(ctx context.Context, method string, path string, contentType string, body interface{}, out interface{}) error {
+	if !kubeEnabled() {
+		return fmt.Errorf("Kubernetes API is not configured")
+	}
+
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, kubeAPIServer+path, reqBody)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		if contentType == "" {
+			contentType = "application/json"
+		}
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.Header.Set("Accept", "application/json")
+	if kubeTokenFile != "" {
+		token, err := os.ReadFile(kubeTokenFile)
+		if err != nil {
+			return fmt.Errorf("failed to read Kubernetes token: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+
+	resp, err := kubeHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	logger.Debug("kubeRequest %s %s raw response: %s", method, path, string(respBody))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var status struct {
+			Reason  string `json:"reason"`
+			Message string `json:"message"`
+		}
+		json.Unmarshal(respBody, &status)
+		if status.Message == "" {
+			status.Message = strings.TrimSpace(string(respBody))
+		}
+		return &KubeAPIError{Status: resp.StatusCode, Reason: status.Reason, Message: status.Message}
+	}
+
+	if out != nil {
+		return json.Unmarshal(respBody, out)
+	}
+	return nil
+}
+
+type KubeNode struct {
+	Metadata struct {
+		Name   string            `json:"name"`
+		Labels map[string]string `json:"labels"`
+	} `json:"metadata"`
+	Spec struct {
+		Unschedulable bool   `json:"unschedulable"`
+		ProviderID    string `json:"providerID"`
+	} `json:"spec"`
+	Status struct {
+		Addresses []struct {
+			Type    string `json:"type"`
+			Address string `json:"address"`
+		} `json:"addresses"`
+		Conditions []struct {
+			Type    string `json:"type"`
+			Status  string `json:"status"`
+			Reason  string `json:"reason"`
+			Message string `json:"message"`
+		} `json:"conditions"`
+	} `json:"status"`
+}
+
+// isReady reports whether the node's Ready condition is True
+func (n *KubeNode) isReady() bool {
+	for _, condition := range n.Status.Conditions {
+		if condition.Type == "Ready" {
+			return condition.Status == "True"
+		}
+	}
+	return false
+}
+
+func getKubeNode(ctx context.Context, name string) (*KubeNode, error) {
+	var node KubeNode
+	if err := kubeRequest(ctx, "GET", "/api/v1/nodes/"+name, "", nil, &node); err != nil {
+		return nil, err
+	}
+	return &node, nil
+}
+
+func (n *KubeNode) isControlPlane() bool {
+	_, ok := n.Metadata.Labels["node-role.kubernetes.io/control-plane"]
+	return ok
+}
+
+// internalIP returns the InternalIP address of the node, or "" if it has none
+func (n *KubeNode) internalIP() string {
+	for _, address := range n.Status.Addresses {
+		if address.Type == "InternalIP" {
+			return address.Address
+		}
+	}
+	return ""
+}
+
+func cordonKubeNode(ctx context.Context, name string) error {
+	patch := map[string]interface{}{"spec": map[string]interface{}{"unschedulable": true}}
+	return kubeRequest(ctx, "PATCH", "/api/v1/nodes/"+name, "application/merge-patch+json", patch, nil)
+}
+
+// deleteKubeNode removes the Node object; a node that is already gone is not an error
+func deleteKubeNode(ctx context.Context, name string) error {
+	err := kubeRequest(ctx, "DELETE", "/api/v1/nodes/"+name, "", nil, nil)
+	if isKubeNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+type KubePod struct {
+	Metadata struct {
+		Name            string            `json:"name"`
+		Namespace       string            `json:"namespace"`
+		Annotations     map[string]string `json:"annotations"`
+		OwnerReferences []struct {
+			Kind string `json:"kind"`
+		} `json:"ownerReferences"`
+	} `json:"metadata"`
+	Status struct {
+		Phase string `json:"phase"`
+	} `json:"status"`
+}
+
+// drainable tells whether drain has to evict the pod. DaemonSet pods would be recreated
+// on the node and mirror pods can't be evicted, like kubectl drain --ignore-daemonsets.
+func (p *KubePod) drainable() bool {
+	if _, ok := p.Metadata.Annotations["kubernetes.io/config.mirror"]; ok {
+		return false
+	}
+	for _, owner := range p.Metadata.OwnerReferences {
+		if owner.Kind == "DaemonSet" {
+			return false
+		}
+	}
+	return p.Status.Phase != "Succeeded" && p.Status.Phase != "Failed"
+}
+
+func listKubeNodePods(ctx context.Context, name string) ([]KubePod, error) {
+	var list struct {
+		Items []KubePod `json:"items"`
+	}
+	path := "/api/v1/pods?fieldSelector=" + url.QueryEscape("spec.nodeName="+name)
+	if err := kubeRequest(ctx, "GET", path, "", nil, &list); err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+// drainKubeNode evicts all drainable pods of a (cordoned) node through the Eviction API, so
+// PodDisruptionBudgets are respected, and waits until they are gone
+func drainKubeNode(ctx context.Context, name string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		pods, err := listKubeNodePods(ctx, name)
+		if err != nil {
+			return err
+		}
+
+		var remaining []string
+		var lastErr error
+		for _, pod := range pods {
+			if !pod.drainable() {
+				continue
+			}
+			remaining = append(remaining, pod.Metadata.Namespace+"/"+pod.Metadata.Name)
+			eviction := map[string]interface{}{
+				"apiVersion": "policy/v1",
+				"kind":       "Eviction",
+				"metadata": map[string]string{
+					"name":      pod.Metadata.Name,
+					"namespace": pod.Metadata.Namespace,
+				},
+			}
+			path := fmt.Sprintf("/api/v1/namespaces/%s/pods/%s/eviction", pod.Metadata.Namespace, pod.Metadata.Name)
+			// 429 means a PodDisruptionBudget doesn't allow the eviction yet
+			if err := kubeRequest(ctx, "POST", path, "", eviction, nil); err != nil && !isKubeNotFound(err) {
+				lastErr = err
+			}
+		}
+		if len(remaining) == 0 {
+			logger.Info("Node %s drained", name)
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			msg := fmt.Sprintf("timed out after %v with %d pod(s) left: %s", timeout, len(remaining), strings.Join(remaining, ", "))
+			if lastErr != nil {
+				msg += ": " + lastErr.Error()
+			}
+			return errors.New(msg)
+		}
+		logger.Debug("Draining node %s: %d pod(s) left", name, len(remaining))
+		if err := sleepContext(ctx, 5*time.Second); err != nil {
+			return fmt.Errorf("stopped with %d pod(s) left: %w", len(remaining), err)
+		}
+	}
+}
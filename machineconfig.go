@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"gopkg.in/yaml.v2"
+)
+
+// MachineConfigData is what TALOS_MACHINE_TEMPLATE is rendered with, e.g. {{ .VMName }}
+// or {{ if eq .Role "controlplane" }}...{{ end }}
+type MachineConfigData struct {
+	VMName               string            // VM name, also used as hostname
+	VMID                 int               // Proxmox VM id
+	ProviderID           string            // proxmox-talos://<node>/<vmid>, for the kubelet provider-id
+	VMIP                 string            // IP address reported by the guest agent
+	Role                 string            // worker or controlplane
+	Node                 string            // Proxmox node name
+	Suffix               string            // suffix of the Proxmox node
+	VmTemplate           VmTemplate        // VM template: .VmTemplate.Name, .CPU, .Memory, .Disk, .CPUModel
+	NUMA                 []int             // host NUMA nodes the VM is bound to
+	ControlPlaneEndpoint string            // TALOS_CONTROLPLANE_ENDPOINT
+	Vars                 map[string]string // extra variables from var_<name> request parameters
+
+	lenientVars bool // render missing .Vars entries as "<no value>" instead of failing
+}
+
+// Legacy {placeholder} tokens and the template fields they stand for
+var legacyPlaceholders = map[string]string{
+	"role":        "{{.Role}}",
+	"vm_name":     "{{.VMName}}",
+	"vm_id":       "{{.VMID}}",
+	"vm_ip":       "{{.VMIP}}",
+	"node":        "{{.Node}}",
+	"vm_template": "{{.VmTemplate.Name}}",
+	"cpu":         "{{.VmTemplate.CPUModel}}",
+	"cpu_cores":   "{{.VmTemplate.CPU}}",
+	"memory":      "{{.VmTemplate.Memory}}",
+	"disk":        "{{.VmTemplate.Disk}}",
+	"suffix":      "{{.Suffix}}",
+}
+
+var (
+	legacyPlaceholderRe = regexp.MustCompile(`\{([a-z_]+)\}`)
+	templateActionRe    = regexp.MustCompile(`(?s)\{\{.*?\}\}`)
+)
+
+// parseMachineTemplate turns legacy {placeholder} tokens into template actions and parses the result.
+// Any other {word} is rejected as a misspelled placeholder; ${word} (shell and environment variables)
+// and {word} inside template actions, e.g. {{ "{word}" }}, are left alone. Using a variable that
+// wasn't passed is an error.
+func parseMachineTemplate(content string) (*template.Template, error) {
+	actions := templateActionRe.FindAllStringIndex(content, -1)
+	inAction := func(pos int) bool {
+		for _, action := range actions {
+			if pos >= action[0] && pos < action[1] {
+				return true
+			}
+		}
+		return false
+	}
+
+	var converted strings.Builder
+	var unknown []string
+	last := 0
+	for _, match := range legacyPlaceholderRe.FindAllStringSubmatchIndex(content, -1) {
+		start, end := match[0], match[1]
+		if (start > 0 && content[start-1] == '$') || inAction(start) {
+			continue
+		}
+		action, ok := legacyPlaceholders[content[match[2]:match[3]]]
+		if !ok {
+			unknown = append(unknown, content[start:end])
+			continue
+		}
+		converted.WriteString(content[last:start])
+		converted.WriteString(action)
+		last = end
+	}
+	if len(unknown) > 0 {
+		return nil, fmt.Errorf("unknown placeholders %s (write ${word} or {{ \"{word}\" }} for literal text)", strings.Join(unknown, ", "))
+	}
+	converted.WriteString(content[last:])
+	return template.New("machine").Option("missingkey=error").Parse(converted.String())
+}
+
+// renderMachineConfig renders the machine config template file at templatePath
+func renderMachineConfig(templatePath string, data *MachineConfigData) (string, error) {
+	templateContent, err := os.ReadFile(templatePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read Talos template file %s: %v", templatePath, err)
+	}
+
+	return renderMachineTemplate(templatePath, string(templateContent), data)
+}
+
+// renderMachineTemplate renders a machine config template or config patch; source names it in errors
+func renderMachineTemplate(source string, content string, data *MachineConfigData) (string, error) {
+	tmpl, err := parseMachineTemplate(content)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse template %s: %v", source, err)
+	}
+	if data.Vars == nil {
+		data.Vars = map[string]string{}
+	}
+	if data.lenientVars {
+		tmpl.Option("missingkey=default")
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("failed to render template %s: %v", source, err)
+	}
+	return buf.String(), nil
+}
+
+// buildMachineConfig renders the machine template and the config patches of a VM and validates the result
+func buildMachineConfig(vmTemplate VmTemplate, requestPatches []string, data *MachineConfigData) (string, error) {
+	talosConfig, err := renderMachineConfig(talosMachineTemplate, data)
+	if err != nil {
+		return "", err
+	}
+	patches, err := renderConfigPatches(vmTemplate, requestPatches, data)
+	if err != nil {
+		return "", err
+	}
+	if talosConfig, err = applyConfigPatches(talosConfig, patches); err != nil {
+		return "", err
+	}
+	if err := validateMachineConfig(talosConfig, data.Role); err != nil {
+		return "", fmt.Errorf("invalid machine config: %w", err)
+	}
+	return talosConfig, nil
+}
+
+// previewMachineConfig builds the machine config of a VM before it is cloned, with placeholder
+// values for what is only known later (VM id, name, IP), to catch template errors early
+func previewMachineConfig(p *createParams) error {
+	vmName := p.Name
+	if vmName == "" {
+		vmName = fmt.Sprintf("%s-%s-100-preview", p.VmTemplate.Name, p.Node.Suffix)
+	}
+	_, err := buildMachineConfig(p.VmTemplate, p.Patches, &MachineConfigData{
+		VMName:               vmName,
+		VMID:                 100,
+		ProviderID:           providerID(p.Node.Name, 100),
+		VMIP:                 "192.0.2.10",
+		Role:                 p.VmTemplate.Role,
+		Node:                 p.Node.Name,
+		Suffix:               p.Node.Suffix,
+		VmTemplate:           p.VmTemplate,
+		ControlPlaneEndpoint: talosControlPlaneEndpoint,
+		Vars:                 p.Vars,
+	})
+	return err
+}
+
+// validateMachineTemplates previews the machine config of every VM template on every node at startup.
+// Request variables aren't known yet, so missing .Vars entries are tolerated here.
+func validateMachineTemplates() error {
+	nodes := config.Nodes
+	if len(nodes) == 0 {
+		nodes = []NodeConfig{{}}
+	}
+	for _, vmTemplate := range config.VmTemplates {
+		for _, node := range nodes {
+			_, err := buildMachineConfig(vmTemplate, nil, &MachineConfigData{
+				VMName:               fmt.Sprintf("%s-%s-100-preview", vmTemplate.Name, node.Suffix),
+				VMID:                 100,
+				ProviderID:           providerID(node.Name, 100),
+				VMIP:                 "192.0.2.10",
+				Role:                 vmTemplate.Role,
+				Node:                 node.Name,
+				Suffix:               node.Suffix,
+				VmTemplate:           vmTemplate,
+				ControlPlaneEndpoint: talosControlPlaneEndpoint,
+				lenientVars:          true,
+			})
+			if err != nil {
+				return fmt.Errorf("vm_template %s on node %s: %w", vmTemplate.Name, node.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Fields every machine config needs, and the extra ones of control plane configs
+var (
+	requiredConfigFields             = []string{"machine.token", "machine.ca.crt", "cluster.controlPlane.endpoint", "cluster.token", "cluster.ca.crt"}
+	requiredControlPlaneConfigFields = []string{"machine.ca.key", "cluster.ca.key"}
+)
+
+// validateMachineConfig checks that every document of config is well-formed YAML and that the v1alpha1
+// machine config has the required fields and a machine type matching role
+func validateMachineConfig(config string, role string) error {
+	var machineConfig map[string]interface{}
+	for i, document := range yamlDocumentSeparator.Split(config, -1) {
+		if strings.TrimSpace(document) == "" {
+			continue
+		}
+		var parsed interface{}
+		if err := yaml.Unmarshal([]byte(document), &parsed); err != nil {
+			return fmt.Errorf("document %d is not valid YAML: %v", i+1, err)
+		}
+		if m, ok := normalizeYAML(parsed).(map[string]interface{}); ok && machineConfig == nil && m["machine"] != nil {
+			machineConfig = m
+		}
+	}
+	if machineConfig == nil {
+		return errors.New("no machine config document with a machine section")
+	}
+
+	get := func(path string) interface{} {
+		var value interface{} = machineConfig
+		for _, key := range strings.Split(path, ".") {
+			m, ok := value.(map[string]interface{})
+			if !ok {
+				return nil
+			}
+			value = m[key]
+		}
+		if value == "" {
+			return nil
+		}
+		return value
+	}
+
+	if version := get("version"); version != "v1alpha1" {
+		return fmt.Errorf("version must be v1alpha1, got %v", version)
+	}
+	machineType, _ := get("machine.type").(string)
+	switch machineType {
+	case "worker", "controlplane", "init":
+	default:
+		return fmt.Errorf("machine.type must be worker, controlplane or init, got %q", machineType)
+	}
+	if role != "" && machineType != role && !(role == "controlplane" && machineType == "init") {
+		return fmt.Errorf("machine.type %s doesn't match role %s of the VM template", machineType, role)
+	}
+
+	required := requiredConfigFields
+	if machineType != "worker" {
+		required = append(append([]string(nil), required...), requiredControlPlaneConfigFields...)
+	}
+	var missing []string
+	for _, field := range required {
+		if get(field) == nil {
+			missing = append(missing, field)
+		}
+	}
+	if get("machine.install.disk") == nil && get("machine.install.diskSelector") == nil {
+		missing = append(missing, "machine.install.disk")
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing required fields: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
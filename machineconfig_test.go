@@ -0,0 +1,44 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMachineTemplatePlaceholders(t *testing.T) {
+	data := func() *MachineConfigData {
+		return &MachineConfigData{VMName: "worker-1", Role: "worker"}
+	}
+	files := `    files:
+        - path: /var/etc/hook.sh
+          permissions: 0o755
+          op: create
+          content: |
+            echo "${HOSTNAME}" ${name} {{ "{json}" }}{{ if eq .Role "worker" }} worker{{ end }}
+            summary: "{{"{{"}} $labels.instance {{"}}"}}" {{ "{{ $value }}" }}
+`
+	withFiles := strings.Replace(testMachineTemplate, "    install:\n", files+"    install:\n", 1)
+	config, err := renderMachineTemplate("test", withFiles, data())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := validateMachineConfig(config, "worker"); err != nil {
+		t.Errorf("rendered config rejected: %v", err)
+	}
+	for _, want := range []string{"hostname: worker-1", "type: worker", `echo "${HOSTNAME}" ${name} {json} worker`,
+		`summary: "{{ $labels.instance }}" {{ $value }}`} {
+		if !strings.Contains(config, want) {
+			t.Errorf("rendered config lacks %q:\n%s", want, config)
+		}
+	}
+
+	prometheus := strings.Replace(withFiles, "{{\"{{\"}} $labels.instance {{\"}}\"}}", "{{ $labels.instance }}", 1)
+	if _, err := renderMachineTemplate("test", prometheus, data()); err == nil || !strings.Contains(err.Error(), "$labels") {
+		t.Errorf("expected unescaped {{ $labels.instance }} to be rejected, got %v", err)
+	}
+
+	typo := strings.Replace(testMachineTemplate, "hostname: {vm_name}", "hostname: {vm_nmae}", 1)
+	if _, err := renderMachineTemplate("test", typo, data()); err == nil || !strings.Contains(err.Error(), "{vm_nmae}") {
+		t.Errorf("expected the misspelled {vm_nmae} to be reported, got %v", err)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"io/ioutil"
 	"log"
 	"math/rand"
+	"net"
 	"net/http"
 	"os"
 	"strconv"
@@ -35,7 +36,7 @@ var (
 	talosMachineConfig        Config
 	config                    Config
 	appConfig                 AppConfig
-	httpClient                *http.Client
+	bulkSlots                 chan struct{}
 )
 
 // Helper function to get environment variable with default value
@@ -68,18 +69,42 @@ func main() {
 	talosMachineTemplate = appConfig.TalosMachineTemplate
 	talosControlPlaneEndpoint = appConfig.TalosControlPlaneEndpoint
 
-	// Initialize HTTP client with SSL verification setting
-	httpClient = &http.Client{
-		Timeout: 10 * time.Second,
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: !appConfig.VerifySSL,
+	// Initialize the Proxmox client with SSL verification setting
+	retryPolicy, err := newRetryPolicy(appConfig.ProxmoxRetryMaxAttempts, appConfig.ProxmoxRetryBaseDelay, appConfig.ProxmoxRetryMaxDelay, appConfig.ProxmoxRetryOn)
+	if err != nil {
+		log.Fatalf("Invalid PROXMOX_RETRY_ON: %s", err)
+	}
+	proxmox = &ProxmoxClient{
+		BaseURL: proxmoxBaseAddr,
+		Token:   proxmoxToken,
+		HTTP: &http.Client{
+			Timeout: 10 * time.Second,
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{
+					InsecureSkipVerify: !appConfig.VerifySSL,
+				},
 			},
 		},
+		Retry: retryPolicy,
 	}
 
 	logger = &Logger{Level: appConfig.LogLevel}
 
+	if appConfig.MaxParallelism < 1 {
+		appConfig.MaxParallelism = 1
+	}
+	bulkSlots = make(chan struct{}, appConfig.MaxParallelism)
+
+	if !isValidTalosApplyMode(appConfig.TalosApplyMode) {
+		logger.Error("Invalid TALOS_APPLY_MODE: %s", appConfig.TalosApplyMode)
+		os.Exit(1)
+	}
+
+	if !isValidPlacement(appConfig.Placement) {
+		logger.Error("Invalid PLACEMENT: %s", appConfig.Placement)
+		os.Exit(1)
+	}
+
 	if err := sentry.Init(sentry.ClientOptions{Dsn: appConfig.SentryDSN}); err != nil {
 		logger.Error("sentry.Init: %s", err)
 		os.Exit(1)
@@ -96,15 +121,92 @@ func main() {
 		os.Exit(1)
 	}
 
+	if appConfig.ProxmoxFake {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			logger.Error("Failed to start fake Proxmox API: %s", err)
+			os.Exit(1)
+		}
+		fake := newFakeProxmoxFromConfig(config)
+		fake.GuestIP = appConfig.ProxmoxFakeGuestIP
+		go http.Serve(listener, fake)
+		proxmox.BaseURL = "http://" + listener.Addr().String() + "/api2/json"
+		logger.Info("Using fake Proxmox API on %s", listener.Addr().String())
+	}
+
+	if err := initKubeClient(); err != nil {
+		logger.Error("Failed to configure Kubernetes API: %s", err)
+		os.Exit(1)
+	}
+	if err := initTalosClient(); err != nil {
+		logger.Error("Failed to configure Talos client: %s", err)
+		os.Exit(1)
+	}
+
 	// Set the global talosMachineConfig to the loaded config
 	talosMachineConfig = config
 
+	if err := validateMachineTemplates(); err != nil {
+		logger.Error("Invalid Talos machine config: %s", err)
+		os.Exit(1)
+	}
+
+	inventory, err = openInventory(appConfig.InventoryPath)
+	if err != nil {
+		logger.Error("Failed to open inventory %s: %s", appConfig.InventoryPath, err)
+		os.Exit(1)
+	}
+
+	idempotency, err = openIdempotencyStore(appConfig.IdempotencyPath)
+	if err != nil {
+		logger.Error("Failed to open idempotency keys %s: %s", appConfig.IdempotencyPath, err)
+		os.Exit(1)
+	}
+
+	if err := initPools(); err != nil {
+		logger.Error("Invalid pools: %s", err)
+		os.Exit(1)
+	}
+
 	initMetrics()
 
 	http.HandleFunc("/health-check", healthCheckHandler)
 	http.Handle("/metrics", promhttp.Handler())
 	http.HandleFunc("/api/v1/create", createVMHandler)
 	http.HandleFunc("/api/v1/delete", deleteVMHandler)
+	http.HandleFunc("/api/v1/jobs/", jobStatusHandler)
+	http.HandleFunc("/api/v1/vms", vmsHandler)
+	http.HandleFunc("/api/v1/vms/", vmsHandler)
+	http.HandleFunc("/api/v1/reconcile", reconcileHandler)
+
+	http.HandleFunc("/api/v1/pools", poolsHandler)
+	http.HandleFunc("/api/v1/pools/", poolsHandler)
+
+	if appConfig.ReconcileInterval > 0 {
+		go runReconciler(appConfig.ReconcileInterval)
+	}
+	if len(pools) > 0 {
+		go runPoolController()
+	}
+	if appConfig.Controller {
+		if !kubeEnabled() {
+			logger.Error("CONTROLLER requires access to the Kubernetes API")
+			os.Exit(1)
+		}
+		go runController()
+	}
+	if appConfig.AutoscalerAddr != "" {
+		if err := validateAutoscalerProviderIDs(); err != nil {
+			logger.Error("Invalid autoscaler setup: %s", err)
+			os.Exit(1)
+		}
+		go func() {
+			if err := runAutoscalerServer(); err != nil {
+				logger.Error("Autoscaler gRPC server error: %s", err)
+				os.Exit(1)
+			}
+		}()
+	}
 
 	serverAddr := fmt.Sprintf("%s:%s", appConfig.ListenAddr, appConfig.ListenPort)
 	logger.Info("Server starting on %s", serverAddr)
@@ -19,10 +19,41 @@ var (
 		Name: "vm_deployer_vm_deleted_total",
 		Help: "Total number of VMs deleted",
 	}, []string{"node"})
+
+	rollbackCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "vm_deployer_rollbacks_total",
+		Help: "Total number of rollbacks of failed VM creations",
+	}, []string{"node", "result"})
+
+	reconcileGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "vm_deployer_reconcile_vms",
+		Help: "Number of VMs found missing, drifted or orphaned by the last reconciliation",
+	}, []string{"state"})
+
+	reconcileTimestamp = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "vm_deployer_reconcile_last_run_timestamp_seconds",
+		Help: "Time the last reconciliation finished",
+	})
+
+	orphanCleanupCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "vm_deployer_orphans_deleted_total",
+		Help: "Total number of orphaned VMs deleted by the reconciler",
+	}, []string{"node"})
+
+	proxmoxRetryCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "vm_deployer_proxmox_retries_total",
+		Help: "Total number of retried Proxmox API calls",
+	}, []string{"method", "class"})
+
+	proxmoxRetriesExhaustedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "vm_deployer_proxmox_retries_exhausted_total",
+		Help: "Total number of Proxmox API calls that still failed after all retries",
+	}, []string{"method", "class"})
 )
 
 func initMetrics() {
-	prometheus.MustRegister(errorCounter, createdCounter, deletedCounter)
+	prometheus.MustRegister(errorCounter, createdCounter, deletedCounter, rollbackCounter,
+		reconcileGauge, reconcileTimestamp, orphanCleanupCounter, proxmoxRetryCounter, proxmoxRetriesExhaustedCounter)
 }
 
 func incErrorCounterHandler(handler string) {
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// coreAllocMu serializes core allocation with writing the VM config, so concurrent
+// pipelines don't read the same free cores before either of them pinned its VM
+var coreAllocMu sync.Mutex
+
+// hostUsage is what existing VMs on a Proxmox node already took
+type hostUsage struct {
+	PinnedCores map[int]bool
+	NumaMemory  map[int]int // MB bound to each host NUMA node via numaN hostnodes
+}
+
+// coreAllocation is the host placement of a VM: one slice per host NUMA node it is bound to,
+// each becoming a guest socket and guest NUMA node
+type coreAllocation struct {
+	Nodes []numaSlice
+}
+
+type numaSlice struct {
+	NumaNode *NumaNode
+	Cores    []int // pinned host cores
+	VCPUs    int
+	Memory   int // MB
+}
+
+// affinity returns all pinned host cores in Proxmox range format
+func (a *coreAllocation) affinity() string {
+	var cores []int
+	for _, slice := range a.Nodes {
+		cores = append(cores, slice.Cores...)
+	}
+	return formatCoreRange(cores)
+}
+
+// guestCPUList formats count guest vCPUs starting at start, e.g. "4-7"
+func guestCPUList(start int, count int) string {
+	if count == 1 {
+		return strconv.Itoa(start)
+	}
+	return fmt.Sprintf("%d-%d", start, start+count-1)
+}
+
+// splitMemory returns the share of memory for slice i of k; the last slice gets the remainder
+func splitMemory(memory int, k int, i int) int {
+	if i == k-1 {
+		return memory - memory/k*(k-1)
+	}
+	return memory / k
+}
+
+// getHostUsage reads affinity and guest NUMA bindings of every VM on the node except excludeVMID
+func getHostUsage(ctx context.Context, node string, excludeVMID int) (*hostUsage, error) {
+	vms, err := listVMs(ctx, node)
+	if err != nil {
+		return nil, err
+	}
+
+	usage := &hostUsage{
+		PinnedCores: map[int]bool{},
+		NumaMemory:  map[int]int{},
+	}
+	for _, vm := range vms {
+		if vm.Template == 1 || vm.VMID == excludeVMID {
+			continue
+		}
+		vmConfig, err := getVMConfig(ctx, node, vm.VMID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get config of VM %d: %w", vm.VMID, err)
+		}
+
+		if affinity, ok := vmConfig["affinity"].(string); ok {
+			for _, core := range parseCoreRange(affinity) {
+				usage.PinnedCores[core] = true
+			}
+		}
+
+		for key, value := range vmConfig {
+			numaValue, ok := value.(string)
+			if !ok || !strings.HasPrefix(key, "numa") || key == "numa" {
+				continue
+			}
+			memory, hostNodes := parseGuestNumaConfig(numaValue)
+			if memory == 0 || len(hostNodes) == 0 {
+				continue
+			}
+			for _, hostNode := range hostNodes {
+				usage.NumaMemory[hostNode] += memory / len(hostNodes)
+			}
+		}
+	}
+	return usage, nil
+}
+
+// parseGuestNumaConfig extracts memory and hostnodes from a "cpus=0-3,memory=8192,hostnodes=0,policy=bind" value
+func parseGuestNumaConfig(value string) (int, []int) {
+	memory := 0
+	var hostNodes []int
+	for _, part := range strings.Split(value, ",") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "memory":
+			memory, _ = strconv.Atoi(kv[1])
+		case "hostnodes":
+			hostNodes = parseCoreRange(strings.ReplaceAll(kv[1], ";", ","))
+		}
+	}
+	return memory, hostNodes
+}
+
+// getVMPinning returns the pinned host cores (affinity) of a VM and the host NUMA nodes
+// it is bound to through its numaN settings
+func getVMPinning(ctx context.Context, node string, vmid int) (string, []int, error) {
+	vmConfig, err := getVMConfig(ctx, node, vmid)
+	if err != nil {
+		return "", nil, err
+	}
+	affinity, _ := vmConfig["affinity"].(string)
+	var hostNodes []int
+	for i := 0; ; i++ {
+		value, ok := vmConfig[fmt.Sprintf("numa%d", i)].(string)
+		if !ok {
+			return affinity, hostNodes, nil
+		}
+		_, nodes := parseGuestNumaConfig(value)
+		hostNodes = append(hostNodes, nodes...)
+	}
+}
+
+// allocateCores picks the host NUMA node with the most free cores (then memory) and pins exactly
+// cores of it, preferring whole physical/HT sibling pairs. If no single NUMA node fits the VM,
+// it is split evenly over the smallest number of NUMA nodes that do. requested restricts the
+// choice to the given NUMA nodes; more than one requested node always spans all of them.
+func allocateCores(ctx context.Context, nodeConfig *NodeConfig, vmid int, requested []NumaNode, cores int, memory int, phyOnly bool, htOnly bool) (*coreAllocation, error) {
+	if htOnly && !nodeConfig.HT {
+		return nil, fmt.Errorf("ht_only requested but hyperthreading is disabled on node %s", nodeConfig.Name)
+	}
+
+	candidates := nodeConfig.NUMA
+	if len(requested) > 0 {
+		candidates = requested
+	}
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("no NUMA nodes defined for node %s", nodeConfig.Name)
+	}
+
+	usage, err := getHostUsage(ctx, nodeConfig.Name, vmid)
+	if err != nil {
+		return nil, err
+	}
+
+	type option struct {
+		numaNode   NumaNode
+		freeCores  int
+		freeMemory int // -1 when the NUMA node has no memory configured
+	}
+	var options []option
+	for _, numaNode := range candidates {
+		freeMemory := -1
+		if numaNode.Memory > 0 {
+			freeMemory = numaNode.Memory - usage.NumaMemory[numaNode.ID]
+		}
+		options = append(options, option{
+			numaNode:   numaNode,
+			freeCores:  len(freeCores(&numaNode, usage.PinnedCores, nodeConfig.HT, phyOnly, htOnly)),
+			freeMemory: freeMemory,
+		})
+	}
+	sort.SliceStable(options, func(i, j int) bool {
+		if options[i].freeCores != options[j].freeCores {
+			return options[i].freeCores > options[j].freeCores
+		}
+		return options[i].freeMemory > options[j].freeMemory
+	})
+
+	fits := func(o option, vcpus int, mem int) string {
+		if o.freeCores < vcpus {
+			return fmt.Sprintf("NUMA %d: %d free cores, need %d", o.numaNode.ID, o.freeCores, vcpus)
+		}
+		if o.freeMemory >= 0 && o.freeMemory < mem {
+			return fmt.Sprintf("NUMA %d: %d MB free memory, need %d MB", o.numaNode.ID, o.freeMemory, mem)
+		}
+		return ""
+	}
+
+	// Try one NUMA node, then spread over 2, 3, ... NUMA nodes with an even share of vCPUs each
+	minSpan, maxSpan := 1, len(options)
+	if len(requested) > 1 {
+		minSpan = len(requested)
+	}
+	var rejections []string
+	for span := minSpan; span <= maxSpan; span++ {
+		if cores%span != 0 {
+			rejections = append(rejections, fmt.Sprintf("%d cores can't be split evenly over %d NUMA nodes", cores, span))
+			continue
+		}
+		vcpus := cores / span
+
+		var chosen []option
+		var reasons []string
+		for _, o := range options {
+			if len(chosen) == span {
+				break
+			}
+			if reason := fits(o, vcpus, splitMemory(memory, span, len(chosen))); reason != "" {
+				reasons = append(reasons, reason)
+				continue
+			}
+			chosen = append(chosen, o)
+		}
+		if len(chosen) < span {
+			rejections = append(rejections, fmt.Sprintf("span %d: %s", span, strings.Join(reasons, ", ")))
+			continue
+		}
+
+		allocation := &coreAllocation{}
+		for i, o := range chosen {
+			numaNode := o.numaNode
+			slice := numaSlice{
+				NumaNode: findNumaNode(nodeConfig, numaNode.ID),
+				Cores:    pickCores(&numaNode, usage.PinnedCores, nodeConfig.HT, phyOnly, htOnly, vcpus),
+				VCPUs:    vcpus,
+				Memory:   splitMemory(memory, span, i),
+			}
+			logger.Info("Selected NUMA node %d of %s (%d free cores): pinning cores %s",
+				numaNode.ID, nodeConfig.Name, o.freeCores, formatCoreRange(slice.Cores))
+			allocation.Nodes = append(allocation.Nodes, slice)
+		}
+		return allocation, nil
+	}
+
+	return nil, fmt.Errorf("NUMA nodes of %s can't fit %d cores and %d MB: %s", nodeConfig.Name, cores, memory, strings.Join(rejections, "; "))
+}
+
+// pinnedAllocation maps explicitly pinned host cores to guest NUMA nodes. Without requested
+// NUMA nodes, the NUMA nodes owning the pinned cores are used.
+func pinnedAllocation(nodeConfig *NodeConfig, requested []NumaNode, pinned []int, cores int, memory int) (*coreAllocation, error) {
+	hostNodes := requested
+	if len(hostNodes) == 0 {
+		seen := map[int]bool{}
+		for _, core := range pinned {
+			numaNode := numaNodeForCores(nodeConfig, []int{core})
+			if numaNode == nil {
+				return nil, fmt.Errorf("core %d doesn't belong to any NUMA node of %s", core, nodeConfig.Name)
+			}
+			if !seen[numaNode.ID] {
+				seen[numaNode.ID] = true
+				hostNodes = append(hostNodes, *numaNode)
+			}
+		}
+		if len(hostNodes) == 0 {
+			return nil, fmt.Errorf("no cores pinned")
+		}
+	}
+
+	if cores%len(hostNodes) != 0 {
+		logger.Info("%d cores can't be split evenly over %d NUMA nodes, binding guest memory to NUMA node %d only",
+			cores, len(hostNodes), hostNodes[0].ID)
+		hostNodes = hostNodes[:1]
+	}
+
+	allocation := &coreAllocation{}
+	span := len(hostNodes)
+	for i, numaNode := range hostNodes {
+		slice := numaSlice{
+			NumaNode: findNumaNode(nodeConfig, numaNode.ID),
+			VCPUs:    cores / span,
+			Memory:   splitMemory(memory, span, i),
+		}
+		if i == 0 {
+			slice.Cores = pinned
+		}
+		allocation.Nodes = append(allocation.Nodes, slice)
+	}
+	return allocation, nil
+}
+
+// findNumaNode returns the NUMA node with id from the node configuration
+func findNumaNode(nodeConfig *NodeConfig, id int) *NumaNode {
+	for i := range nodeConfig.NUMA {
+		if nodeConfig.NUMA[i].ID == id {
+			return &nodeConfig.NUMA[i]
+		}
+	}
+	return nil
+}
+
+// siblingPairs pairs physical cores with their HT siblings by position in the configured ranges
+func siblingPairs(numaNode *NumaNode) [][2]int {
+	phy := parseCoreRange(numaNode.Cores.Phy)
+	ht := parseCoreRange(numaNode.Cores.HT)
+	var pairs [][2]int
+	for i := 0; i < len(phy) && i < len(ht); i++ {
+		pairs = append(pairs, [2]int{phy[i], ht[i]})
+	}
+	return pairs
+}
+
+// freeCores lists unpinned cores of a NUMA node usable under the phy_only/ht_only mode
+func freeCores(numaNode *NumaNode, pinned map[int]bool, hostHT bool, phyOnly bool, htOnly bool) []int {
+	var ranges []string
+	switch {
+	case phyOnly || !hostHT:
+		ranges = []string{numaNode.Cores.Phy}
+	case htOnly:
+		ranges = []string{numaNode.Cores.HT}
+	default:
+		ranges = []string{numaNode.Cores.Phy, numaNode.Cores.HT}
+	}
+
+	var free []int
+	for _, r := range ranges {
+		for _, core := range parseCoreRange(r) {
+			if !pinned[core] {
+				free = append(free, core)
+			}
+		}
+	}
+	return free
+}
+
+// pickCores takes count free cores. When both physical and HT cores are allowed, whole sibling
+// pairs go first so a VM doesn't share physical cores with another VM; lone cores fill the rest.
+func pickCores(numaNode *NumaNode, pinned map[int]bool, hostHT bool, phyOnly bool, htOnly bool, count int) []int {
+	free := freeCores(numaNode, pinned, hostHT, phyOnly, htOnly)
+	if phyOnly || htOnly || !hostHT {
+		selected := append([]int(nil), free[:count]...)
+		sort.Ints(selected)
+		return selected
+	}
+
+	var pairs [][2]int
+	paired := map[int]bool{}
+	for _, pair := range siblingPairs(numaNode) {
+		if !pinned[pair[0]] && !pinned[pair[1]] {
+			pairs = append(pairs, pair)
+			paired[pair[0]] = true
+			paired[pair[1]] = true
+		}
+	}
+	var lone []int
+	for _, core := range free {
+		if !paired[core] {
+			lone = append(lone, core)
+		}
+	}
+
+	var selected []int
+	need := count
+	for len(pairs) > 0 && need >= 2 {
+		selected = append(selected, pairs[0][0], pairs[0][1])
+		pairs = pairs[1:]
+		need -= 2
+	}
+	for len(lone) > 0 && need > 0 {
+		selected = append(selected, lone[0])
+		lone = lone[1:]
+		need--
+	}
+	if need == 1 && len(pairs) > 0 {
+		selected = append(selected, pairs[0][0])
+	}
+
+	sort.Ints(selected)
+	return selected
+}
+
+// numaNodeForCores returns the NUMA node that owns the first of the given cores
+func numaNodeForCores(nodeConfig *NodeConfig, cores []int) *NumaNode {
+	if len(cores) == 0 {
+		return nil
+	}
+	for i, numaNode := range nodeConfig.NUMA {
+		for _, r := range []string{numaNode.Cores.Phy, numaNode.Cores.HT} {
+			for _, core := range parseCoreRange(r) {
+				if core == cores[0] {
+					return &nodeConfig.NUMA[i]
+				}
+			}
+		}
+	}
+	return nil
+}
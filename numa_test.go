@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPickCores(t *testing.T) {
+	numaNode := &NumaNode{ID: 0, Cores: CoreRange{Phy: "0-3", HT: "4-7"}} // siblings 0/4, 1/5, 2/6, 3/7
+	tests := []struct {
+		name    string
+		hostHT  bool
+		phyOnly bool
+		htOnly  bool
+		pinned  []int
+		count   int
+		want    []int
+	}{
+		{name: "whole sibling pairs", hostHT: true, count: 4, want: []int{0, 1, 4, 5}},
+		{name: "odd count takes half a pair", hostHT: true, count: 3, want: []int{0, 1, 4}},
+		{name: "lone core before half a pair", hostHT: true, pinned: []int{1}, count: 3, want: []int{0, 4, 5}},
+		{name: "phy_only", hostHT: true, phyOnly: true, pinned: []int{0}, count: 2, want: []int{1, 2}},
+		{name: "ht_only", hostHT: true, htOnly: true, count: 2, want: []int{4, 5}},
+		{name: "host without HT", count: 2, want: []int{0, 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pinned := map[int]bool{}
+			for _, core := range tt.pinned {
+				pinned[core] = true
+			}
+			if got := pickCores(numaNode, pinned, tt.hostHT, tt.phyOnly, tt.htOnly, tt.count); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got cores %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// numaSliceSummary is the part of a numaSlice the allocation tests compare
+type numaSliceSummary struct {
+	NumaNode int
+	Cores    []int
+	VCPUs    int
+	Memory   int
+}
+
+func summarizeAllocation(allocation *coreAllocation) []numaSliceSummary {
+	var slices []numaSliceSummary
+	for _, slice := range allocation.Nodes {
+		slices = append(slices, numaSliceSummary{slice.NumaNode.ID, slice.Cores, slice.VCPUs, slice.Memory})
+	}
+	return slices
+}
+
+func TestAllocateCores(t *testing.T) {
+	fake := setupTest(t)
+	nodeConfig := &NodeConfig{Name: "pve1", NUMA: []NumaNode{
+		{ID: 0, Cores: CoreRange{Phy: "0-3"}, Memory: 8192},
+		{ID: 1, Cores: CoreRange{Phy: "4-7"}, Memory: 8192},
+	}}
+	// VM 200 takes core 0 and 2 GB of NUMA node 0
+	fake.AddVM(FakeVM{Node: "pve1", VMID: 200, Name: "pinned", Config: map[string]string{
+		"affinity": "0",
+		"numa0":    "cpus=0,memory=2048,hostnodes=0,policy=bind",
+	}})
+
+	tests := []struct {
+		name      string
+		vmid      int
+		requested []NumaNode
+		cores     int
+		memory    int
+		htOnly    bool
+		want      []numaSliceSummary
+		wantErr   string
+	}{
+		{
+			name: "least used NUMA node", cores: 2, memory: 1024,
+			want: []numaSliceSummary{{1, []int{4, 5}, 2, 1024}},
+		},
+		{
+			name: "requested NUMA node", requested: nodeConfig.NUMA[:1], cores: 2, memory: 1024,
+			want: []numaSliceSummary{{0, []int{1, 2}, 2, 1024}},
+		},
+		{
+			name: "split when no NUMA node has enough cores", cores: 6, memory: 3001,
+			want: []numaSliceSummary{{1, []int{4, 5, 6}, 3, 1500}, {0, []int{1, 2, 3}, 3, 1501}},
+		},
+		{
+			name: "split when no NUMA node has enough memory", cores: 2, memory: 9000,
+			want: []numaSliceSummary{{1, []int{4}, 1, 4500}, {0, []int{1}, 1, 4500}},
+		},
+		{
+			name: "cores of the VM itself are free for it", vmid: 200, requested: nodeConfig.NUMA[:1], cores: 4, memory: 8192,
+			want: []numaSliceSummary{{0, []int{0, 1, 2, 3}, 4, 8192}},
+		},
+		{name: "not enough cores", cores: 8, memory: 1024, wantErr: "NUMA 0: 3 free cores, need 4"},
+		{name: "not enough memory", requested: nodeConfig.NUMA[:1], cores: 2, memory: 8192, wantErr: "NUMA 0: 6144 MB free memory"},
+		{name: "uneven split", cores: 5, memory: 1024, wantErr: "5 cores can't be split evenly over 2 NUMA nodes"},
+		{name: "ht_only without HT", cores: 2, memory: 1024, htOnly: true, wantErr: "hyperthreading is disabled"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			allocation, err := allocateCores(context.Background(), nodeConfig, tt.vmid, tt.requested, tt.cores, tt.memory, false, tt.htOnly)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected an error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := summarizeAllocation(allocation); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	// Deleting the VM releases its cores and memory
+	if _, err := deleteVM(context.Background(), "pve1", 200); err != nil {
+		t.Fatal(err)
+	}
+	allocation, err := allocateCores(context.Background(), nodeConfig, 0, nodeConfig.NUMA[:1], 4, 8192, false, false)
+	if err != nil {
+		t.Fatalf("cores of the deleted VM weren't released: %v", err)
+	}
+	if got, want := allocation.affinity(), "0-3"; got != want {
+		t.Errorf("got affinity %s, want %s", got, want)
+	}
+}
+
+func TestPinnedAllocation(t *testing.T) {
+	nodeConfig := &NodeConfig{Name: "pve1", NUMA: []NumaNode{
+		{ID: 0, Cores: CoreRange{Phy: "0-3"}},
+		{ID: 1, Cores: CoreRange{Phy: "4-7"}},
+	}}
+	tests := []struct {
+		name      string
+		requested []NumaNode
+		pinned    []int
+		cores     int
+		want      []numaSliceSummary
+		wantErr   string
+	}{
+		{
+			name: "NUMA node of the pinned cores", pinned: []int{4, 5}, cores: 2,
+			want: []numaSliceSummary{{1, []int{4, 5}, 2, 4096}},
+		},
+		{
+			name: "pinned cores on two NUMA nodes", pinned: []int{0, 1, 4, 5}, cores: 4,
+			want: []numaSliceSummary{{0, []int{0, 1, 4, 5}, 2, 2048}, {1, nil, 2, 2048}},
+		},
+		{
+			name: "uneven split binds the first NUMA node only", pinned: []int{0, 4, 5}, cores: 3,
+			want: []numaSliceSummary{{0, []int{0, 4, 5}, 3, 4096}},
+		},
+		{name: "core outside the NUMA nodes", pinned: []int{8}, cores: 1, wantErr: "core 8 doesn't belong"},
+		{name: "no cores", cores: 1, wantErr: "no cores pinned"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			allocation, err := pinnedAllocation(nodeConfig, tt.requested, tt.pinned, tt.cores, 4096)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected an error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := summarizeAllocation(allocation); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Talos config patches come in two flavours, told apart like talosctl does: a YAML/JSON
+// mapping is a strategic merge patch, a list is a JSON6902 patch (RFC 6902 operations).
+
+// configPatch is a rendered patch and where it came from, for error messages
+type configPatch struct {
+	Source  string
+	Content string
+}
+
+var yamlDocumentSeparator = regexp.MustCompile(`(?m)^---[ \t]*$`)
+
+// resolveConfigFile resolves paths in config.yaml relative to the directory of CONFIG_PATH
+func resolveConfigFile(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(filepath.Dir(appConfig.ConfigPath), path)
+}
+
+// renderConfigPatches renders the patch files of the VM template followed by the request patches
+func renderConfigPatches(vmTemplate VmTemplate, requestPatches []string, data *MachineConfigData) ([]configPatch, error) {
+	var patches []configPatch
+	for _, path := range vmTemplate.Patches {
+		path = resolveConfigFile(path)
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config patch %s: %v", path, err)
+		}
+		rendered, err := renderMachineTemplate(path, string(content), data)
+		if err != nil {
+			return nil, err
+		}
+		patches = append(patches, configPatch{Source: path, Content: rendered})
+	}
+	for i, content := range requestPatches {
+		source := fmt.Sprintf("request patch #%d", i+1)
+		rendered, err := renderMachineTemplate(source, content, data)
+		if err != nil {
+			return nil, err
+		}
+		patches = append(patches, configPatch{Source: source, Content: rendered})
+	}
+	return patches, nil
+}
+
+// parseConfigPatch decodes a patch into a mapping (strategic merge) or a list of operations (JSON6902)
+func parseConfigPatch(content string) (interface{}, error) {
+	var patch interface{}
+	if err := yaml.Unmarshal([]byte(content), &patch); err != nil {
+		return nil, err
+	}
+	patch = normalizeYAML(patch)
+	switch patch.(type) {
+	case map[string]interface{}, []interface{}:
+		return patch, nil
+	}
+	return nil, errors.New("patch must be a YAML mapping (strategic merge) or a list of JSON6902 operations")
+}
+
+// applyConfigPatches applies patches in order to the first document of a machine config.
+// Further documents of a multi-document config are kept as they are. A patched document is
+// re-marshalled through yaml.v2, which drops its comments and sorts its keys.
+func applyConfigPatches(config string, patches []configPatch) (string, error) {
+	if len(patches) == 0 {
+		return config, nil
+	}
+
+	documents := yamlDocumentSeparator.Split(config, -1)
+	first := 0
+	for first < len(documents)-1 && strings.TrimSpace(documents[first]) == "" {
+		first++
+	}
+	var base interface{}
+	if err := yaml.Unmarshal([]byte(documents[first]), &base); err != nil {
+		return "", fmt.Errorf("failed to parse machine config: %v", err)
+	}
+	base = normalizeYAML(base)
+
+	for _, patch := range patches {
+		parsed, err := parseConfigPatch(patch.Content)
+		if err != nil {
+			return "", fmt.Errorf("invalid config patch %s: %v", patch.Source, err)
+		}
+		switch p := parsed.(type) {
+		case map[string]interface{}:
+			base = mergeConfigPatch(base, p)
+		case []interface{}:
+			if base, err = applyJSONPatch(base, p); err != nil {
+				return "", fmt.Errorf("failed to apply config patch %s: %v", patch.Source, err)
+			}
+		}
+	}
+
+	merged, err := yaml.Marshal(base)
+	if err != nil {
+		return "", err
+	}
+	documents = append([]string{string(merged)}, documents[first+1:]...)
+	return strings.Join(documents, "---"), nil // the split kept the newline after each separator
+}
+
+// normalizeYAML converts the map[interface{}]interface{} produced by yaml.v2 into map[string]interface{}
+func normalizeYAML(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			m[fmt.Sprint(key)] = normalizeYAML(item)
+		}
+		return m
+	case []interface{}:
+		for i, item := range v {
+			v[i] = normalizeYAML(item)
+		}
+	}
+	return value
+}
+
+// copyYAML deep copies a normalized YAML value
+func copyYAML(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			m[key] = copyYAML(item)
+		}
+		return m
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for i, item := range v {
+			list[i] = copyYAML(item)
+		}
+		return list
+	}
+	return value
+}
+
+// mergeConfigPatch merges patch into base like Talos strategic merge patches: mappings are merged
+// recursively, lists are appended to (network interfaces are merged by name), scalars are replaced,
+// and a mapping with "$patch: delete" removes the key
+func mergeConfigPatch(base interface{}, patch interface{}) interface{} {
+	switch p := patch.(type) {
+	case map[string]interface{}:
+		baseMap, ok := base.(map[string]interface{})
+		if !ok {
+			baseMap = map[string]interface{}{}
+		}
+		for key, value := range p {
+			if m, ok := value.(map[string]interface{}); ok && m["$patch"] == "delete" {
+				delete(baseMap, key)
+				continue
+			}
+			baseMap[key] = mergeConfigPatch(baseMap[key], value)
+		}
+		return baseMap
+	case []interface{}:
+		baseList, ok := base.([]interface{})
+		if !ok {
+			return p
+		}
+		for _, item := range p {
+			if i := findInterface(baseList, item); i >= 0 {
+				baseList[i] = mergeConfigPatch(baseList[i], item)
+				continue
+			}
+			baseList = append(baseList, item)
+		}
+		return baseList
+	}
+	return patch
+}
+
+// findInterface returns the index of the list entry configuring the same network interface as item, or -1
+func findInterface(list []interface{}, item interface{}) int {
+	m, ok := item.(map[string]interface{})
+	if !ok || m["interface"] == nil {
+		return -1
+	}
+	for i, entry := range list {
+		if e, ok := entry.(map[string]interface{}); ok && e["interface"] == m["interface"] {
+			return i
+		}
+	}
+	return -1
+}
+
+// applyJSONPatch applies RFC 6902 operations to doc
+func applyJSONPatch(doc interface{}, operations []interface{}) (interface{}, error) {
+	for i, raw := range operations {
+		op, ok := raw.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("operation #%d is not a mapping", i+1)
+		}
+		name, _ := op["op"].(string)
+		path, err := parseJSONPointer(op["path"])
+		if err != nil {
+			return nil, fmt.Errorf("operation #%d: %v", i+1, err)
+		}
+
+		switch name {
+		case "add":
+			doc, err = jsonPointerAdd(doc, path, op["value"])
+		case "remove":
+			doc, _, err = jsonPointerRemove(doc, path)
+		case "replace":
+			if doc, _, err = jsonPointerRemove(doc, path); err == nil {
+				doc, err = jsonPointerAdd(doc, path, op["value"])
+			}
+		case "move", "copy":
+			var from []string
+			var value interface{}
+			if from, err = parseJSONPointer(op["from"]); err != nil {
+				break
+			}
+			if name == "move" {
+				doc, value, err = jsonPointerRemove(doc, from)
+			} else if value, err = jsonPointerGet(doc, from); err == nil {
+				value = copyYAML(value) // the copy must not change with the original
+			}
+			if err == nil {
+				doc, err = jsonPointerAdd(doc, path, value)
+			}
+		case "test":
+			var value interface{}
+			if value, err = jsonPointerGet(doc, path); err == nil && !reflect.DeepEqual(value, op["value"]) {
+				err = fmt.Errorf("test failed at %v", op["path"])
+			}
+		default:
+			err = fmt.Errorf("unsupported op %q", name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("operation #%d (%s %v): %v", i+1, name, op["path"], err)
+		}
+	}
+	return doc, nil
+}
+
+func parseJSONPointer(value interface{}) ([]string, error) {
+	pointer, ok := value.(string)
+	if !ok || (pointer != "" && !strings.HasPrefix(pointer, "/")) {
+		return nil, fmt.Errorf("invalid JSON pointer %v", value)
+	}
+	if pointer == "" {
+		return nil, nil
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+func jsonPointerGet(doc interface{}, path []string) (interface{}, error) {
+	for _, token := range path {
+		switch node := doc.(type) {
+		case map[string]interface{}:
+			value, ok := node[token]
+			if !ok {
+				return nil, fmt.Errorf("key %q not found", token)
+			}
+			doc = value
+		case []interface{}:
+			index, err := strconv.Atoi(token)
+			if err != nil || index < 0 || index >= len(node) {
+				return nil, fmt.Errorf("index %q out of range", token)
+			}
+			doc = node[index]
+		default:
+			return nil, fmt.Errorf("can't descend into %q", token)
+		}
+	}
+	return doc, nil
+}
+
+// jsonPointerUpdate replaces the parent of path's last token with the result of fn
+func jsonPointerUpdate(doc interface{}, path []string, fn func(parent interface{}, token string) (interface{}, error)) (interface{}, error) {
+	if len(path) == 1 {
+		return fn(doc, path[0])
+	}
+	child, err := jsonPointerGet(doc, path[:1])
+	if err != nil {
+		return nil, err
+	}
+	child, err = jsonPointerUpdate(child, path[1:], fn)
+	if err != nil {
+		return nil, err
+	}
+	switch node := doc.(type) {
+	case map[string]interface{}:
+		node[path[0]] = child
+	case []interface{}:
+		index, _ := strconv.Atoi(path[0])
+		node[index] = child
+	}
+	return doc, nil
+}
+
+func jsonPointerAdd(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	return jsonPointerUpdate(doc, path, func(parent interface{}, token string) (interface{}, error) {
+		switch node := parent.(type) {
+		case map[string]interface{}:
+			node[token] = value
+			return node, nil
+		case []interface{}:
+			if token == "-" {
+				return append(node, value), nil
+			}
+			index, err := strconv.Atoi(token)
+			if err != nil || index < 0 || index > len(node) {
+				return nil, fmt.Errorf("index %q out of range", token)
+			}
+			node = append(node, nil)
+			copy(node[index+1:], node[index:])
+			node[index] = value
+			return node, nil
+		}
+		return nil, fmt.Errorf("can't add %q to a scalar", token)
+	})
+}
+
+func jsonPointerRemove(doc interface{}, path []string) (interface{}, interface{}, error) {
+	if len(path) == 0 {
+		return nil, doc, nil
+	}
+	var removed interface{}
+	doc, err := jsonPointerUpdate(doc, path, func(parent interface{}, token string) (interface{}, error) {
+		switch node := parent.(type) {
+		case map[string]interface{}:
+			value, ok := node[token]
+			if !ok {
+				return nil, fmt.Errorf("key %q not found", token)
+			}
+			removed = value
+			delete(node, token)
+			return node, nil
+		case []interface{}:
+			index, err := strconv.Atoi(token)
+			if err != nil || index < 0 || index >= len(node) {
+				return nil, fmt.Errorf("index %q out of range", token)
+			}
+			removed = node[index]
+			return append(node[:index], node[index+1:]...), nil
+		}
+		return nil, fmt.Errorf("can't remove %q from a scalar", token)
+	})
+	return doc, removed, err
+}
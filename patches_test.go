@@ -0,0 +1,193 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+// parseTestYAML decodes and normalizes a YAML test value
+func parseTestYAML(t *testing.T, content string) interface{} {
+	t.Helper()
+	var value interface{}
+	if err := yaml.Unmarshal([]byte(content), &value); err != nil {
+		t.Fatalf("invalid test YAML %q: %v", content, err)
+	}
+	return normalizeYAML(value)
+}
+
+func TestParseJSONPointer(t *testing.T) {
+	tests := []struct {
+		pointer interface{}
+		want    []string
+		wantErr bool
+	}{
+		{pointer: "", want: nil},
+		{pointer: "/machine/type", want: []string{"machine", "type"}},
+		{pointer: "/a~1b/c~0d", want: []string{"a/b", "c~d"}},
+		{pointer: "/~01", want: []string{"~1"}}, // ~1 is decoded before ~0
+		{pointer: "/", want: []string{""}},
+		{pointer: "machine", wantErr: true},
+		{pointer: 1, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseJSONPointer(tt.pointer)
+		if (err != nil) != tt.wantErr || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseJSONPointer(%v) = %q, %v; want %q, error %v", tt.pointer, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestApplyJSONPatch(t *testing.T) {
+	base := `
+machine:
+  type: worker
+  certSANs: [a, b]
+  nodeLabels:
+    zone/name: home
+    tilde~key: x
+  kubelet:
+    extraArgs:
+      max-pods: "110"
+`
+	tests := []struct {
+		name    string
+		patch   string
+		want    string // YAML of the patched document
+		wantErr string
+	}{
+		{
+			name:  "add to a mapping",
+			patch: `[{op: add, path: /machine/install, value: {disk: /dev/vda}}]`,
+			want:  `{type: worker, certSANs: [a, b], nodeLabels: {zone/name: home, tilde~key: x}, kubelet: {extraArgs: {max-pods: "110"}}, install: {disk: /dev/vda}}`,
+		},
+		{
+			name:  "append with -",
+			patch: `[{op: add, path: /machine/certSANs/-, value: c}]`,
+			want:  `{type: worker, certSANs: [a, b, c], nodeLabels: {zone/name: home, tilde~key: x}, kubelet: {extraArgs: {max-pods: "110"}}}`,
+		},
+		{
+			name:  "insert at an index",
+			patch: `[{op: add, path: /machine/certSANs/0, value: z}]`,
+			want:  `{type: worker, certSANs: [z, a, b], nodeLabels: {zone/name: home, tilde~key: x}, kubelet: {extraArgs: {max-pods: "110"}}}`,
+		},
+		{
+			name:  "escaped keys",
+			patch: `[{op: replace, path: /machine/nodeLabels/zone~1name, value: work}, {op: remove, path: /machine/nodeLabels/tilde~0key}]`,
+			want:  `{type: worker, certSANs: [a, b], nodeLabels: {zone/name: work}, kubelet: {extraArgs: {max-pods: "110"}}}`,
+		},
+		{
+			name:  "remove from a list",
+			patch: `[{op: remove, path: /machine/certSANs/0}]`,
+			want:  `{type: worker, certSANs: [b], nodeLabels: {zone/name: home, tilde~key: x}, kubelet: {extraArgs: {max-pods: "110"}}}`,
+		},
+		{
+			name:  "move",
+			patch: `[{op: move, from: /machine/kubelet/extraArgs, path: /machine/extraArgs}]`,
+			want:  `{type: worker, certSANs: [a, b], nodeLabels: {zone/name: home, tilde~key: x}, kubelet: {}, extraArgs: {max-pods: "110"}}`,
+		},
+		{
+			name:  "copy is independent of its source",
+			patch: `[{op: copy, from: /machine/kubelet, path: /machine/copied}, {op: add, path: /machine/copied/extraArgs/rotate, value: "true"}]`,
+			want:  `{type: worker, certSANs: [a, b], nodeLabels: {zone/name: home, tilde~key: x}, kubelet: {extraArgs: {max-pods: "110"}}, copied: {extraArgs: {max-pods: "110", rotate: "true"}}}`,
+		},
+		{
+			name:  "test a nested value",
+			patch: `[{op: test, path: /machine/kubelet, value: {extraArgs: {max-pods: "110"}}}, {op: test, path: /machine/certSANs, value: [a, b]}]`,
+			want:  `{type: worker, certSANs: [a, b], nodeLabels: {zone/name: home, tilde~key: x}, kubelet: {extraArgs: {max-pods: "110"}}}`,
+		},
+		{name: "failed test", patch: `[{op: test, path: /machine/certSANs, value: [b, a]}]`, wantErr: "test failed"},
+		{name: "remove a missing key", patch: `[{op: remove, path: /machine/install}]`, wantErr: `key "install" not found`},
+		{name: "replace a missing key", patch: `[{op: replace, path: /machine/install/disk, value: x}]`, wantErr: `key "install" not found`},
+		{name: "remove with -", patch: `[{op: remove, path: /machine/certSANs/-}]`, wantErr: "out of range"},
+		{name: "add past the end", patch: `[{op: add, path: /machine/certSANs/3, value: c}]`, wantErr: "out of range"},
+		{name: "add below a scalar", patch: `[{op: add, path: /machine/type/x, value: c}]`, wantErr: "scalar"},
+		{name: "unknown op", patch: `[{op: merge, path: /machine}]`, wantErr: "unsupported op"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc, err := applyJSONPatch(parseTestYAML(t, base), parseTestYAML(t, tt.patch).([]interface{}))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected an error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := parseTestYAML(t, tt.want); !reflect.DeepEqual(doc.(map[string]interface{})["machine"], want) {
+				t.Errorf("got %v, want %v", doc, want)
+			}
+		})
+	}
+}
+
+func TestMergeConfigPatch(t *testing.T) {
+	base := `
+machine:
+  type: worker
+  certSANs: [a]
+  nodeLabels: {zone: home, old: x}
+  network:
+    interfaces:
+      - interface: eth0
+        dhcp: true
+        mtu: 1500
+`
+	tests := []struct {
+		name  string
+		patch string
+		want  string // YAML of the patched machine section
+	}{
+		{
+			name:  "scalars are replaced and mappings merged",
+			patch: `{machine: {type: controlplane, nodeLabels: {rack: r1}}}`,
+			want:  `{type: controlplane, certSANs: [a], nodeLabels: {zone: home, old: x, rack: r1}, network: {interfaces: [{interface: eth0, dhcp: true, mtu: 1500}]}}`,
+		},
+		{
+			name:  "lists are appended to",
+			patch: `{machine: {certSANs: [b]}}`,
+			want:  `{type: worker, certSANs: [a, b], nodeLabels: {zone: home, old: x}, network: {interfaces: [{interface: eth0, dhcp: true, mtu: 1500}]}}`,
+		},
+		{
+			name:  "network interfaces are merged by name",
+			patch: `{machine: {network: {interfaces: [{interface: eth0, mtu: 9000}, {interface: eth1, dhcp: false}]}}}`,
+			want:  `{type: worker, certSANs: [a], nodeLabels: {zone: home, old: x}, network: {interfaces: [{interface: eth0, dhcp: true, mtu: 9000}, {interface: eth1, dhcp: false}]}}`,
+		},
+		{
+			name:  "$patch: delete removes a key",
+			patch: `{machine: {nodeLabels: {old: {$patch: delete}}}}`,
+			want:  `{type: worker, certSANs: [a], nodeLabels: {zone: home}, network: {interfaces: [{interface: eth0, dhcp: true, mtu: 1500}]}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc := mergeConfigPatch(parseTestYAML(t, base), parseTestYAML(t, tt.patch))
+			if want := parseTestYAML(t, tt.want); !reflect.DeepEqual(doc.(map[string]interface{})["machine"], want) {
+				t.Errorf("got %v, want %v", doc, want)
+			}
+		})
+	}
+}
+
+func TestApplyConfigPatches(t *testing.T) {
+	config := "version: v1alpha1\nmachine:\n  type: worker\n---\nkind: HostnameConfig\nhostname: a\n"
+	patched, err := applyConfigPatches(config, []configPatch{
+		{Source: "merge", Content: "machine:\n  type: controlplane\n"},
+		{Source: "json6902", Content: "- op: add\n  path: /cluster\n  value: {id: x}\n"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "cluster:\n  id: x\nmachine:\n  type: controlplane\nversion: v1alpha1\n---\nkind: HostnameConfig\nhostname: a\n"
+	if patched != want {
+		t.Errorf("got %q, want %q", patched, want)
+	}
+
+	if _, err := applyConfigPatches(config, []configPatch{{Source: "bad", Content: "just a string"}}); err == nil || !strings.Contains(err.Error(), "bad") {
+		t.Errorf("expected an error naming the patch, got %v", err)
+	}
+}
@@ -0,0 +1,586 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var nextIDMu sync.Mutex
+
+// createParams holds everything needed to create a VM, resolved from the request
+// before any Proxmox call is made so the pipeline can outlive the HTTP request.
+type createParams struct {
+	BaseTemplateName string
+	BaseTemplateID   int // resolved for Node by placeVMs
+	VmTemplate       VmTemplate
+	RequestedNode    string
+	Placement        string
+	Node             NodeConfig // set by placeVMs
+	Name             string
+	NUMA             string
+	PhyCores         string
+	HTCores          string
+	PhyOnly          bool
+	HTOnly           bool
+	Reset            bool
+	OnFailure        string            // keep or destroy
+	ApplyMode        string            // Talos apply mode: auto, reboot, no-reboot or staged
+	WaitReady        bool              // wait for the Kubernetes node to become Ready
+	Vars             map[string]string // extra machine config template variables (var_<name>)
+	Patches          []string          // request-level Talos config patches, applied after the VM template ones
+	Requestor        string            // X-Requestor header or client address, recorded in the inventory
+	Pool             string            // node pool the VM is created for
+	NamePrefix       string            // prefix of generated names instead of the vm_template name
+}
+
+// stepError is returned by the pipeline; Message is safe to show to the API client
+type stepError struct {
+	Step    string
+	Message string
+	Err     error
+}
+
+func (e *stepError) Error() string {
+	return e.Message + ": " + e.Err.Error()
+}
+
+func (e *stepError) Unwrap() error {
+	return e.Err
+}
+
+// requestError is a validation error with the HTTP status to respond with
+type requestError struct {
+	Status  int
+	Message string
+}
+
+func (e *requestError) Error() string {
+	return e.Message
+}
+
+// parseCreateParams validates user input and resolves templates; call placeVMs to pick nodes
+func parseCreateParams(r *http.Request) (*createParams, error) {
+	p, err := createParamsFromForm(r.Form)
+	if err != nil {
+		return nil, err
+	}
+	p.Requestor = requestor(r)
+	return p, nil
+}
+
+// createParamsFromForm validates create parameters given as form values (or built from a TalosProxmoxMachine)
+func createParamsFromForm(form url.Values) (*createParams, error) {
+	baseTemplateName := form.Get("base_template")
+	vmTemplateName := form.Get("vm_template")
+	nodeName := form.Get("node")
+
+	if baseTemplateName == "" || vmTemplateName == "" {
+		return nil, &requestError{http.StatusBadRequest, "base_template and vm_template are required"}
+	}
+
+	// 1. Placement strategy, nodes are picked later by placeVMs
+	placement := form.Get("placement")
+	if placement == "" {
+		placement = appConfig.Placement
+	}
+	if !isValidPlacement(placement) {
+		return nil, &requestError{http.StatusBadRequest, "Invalid placement: " + placement + ". Must be pack, spread or weighted-per-vm"}
+	}
+
+	// 2. Chosen template validation
+	var vmTemplateConfig VmTemplate
+	found := false
+	for _, t := range config.VmTemplates {
+		if t.Name == vmTemplateName {
+			vmTemplateConfig = t
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, &requestError{http.StatusBadRequest, "Invalid vm_template: " + vmTemplateName}
+	}
+
+	// 3. CPU pinning options
+	phyOnly := form.Get("phy_only") == "1"
+	htOnly := form.Get("ht_only") == "1"
+	if phyOnly && htOnly {
+		return nil, &requestError{http.StatusBadRequest, "Both phy_only and ht_only cannot be set at the same time"}
+	}
+
+	onFailure := form.Get("on_failure")
+	if onFailure == "" {
+		onFailure = appConfig.OnFailure
+	}
+	if onFailure != OnFailureKeep && onFailure != OnFailureDestroy {
+		return nil, &requestError{http.StatusBadRequest, "Invalid on_failure: " + onFailure + ". Must be keep or destroy"}
+	}
+
+	applyMode := form.Get("apply_mode")
+	if applyMode == "" {
+		applyMode = appConfig.TalosApplyMode
+	}
+	if !isValidTalosApplyMode(applyMode) {
+		return nil, &requestError{http.StatusBadRequest, "Invalid apply_mode: " + applyMode + ". Must be auto, reboot, no-reboot or staged"}
+	}
+
+	waitReady := appConfig.WaitForReady
+	if waitReadyStr := form.Get("wait_ready"); waitReadyStr != "" {
+		waitReady = waitReadyStr == "1"
+	}
+	if waitReady && !kubeEnabled() {
+		return nil, &requestError{http.StatusBadRequest, "wait_ready requires access to the Kubernetes API"}
+	}
+	if waitReady && applyMode == "staged" {
+		return nil, &requestError{http.StatusBadRequest, "wait_ready can't be used with apply_mode=staged"}
+	}
+
+	vars := map[string]string{}
+	for key := range form {
+		if name := strings.TrimPrefix(key, "var_"); name != key && name != "" {
+			vars[name] = form.Get(key)
+		}
+	}
+
+	patches := form["patch"]
+	for i, patch := range patches {
+		if _, err := parseMachineTemplate(patch); err != nil {
+			return nil, &requestError{http.StatusBadRequest, fmt.Sprintf("Invalid patch #%d: %s", i+1, err.Error())}
+		}
+	}
+
+	return &createParams{
+		BaseTemplateName: baseTemplateName,
+		VmTemplate:       vmTemplateConfig,
+		RequestedNode:    nodeName,
+		Placement:        placement,
+		Name:             form.Get("name"),
+		NUMA:             form.Get("numa"),
+		PhyCores:         form.Get("phy"),
+		HTCores:          form.Get("ht"),
+		PhyOnly:          phyOnly,
+		HTOnly:           htOnly,
+		Reset:            form.Get("reset") == "1",
+		OnFailure:        onFailure,
+		ApplyMode:        applyMode,
+		WaitReady:        waitReady,
+		Vars:             vars,
+		Patches:          patches,
+	}, nil
+}
+
+// checkMachineConfigs previews the machine config of placed VMs, once per Proxmox node, so
+// template and patch errors are rejected before anything is cloned
+func checkMachineConfigs(placed []*createParams) error {
+	checked := map[string]bool{}
+	for _, p := range placed {
+		if checked[p.Node.Name] {
+			continue
+		}
+		checked[p.Node.Name] = true
+		if err := previewMachineConfig(p); err != nil {
+			msg := fmt.Sprintf("Invalid Talos config for vm_template %s: %s", p.VmTemplate.Name, err.Error())
+			return &requestError{http.StatusBadRequest, msg}
+		}
+	}
+	return nil
+}
+
+// runCreatePipeline runs clone -> configure -> resize -> start -> IP discovery -> Talos apply,
+// reporting every step to the job. The returned result is filled as far as the pipeline got.
+// The pipeline stops when ctx is done or the job is canceled; the VM is then rolled back
+// like on any other failure.
+func runCreatePipeline(ctx context.Context, p *createParams, job *Job) (*VMResult, error) {
+	handlerName := "/api/v1/create"
+	ctx, cancel := job.start(ctx)
+	defer cancel()
+	startTime := time.Now()
+	nodeName := p.Node.Name
+	result := &VMResult{
+		Node:  nodeName,
+		Name:  p.Name,
+		Role:  p.VmTemplate.Role,
+		Reset: p.Reset,
+		JobID: job.ID,
+	}
+
+	cloned := false
+	started := false
+	// A task interrupted by ctx keeps running on Proxmox and holds the VM lock;
+	// the rollback waits for it
+	var pendingTask string
+	track := func(ctx context.Context, upid string) error {
+		var onLog func([]string)
+		if appConfig.TaskLogStream {
+			onLog = job.addStepLog
+		}
+		err := trackTaskLog(ctx, nodeName, upid, onLog)
+		if err != nil && ctx.Err() != nil {
+			pendingTask = upid
+		}
+		return err
+	}
+	fail := func(step, msg string, err error) (*VMResult, error) {
+		if errors.Is(err, context.Canceled) {
+			logger.Info("%s: job %s canceled: %s", msg, job.ID, err.Error())
+		} else {
+			logger.Error("%s: %s", msg, err.Error())
+			reportError(err)
+			incErrorCounterHandler(handlerName)
+		}
+		stepErr := &stepError{Step: step, Message: msg, Err: err}
+		result.Error = stepErr.Error()
+		var taskErr *ProxmoxTaskError
+		if errors.As(err, &taskErr) && !appConfig.TaskLogStream {
+			job.addStepLog(taskErr.Log)
+		}
+		job.endStep(stepErr)
+		if cloned || pendingTask != "" {
+			result.Rollback = handleFailedVM(p, job, result, started, pendingTask)
+		}
+		job.finish(result, stepErr)
+		return result, stepErr
+	}
+
+	// 1. Get "next-id" for VM. Proxmox hands out the same id until a clone claims it,
+	// so id allocation and the clone call are serialized across concurrent pipelines.
+	job.beginStep(StepCloning)
+	cloneCtx, cancelClone := context.WithTimeout(ctx, appConfig.CloneTimeout)
+	defer cancelClone()
+	nextIDMu.Lock()
+	vmid, err := getNextID(cloneCtx)
+	if err != nil {
+		nextIDMu.Unlock()
+		return fail(StepCloning, "Failed to get VM id", err)
+	}
+	result.ID = vmid
+
+	// 2. Set VM name
+	if result.Name == "" {
+		randomSuffix := generateRandomString(6)
+		prefix := p.VmTemplate.Name
+		if p.NamePrefix != "" {
+			prefix = p.NamePrefix
+		}
+		result.Name = fmt.Sprintf("%s-%s-%d-%s", prefix, p.Node.Suffix, vmid, randomSuffix)
+	}
+	vmName := result.Name
+
+	logger.Info("Starting VM creation: job=%s, node=%s, base_template=%s, vm_template=%s, vm_name=%s",
+		job.ID, nodeName, p.BaseTemplateName, p.VmTemplate.Name, vmName)
+
+	// 3. Call & validate vm cloning
+	cloneTask, err := cloneVM(cloneCtx, nodeName, p.BaseTemplateID, vmid, vmName)
+	nextIDMu.Unlock()
+	if err != nil {
+		return fail(StepCloning, "Failed to clone VM", err)
+	}
+	job.setVM(nodeName, vmid)
+	if err = track(cloneCtx, cloneTask); err != nil {
+		return fail(StepCloning, "Clone task failed", err)
+	}
+	cloned = true
+
+	// 4. Configure CPU & memory for cloned VM
+	job.beginStep(StepConfiguring)
+	coreAllocMu.Lock()
+	configTask, err := configureVM(ctx, nodeName, vmid, p.VmTemplate.CPU, p.VmTemplate.Memory, p.VmTemplate.CPUModel, p.NUMA, p.PhyCores, p.HTCores, p.PhyOnly, p.HTOnly, &p.Node)
+	if err != nil {
+		coreAllocMu.Unlock()
+		return fail(StepConfiguring, "Failed to configure VM", err)
+	}
+	err = track(ctx, configTask)
+	coreAllocMu.Unlock()
+	if err != nil {
+		return fail(StepConfiguring, "Configuration task failed", err)
+	}
+
+	// 5. Configure disk size
+	job.beginStep(StepResizing)
+	resizeTask, err := resizeDisk(ctx, nodeName, vmid, p.VmTemplate.Disk)
+	if err != nil {
+		return fail(StepResizing, "Failed to resize disk", err)
+	}
+	if resizeTask != "" {
+		if err = track(ctx, resizeTask); err != nil {
+			return fail(StepResizing, "Resize disk task failed", err)
+		}
+	}
+
+	// 6. Start VM
+	job.beginStep(StepStarting)
+	startCtx, cancelStart := context.WithTimeout(ctx, appConfig.StartTimeout)
+	defer cancelStart()
+	startTask, err := startVM(startCtx, nodeName, vmid)
+	if err != nil {
+		return fail(StepStarting, "Failed to start VM", err)
+	}
+	started = true
+	if err = track(startCtx, startTask); err != nil {
+		return fail(StepStarting, "Start VM task failed", err)
+	}
+
+	// 7. Check if reset is requested (to fix kernel panic on first run)
+	if p.Reset {
+		job.beginStep(StepResetting)
+		logger.Info("Reset requested for VM: id=%d, node=%s, name=%s", vmid, nodeName, vmName)
+		// Sleep for 3 seconds before resetting to allow VM to boot
+		if err := sleepContext(ctx, 3*time.Second); err != nil {
+			return fail(StepResetting, "Failed to reset VM", err)
+		}
+
+		// Reset the VM
+		resetCtx, cancelReset := context.WithTimeout(ctx, appConfig.StartTimeout)
+		defer cancelReset()
+		resetTask, err := resetVM(resetCtx, nodeName, vmid)
+		if err != nil {
+			return fail(StepResetting, "Failed to reset VM", err)
+		}
+		if err = track(resetCtx, resetTask); err != nil {
+			return fail(StepResetting, "Reset VM task failed", err)
+		}
+		logger.Info("VM reset successful: id=%d, node=%s, name=%s", vmid, nodeName, vmName)
+	}
+
+	// 8. Get VM IP address for Talos registration
+	job.beginStep(StepWaitingIP)
+	logger.Info("Getting VM IP address for Talos registration...")
+	vmIP, err := getVMIPAddress(ctx, nodeName, vmid)
+	if err != nil {
+		return fail(StepWaitingIP, "Failed to get VM IP address", err)
+	}
+	result.IP = vmIP
+	logger.Info("VM IP address obtained: %s", vmIP)
+
+	// 9. Generate Talos configuration
+	job.beginStep(StepApplyingConfig)
+	logger.Info("Generating Talos configuration...")
+	affinity, hostNuma, err := getVMPinning(ctx, nodeName, vmid)
+	if err != nil {
+		logger.Error("Failed to read NUMA nodes of VM %d: %s", vmid, err.Error())
+	}
+	configData := &MachineConfigData{
+		VMName:               vmName,
+		VMID:                 vmid,
+		ProviderID:           providerID(nodeName, vmid),
+		VMIP:                 vmIP,
+		Role:                 p.VmTemplate.Role,
+		Node:                 nodeName,
+		Suffix:               p.Node.Suffix,
+		VmTemplate:           p.VmTemplate,
+		NUMA:                 hostNuma,
+		ControlPlaneEndpoint: talosControlPlaneEndpoint,
+		Vars:                 p.Vars,
+	}
+	talosConfig, err := buildMachineConfig(p.VmTemplate, p.Patches, configData)
+	if err != nil {
+		return fail(StepApplyingConfig, "Failed to generate Talos config", err)
+	}
+
+	// 10. Wait for Talos node to be ready
+	logger.Info("Waiting for Talos node to be ready...")
+	if err := waitForTalosNode(ctx, vmIP); err != nil {
+		return fail(StepApplyingConfig, "Talos node not ready", err)
+	}
+
+	// 11. Register node with Talos cluster
+	logger.Info("Registering node with Talos cluster...")
+	applyResult, err := registerTalosNode(ctx, vmIP, talosConfig, p.ApplyMode)
+	if err != nil {
+		return fail(StepApplyingConfig, "Failed to register Talos node", err)
+	}
+	result.TalosApply = applyResult
+
+	// 12. Optionally wait until the node joined the cluster
+	if p.WaitReady {
+		job.beginStep(StepWaitingReady)
+		logger.Info("Waiting for node %s to join the cluster (timeout %v)...", vmName, appConfig.ReadyTimeout)
+		if err := waitForNodeReady(ctx, vmIP, vmName, appConfig.ReadyTimeout, job); err != nil {
+			return fail(StepWaitingReady, "Node did not join the cluster", err)
+		}
+	}
+
+	// 13. Log success with timing
+	totalDuration := time.Since(startTime)
+	result.DurationSeconds = totalDuration.Seconds()
+	logger.Info("Talos VM creation and registration successful: id=%d, node=%s, name=%s, ip=%s, role=%s, duration=%v",
+		vmid, nodeName, vmName, vmIP, p.VmTemplate.Role, totalDuration)
+	createdCounter.With(prometheus.Labels{
+		"node":          nodeName,
+		"base_template": p.BaseTemplateName,
+		"vm_template":   p.VmTemplate.Name,
+	}).Inc()
+
+	if err := inventory.put(InventoryVM{
+		VMID:         vmid,
+		Node:         nodeName,
+		Name:         vmName,
+		IP:           vmIP,
+		Role:         p.VmTemplate.Role,
+		BaseTemplate: p.BaseTemplateName,
+		VmTemplate:   p.VmTemplate.Name,
+		Affinity:     affinity,
+		NUMA:         hostNuma,
+		CreatedAt:    time.Now().UTC(),
+		Requestor:    p.Requestor,
+		Pool:         p.Pool,
+		JobID:        job.ID,
+	}); err != nil {
+		logger.Error("Failed to record VM %s in inventory: %s", vmName, err.Error())
+		reportError(err)
+	}
+
+	job.finish(result, nil)
+	return result, nil
+}
+
+// handleFailedVM applies the on_failure policy to a VM whose creation failed after cloning.
+// Kept VMs are recorded in the inventory, so the reconciler doesn't delete them as orphans.
+// The rollback gets its own context, as the pipeline's may be what stopped it.
+func handleFailedVM(p *createParams, job *Job, result *VMResult, started bool, pendingTask string) *RollbackResult {
+	nodeName, vmid := p.Node.Name, result.ID
+	if p.OnFailure == OnFailureKeep {
+		logger.Info("Keeping failed VM for debugging: id=%d, node=%s", vmid, nodeName)
+		if err := inventory.put(InventoryVM{
+			VMID:         vmid,
+			Node:         nodeName,
+			Name:         result.Name,
+			IP:           result.IP,
+			Role:         p.VmTemplate.Role,
+			BaseTemplate: p.BaseTemplateName,
+			VmTemplate:   p.VmTemplate.Name,
+			CreatedAt:    time.Now().UTC(),
+			Requestor:    p.Requestor,
+			Pool:         p.Pool,
+			JobID:        job.ID,
+			State:        InventoryKept,
+		}); err != nil {
+			logger.Error("Failed to record kept VM %s in inventory: %s", result.Name, err.Error())
+			reportError(err)
+		}
+		return &RollbackResult{Action: RollbackKept}
+	}
+
+	job.beginStep(StepRollingBack)
+	logger.Info("Rolling back failed VM: id=%d, node=%s", vmid, nodeName)
+	ctx, cancel := context.WithTimeout(context.Background(), appConfig.RollbackTimeout)
+	defer cancel()
+	err := rollbackVM(ctx, nodeName, vmid, started, pendingTask)
+	job.endStep(err)
+	if err != nil {
+		logger.Error("Rollback of VM %d on node %s failed: %s", vmid, nodeName, err.Error())
+		reportError(err)
+		rollbackCounter.With(prometheus.Labels{"node": nodeName, "result": RollbackFailed}).Inc()
+		return &RollbackResult{Action: RollbackFailed, Error: err.Error()}
+	}
+
+	logger.Info("Rollback successful: id=%d, node=%s", vmid, nodeName)
+	rollbackCounter.With(prometheus.Labels{"node": nodeName, "result": RollbackDestroyed}).Inc()
+	return &RollbackResult{Action: RollbackDestroyed}
+}
+
+// rollbackVM stops (when it was started) and destroys a half-created VM, after waiting for
+// pendingTask (if any) to release the VM
+func rollbackVM(ctx context.Context, node string, vmid int, started bool, pendingTask string) error {
+	if pendingTask != "" {
+		if err := trackTask(ctx, node, pendingTask); err != nil && ctx.Err() != nil {
+			return fmt.Errorf("interrupted task did not end: %w", err)
+		}
+	}
+
+	if started {
+		stopTask, err := stopVM(ctx, node, vmid, "stop")
+		if errors.Is(err, errProxmoxNotFound) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to stop VM: %w", err)
+		}
+		if stopTask != "" {
+			if err := trackTask(ctx, node, stopTask); err != nil {
+				return fmt.Errorf("stop VM task failed: %w", err)
+			}
+		}
+	}
+
+	deleteTask, err := deleteVM(ctx, node, vmid)
+	if errors.Is(err, errProxmoxNotFound) {
+		// An interrupted clone may not have created the VM
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete VM: %w", err)
+	}
+	if deleteTask != "" {
+		if err := trackTask(ctx, node, deleteTask); err != nil {
+			return fmt.Errorf("delete VM task failed: %w", err)
+		}
+	}
+	return nil
+}
+
+// respondPipelineError writes a failed creation as JSON so the client sees what happened to the VM
+func respondPipelineError(w http.ResponseWriter, result *VMResult, err error) {
+	respData := map[string]interface{}{
+		"error": err.Error(),
+	}
+	var stepErr *stepError
+	if errors.As(err, &stepErr) {
+		respData["error"] = stepErr.Message
+		respData["step"] = stepErr.Step
+		respData["details"] = stepErr.Err.Error()
+	}
+	var readyErr *nodeReadyError
+	if errors.As(err, &readyErr) {
+		respData["stalled_at"] = readyErr.Stage
+	}
+	var talosErr *TalosAPIError
+	if errors.As(err, &talosErr) {
+		respData["talos_error"] = map[string]string{
+			"code":    talosErr.Code,
+			"message": talosErr.Message,
+		}
+	}
+	if details := proxmoxErrorDetails(err); details != nil {
+		respData["proxmox_error"] = details
+	}
+	if details := proxmoxTaskDetails(err); details != nil {
+		respData["proxmox_task"] = details
+	}
+	if result != nil {
+		if result.ID != 0 {
+			respData["vm_id"] = result.ID
+		}
+		respData["node"] = result.Node
+		respData["name"] = result.Name
+		respData["job_id"] = result.JobID
+		if result.Rollback != nil {
+			respData["rollback"] = result.Rollback
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusInternalServerError)
+	json.NewEncoder(w).Encode(respData)
+}
+
+// respondRequestError writes a validation error returned by parseCreateParams
+func respondRequestError(w http.ResponseWriter, handlerName string, err error) {
+	status := http.StatusBadRequest
+	var reqErr *requestError
+	if errors.As(err, &reqErr) {
+		status = reqErr.Status
+	}
+	logger.Error(err.Error())
+	reportError(err)
+	incErrorCounterHandler(handlerName)
+	http.Error(w, err.Error(), status)
+}
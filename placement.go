@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Placement strategies for distributing VMs across Proxmox nodes
+const (
+	PlacementPack          = "pack"            // all VMs of a request on one weighted-random node
+	PlacementSpread        = "spread"          // fewest VMs of the request first, heaviest nodes on ties
+	PlacementWeightedPerVM = "weighted-per-vm" // weighted-random node picked for every VM
+)
+
+func isValidPlacement(strategy string) bool {
+	switch strategy {
+	case PlacementPack, PlacementSpread, PlacementWeightedPerVM:
+		return true
+	}
+	return false
+}
+
+// placementCandidates returns the nodes that can host a clone of baseTemplateName
+// and a "node: reason" line for every node that can't
+func placementCandidates(nodes []NodeConfig, baseTemplateName string) ([]NodeConfig, []string) {
+	var candidates []NodeConfig
+	var rejections []string
+	for _, node := range nodes {
+		if node.Weight <= 0 {
+			rejections = append(rejections, node.Name+": weight is 0")
+			continue
+		}
+		if findBaseTemplateID(&node, baseTemplateName) == 0 {
+			rejections = append(rejections, node.Name+": no base_template "+baseTemplateName)
+			continue
+		}
+		candidates = append(candidates, node)
+	}
+	return candidates, rejections
+}
+
+// findBaseTemplateID returns the template VM id of baseTemplateName on node, or 0 if the node doesn't have it
+func findBaseTemplateID(node *NodeConfig, baseTemplateName string) int {
+	for _, t := range node.BaseTemplates {
+		if t.Name == baseTemplateName {
+			return t.ID
+		}
+	}
+	return 0
+}
+
+// placeVMs picks a node for each of count VMs and returns per-VM params.
+// An explicitly requested node always wins over the placement strategy.
+// With CAPACITY_CHECK enabled, nodes that can't fit the VM template are skipped.
+func placeVMs(ctx context.Context, p *createParams, count int) ([]*createParams, error) {
+	var candidates []NodeConfig
+	var rejections []string
+	if p.RequestedNode != "" {
+		node := getNodeConfigByName(p.RequestedNode)
+		if node == nil {
+			return nil, &requestError{http.StatusBadRequest, "Invalid node: " + p.RequestedNode}
+		}
+		if findBaseTemplateID(node, p.BaseTemplateName) == 0 {
+			return nil, &requestError{http.StatusBadRequest, fmt.Sprintf("Invalid base_template: %s for node: %s", p.BaseTemplateName, node.Name)}
+		}
+		candidates = []NodeConfig{*node}
+	} else {
+		candidates, rejections = placementCandidates(config.Nodes, p.BaseTemplateName)
+		if len(candidates) == 0 {
+			return nil, &requestError{http.StatusBadRequest, "No nodes available for selection with base_template: " + p.BaseTemplateName}
+		}
+	}
+
+	// Live capacity of every candidate, reduced as VMs are placed
+	capacities := map[string]*nodeCapacity{}
+	if appConfig.CapacityCheck {
+		var available []NodeConfig
+		for _, node := range candidates {
+			capacity, err := getNodeCapacity(ctx, &node, p.BaseTemplateName)
+			if err != nil {
+				logger.Error("Failed to get capacity of node %s: %s", node.Name, err.Error())
+				rejections = append(rejections, node.Name+": status unavailable: "+err.Error())
+				continue
+			}
+			capacities[node.Name] = capacity
+			available = append(available, node)
+		}
+		candidates = available
+	}
+
+	// fitting returns candidates that can take n more VMs, recording why the others can't
+	fitting := func(n int) ([]NodeConfig, []string) {
+		var survivors []NodeConfig
+		reasons := append([]string(nil), rejections...)
+		for _, node := range candidates {
+			capacity, ok := capacities[node.Name]
+			if !ok {
+				survivors = append(survivors, node)
+				continue
+			}
+			if reason := capacity.fits(p.VmTemplate, n); reason != "" {
+				reasons = append(reasons, node.Name+": "+reason)
+				continue
+			}
+			survivors = append(survivors, node)
+		}
+		return survivors, reasons
+	}
+	noCapacity := func(n int, reasons []string) error {
+		msg := fmt.Sprintf("No node can fit %d VM(s) of vm_template %s: %s", n, p.VmTemplate.Name, strings.Join(reasons, "; "))
+		return &requestError{http.StatusConflict, msg}
+	}
+	reserve := func(node NodeConfig) {
+		if capacity, ok := capacities[node.Name]; ok {
+			capacity.reserve(p.VmTemplate)
+		}
+	}
+
+	var nodes []NodeConfig
+	switch {
+	case p.RequestedNode == "" && p.Placement == PlacementSpread:
+		assigned := map[string]int{}
+		for i := 0; i < count; i++ {
+			survivors, reasons := fitting(1)
+			if len(survivors) == 0 {
+				return nil, noCapacity(count, reasons)
+			}
+			selected := spreadNode(survivors, assigned)
+			assigned[selected.Name]++
+			reserve(selected)
+			nodes = append(nodes, selected)
+		}
+	case p.RequestedNode == "" && p.Placement == PlacementWeightedPerVM:
+		for i := 0; i < count; i++ {
+			survivors, reasons := fitting(1)
+			selected := selectWeightedNode(survivors)
+			if selected == nil {
+				return nil, noCapacity(count, reasons)
+			}
+			reserve(*selected)
+			nodes = append(nodes, *selected)
+		}
+	default:
+		// pack, or an explicit node: one node has to fit the whole request
+		survivors, reasons := fitting(count)
+		selected := selectWeightedNode(survivors)
+		if p.RequestedNode != "" && len(survivors) == 1 {
+			selected = &survivors[0]
+		}
+		if selected == nil {
+			return nil, noCapacity(count, reasons)
+		}
+		for i := 0; i < count; i++ {
+			nodes = append(nodes, *selected)
+		}
+	}
+
+	placed := make([]*createParams, count)
+	for i, node := range nodes {
+		vmParams := *p
+		vmParams.Node = node
+		vmParams.BaseTemplateID = findBaseTemplateID(&node, p.BaseTemplateName)
+		placed[i] = &vmParams
+	}
+	return placed, nil
+}
+
+// spreadNode picks the node with the fewest VMs assigned so far, heavier nodes first on ties
+func spreadNode(survivors []NodeConfig, assigned map[string]int) NodeConfig {
+	ordered := append([]NodeConfig(nil), survivors...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		if assigned[ordered[i].Name] != assigned[ordered[j].Name] {
+			return assigned[ordered[i].Name] < assigned[ordered[j].Name]
+		}
+		return ordered[i].Weight > ordered[j].Weight
+	})
+	return ordered[0]
+}
+
+// nodeCapacity is what is left on a Proxmox node for new VMs
+type nodeCapacity struct {
+	CPUs         int
+	FreeMemoryMB int64
+	FreeDiskGB   int64
+	Storage      string
+}
+
+// getNodeCapacity reads live node status and the free space of the storage holding the base template disk
+func getNodeCapacity(ctx context.Context, node *NodeConfig, baseTemplateName string) (*nodeCapacity, error) {
+	status, err := getNodeStatus(ctx, node.Name)
+	if err != nil {
+		return nil, err
+	}
+	capacity := &nodeCapacity{
+		CPUs:         status.CPUInfo.CPUs,
+		FreeMemoryMB: status.Memory.Free / 1024 / 1024,
+		FreeDiskGB:   -1,
+	}
+
+	storage, err := getVMDiskStorage(ctx, node.Name, findBaseTemplateID(node, baseTemplateName))
+	if err != nil {
+		return nil, err
+	}
+	storageStatus, err := getStorageStatus(ctx, node.Name, storage)
+	if err != nil {
+		return nil, err
+	}
+	capacity.Storage = storage
+	capacity.FreeDiskGB = storageStatus.Avail / 1024 / 1024 / 1024
+
+	logger.Debug("Capacity of node %s: cpus=%d, free_memory=%dMB, storage=%s, free_disk=%dGB",
+		node.Name, capacity.CPUs, capacity.FreeMemoryMB, capacity.Storage, capacity.FreeDiskGB)
+	return capacity, nil
+}
+
+// fits returns an empty string if n VMs of template fit, otherwise the reason they don't
+func (c *nodeCapacity) fits(template VmTemplate, n int) string {
+	if c.CPUs < template.CPU {
+		return fmt.Sprintf("not enough CPUs (have %d, need %d)", c.CPUs, template.CPU)
+	}
+	if needMemory := int64(template.Memory * n); c.FreeMemoryMB < needMemory {
+		return fmt.Sprintf("not enough free memory (have %d MB, need %d MB)", c.FreeMemoryMB, needMemory)
+	}
+	if needDisk := int64(template.Disk * n); c.FreeDiskGB >= 0 && c.FreeDiskGB < needDisk {
+		return fmt.Sprintf("not enough free space on storage %s (have %d GB, need %d GB)", c.Storage, c.FreeDiskGB, needDisk)
+	}
+	return ""
+}
+
+func (c *nodeCapacity) reserve(template VmTemplate) {
+	c.FreeMemoryMB -= int64(template.Memory)
+	if c.FreeDiskGB >= 0 {
+		c.FreeDiskGB -= int64(template.Disk)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// setupPlacement adds nodes to the test cluster: pve2 weighs three times pve1, pve3 has weight 0
+// and pve4 lacks the talos base template
+func setupPlacement(t *testing.T) *FakeProxmox {
+	t.Helper()
+	fake := setupTest(t)
+	config.Nodes = append(config.Nodes,
+		NodeConfig{Name: "pve2", Weight: 3, Suffix: "b", BaseTemplates: []BaseTemplate{{Name: "talos", ID: 9001}}},
+		NodeConfig{Name: "pve3", Weight: 0, Suffix: "c", BaseTemplates: []BaseTemplate{{Name: "talos", ID: 9002}}},
+		NodeConfig{Name: "pve4", Weight: 5, Suffix: "d", BaseTemplates: []BaseTemplate{{Name: "other", ID: 9003}}},
+	)
+	for _, node := range config.Nodes[1:] {
+		fake.AddVM(FakeVM{Node: node.Name, VMID: node.BaseTemplates[0].ID, Name: node.BaseTemplates[0].Name, Template: true})
+	}
+	return fake
+}
+
+// placedNodes returns the node of every placed VM, checking the base template ID was resolved for it
+func placedNodes(t *testing.T, placed []*createParams) []string {
+	t.Helper()
+	var nodes []string
+	for _, p := range placed {
+		if want := findBaseTemplateID(&p.Node, p.BaseTemplateName); p.BaseTemplateID != want {
+			t.Errorf("VM on %s got base template ID %d, want %d", p.Node.Name, p.BaseTemplateID, want)
+		}
+		nodes = append(nodes, p.Node.Name)
+	}
+	return nodes
+}
+
+func TestPlaceVMs(t *testing.T) {
+	setupPlacement(t)
+
+	tests := []struct {
+		name      string
+		placement string
+		node      string
+		template  string
+		count     int
+		want      []string // nil accepts any node that can host the base template
+		wantErr   string
+	}{
+		{name: "spread", placement: PlacementSpread, count: 4, want: []string{"pve2", "pve1", "pve2", "pve1"}},
+		{name: "pack", placement: PlacementPack, count: 3},
+		{name: "weighted per VM", placement: PlacementWeightedPerVM, count: 20},
+		{name: "requested node wins over spread", placement: PlacementSpread, node: "pve1", count: 2, want: []string{"pve1", "pve1"}},
+		{name: "requested node with weight 0", placement: PlacementPack, node: "pve3", count: 1, want: []string{"pve3"}},
+		{name: "only node with the base template", placement: PlacementSpread, template: "other", count: 2, want: []string{"pve4", "pve4"}},
+		{name: "unknown node", placement: PlacementPack, node: "pve9", count: 1, wantErr: "Invalid node: pve9"},
+		{name: "requested node without the base template", placement: PlacementPack, node: "pve4", count: 1, wantErr: "Invalid base_template: talos for node: pve4"},
+		{name: "unknown base template", placement: PlacementSpread, template: "missing", count: 1, wantErr: "No nodes available"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			template := tt.template
+			if template == "" {
+				template = "talos"
+			}
+			p := &createParams{BaseTemplateName: template, VmTemplate: config.VmTemplates[0], RequestedNode: tt.node, Placement: tt.placement}
+			placed, err := placeVMs(context.Background(), p, tt.count)
+			if tt.wantErr != "" {
+				var reqErr *requestError
+				if !errors.As(err, &reqErr) || reqErr.Status != http.StatusBadRequest || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected a 400 error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			nodes := placedNodes(t, placed)
+			if len(nodes) != tt.count {
+				t.Fatalf("placed %d VMs, want %d", len(nodes), tt.count)
+			}
+			if tt.want != nil && !reflect.DeepEqual(nodes, tt.want) {
+				t.Errorf("placed on %v, want %v", nodes, tt.want)
+			}
+			for _, node := range nodes {
+				if node != "pve1" && node != "pve2" && tt.node == "" && tt.template == "" {
+					t.Errorf("VM placed on %s, which has weight 0 or lacks the base template", node)
+				}
+				if tt.placement == PlacementPack && node != nodes[0] {
+					t.Errorf("pack placed VMs on %v", nodes)
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestPlaceVMsReservesCapacity(t *testing.T) {
+	fake := setupPlacement(t)
+	// The fake nodes have 256 GB free, enough for two of these
+	large := VmTemplate{Name: "worker-large", CPU: 8, Memory: 100 * 1024, Disk: 50, CPUModel: "host", Role: "worker"}
+
+	tests := []struct {
+		name          string
+		placement     string
+		count         int
+		capacityCheck bool
+		want          map[string]int
+		wantErr       string
+	}{
+		{name: "spread", placement: PlacementSpread, count: 4, capacityCheck: true, want: map[string]int{"pve1": 2, "pve2": 2}},
+		{name: "weighted per VM", placement: PlacementWeightedPerVM, count: 4, capacityCheck: true, want: map[string]int{"pve1": 2, "pve2": 2}},
+		{name: "spread beyond capacity", placement: PlacementSpread, count: 5, capacityCheck: true, wantErr: "not enough free memory"},
+		{name: "weighted per VM beyond capacity", placement: PlacementWeightedPerVM, count: 5, capacityCheck: true, wantErr: "not enough free memory"},
+		{name: "pack needs one node for all", placement: PlacementPack, count: 3, capacityCheck: true, wantErr: "need 307200 MB"},
+		{name: "pack without capacity check", placement: PlacementPack, count: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			appConfig.CapacityCheck = tt.capacityCheck
+			p := &createParams{BaseTemplateName: "talos", VmTemplate: large, Placement: tt.placement}
+			placed, err := placeVMs(context.Background(), p, tt.count)
+			if tt.wantErr != "" {
+				var reqErr *requestError
+				if !errors.As(err, &reqErr) || reqErr.Status != http.StatusConflict || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected a 409 error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			counts := map[string]int{}
+			for _, node := range placedNodes(t, placed) {
+				counts[node]++
+			}
+			if tt.want != nil && !reflect.DeepEqual(counts, tt.want) {
+				t.Errorf("placed %v, want %v", counts, tt.want)
+			}
+		})
+	}
+
+	// A node whose status can't be read is skipped
+	appConfig.CapacityCheck = true
+	fake.Fault(FakeFault{Method: "GET", Path: "/nodes/pve2/status", Status: http.StatusInternalServerError, Message: "node offline"})
+	placed, err := placeVMs(context.Background(), &createParams{BaseTemplateName: "talos", VmTemplate: large, Placement: PlacementSpread}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nodes := placedNodes(t, placed); !reflect.DeepEqual(nodes, []string{"pve1", "pve1"}) {
+		t.Errorf("placed on %v, want pve1 only", nodes)
+	}
+	_, err = placeVMs(context.Background(), &createParams{BaseTemplateName: "talos", VmTemplate: large, Placement: PlacementSpread}, 3)
+	if err == nil || !strings.Contains(err.Error(), "pve2: status unavailable") {
+		t.Errorf("expected the unavailable node in the error, got %v", err)
+	}
+}
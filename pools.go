@@ -0,0 +1,452 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// poolState is a configured pool and what the controller is doing with it
+type poolState struct {
+	Pool
+	Creating map[string]*Job // jobs of the VMs being created, by id
+	Deleting map[string]bool // names of VMs being removed
+	Failures int             // creations failed in a row
+	RetryAt  time.Time       // no creations before, after failures
+}
+
+// PoolStatus is a pool as reported by the API
+type PoolStatus struct {
+	Name         string     `json:"name"`
+	BaseTemplate string     `json:"base_template"`
+	VmTemplate   string     `json:"vm_template"`
+	Placement    string     `json:"placement"`
+	Replicas     int        `json:"replicas"`
+	MinSize      int        `json:"min_size,omitempty"`
+	MaxSize      int        `json:"max_size,omitempty"`
+	Current      int        `json:"current"`
+	Creating     int        `json:"creating"`
+	Deleting     int        `json:"deleting"`
+	VMs          []string   `json:"vms"`
+	RetryAt      *time.Time `json:"retry_at,omitempty"` // creations back off after failures until then
+}
+
+var (
+	poolsMu    sync.Mutex
+	pools      = map[string]*poolState{}
+	poolSyncMu sync.Mutex // serializes syncPool
+)
+
+// initPools validates the configured pools and applies replica counts saved by the scale API
+func initPools() error {
+	for _, pool := range config.Pools {
+		if pool.Name == "" {
+			return errors.New("pool without a name")
+		}
+		if _, ok := pools[pool.Name]; ok {
+			return fmt.Errorf("duplicate pool %s", pool.Name)
+		}
+		if findVmTemplate(pool.VmTemplate) == nil {
+			return fmt.Errorf("pool %s: unknown vm_template %s", pool.Name, pool.VmTemplate)
+		}
+		if candidates, _ := placementCandidates(config.Nodes, pool.BaseTemplate); len(candidates) == 0 {
+			return fmt.Errorf("pool %s: no node has base_template %s", pool.Name, pool.BaseTemplate)
+		}
+		if pool.Placement == "" {
+			pool.Placement = appConfig.Placement
+		}
+		if !isValidPlacement(pool.Placement) {
+			return fmt.Errorf("pool %s: invalid placement %s", pool.Name, pool.Placement)
+		}
+		if pool.Replicas < 0 {
+			return fmt.Errorf("pool %s: replicas must not be negative", pool.Name)
+		}
+		if pool.MaxSize > 0 && (pool.MinSize < 0 || pool.MinSize > pool.MaxSize) {
+			return fmt.Errorf("pool %s: min_size must be between 0 and max_size", pool.Name)
+		}
+		pools[pool.Name] = &poolState{Pool: pool, Creating: map[string]*Job{}, Deleting: map[string]bool{}}
+	}
+
+	data, err := os.ReadFile(appConfig.PoolsStatePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var replicas map[string]int
+	if err := json.Unmarshal(data, &replicas); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", appConfig.PoolsStatePath, err)
+	}
+	for name, n := range replicas {
+		if state, ok := pools[name]; ok {
+			logger.Info("Pool %s: using %d replicas set through the API instead of %d", name, n, state.Replicas)
+			state.Replicas = n
+		}
+	}
+	return nil
+}
+
+// savePoolReplicas persists the replica counts of all pools; callers hold poolsMu
+func savePoolReplicas() error {
+	replicas := map[string]int{}
+	for name, state := range pools {
+		replicas[name] = state.Replicas
+	}
+	data, err := json.MarshalIndent(replicas, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(appConfig.PoolsStatePath, data)
+}
+
+func findVmTemplate(name string) *VmTemplate {
+	for i, t := range config.VmTemplates {
+		if t.Name == name {
+			return &config.VmTemplates[i]
+		}
+	}
+	return nil
+}
+
+// runPoolController converges every pool to its replica count every POOL_SYNC_INTERVAL
+func runPoolController() {
+	logger.Info("Syncing %d pool(s) every %v", len(pools), appConfig.PoolSyncInterval)
+	for {
+		for _, name := range poolNames() {
+			syncPool(name)
+		}
+		time.Sleep(appConfig.PoolSyncInterval)
+	}
+}
+
+func poolNames() []string {
+	poolsMu.Lock()
+	defer poolsMu.Unlock()
+	names := make([]string, 0, len(pools))
+	for name := range pools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// poolMembers returns the inventory VMs of a pool, newest first. Failed VMs kept for
+// debugging aren't members, nor are VMs the reconciler found missing, so they are replaced.
+func poolMembers(name string) []InventoryVM {
+	missing := missingVMs()
+	members := inventory.list(func(vm *InventoryVM) bool {
+		return vm.Pool == name && vm.State != InventoryKept && !missing[vm.Name]
+	})
+	sort.SliceStable(members, func(i, j int) bool { return members[i].CreatedAt.After(members[j].CreatedAt) })
+	return members
+}
+
+// syncPool starts creations or removals to bring a pool to its replica count. It doesn't wait
+// for them; VMs being created or removed are taken into account by the next sync.
+func syncPool(name string) {
+	poolSyncMu.Lock()
+	defer poolSyncMu.Unlock()
+
+	poolsMu.Lock()
+	state, ok := pools[name]
+	if !ok {
+		poolsMu.Unlock()
+		return
+	}
+	pool, creating, retryAt := state.Pool, len(state.Creating), state.RetryAt
+	poolsMu.Unlock()
+
+	var active []InventoryVM
+	for _, vm := range poolMembers(name) {
+		if !isPoolVMDeleting(name, vm.Name) {
+			active = append(active, vm)
+		}
+	}
+
+	switch {
+	case len(active)+creating < pool.Replicas && time.Now().Before(retryAt):
+		logger.Debug("Pool %s: backing off after failed creations until %s", name, retryAt.Format(time.RFC3339))
+	case len(active)+creating < pool.Replicas:
+		createPoolVMs(pool, pool.Replicas-len(active)-creating)
+	case len(active) > pool.Replicas && creating == 0:
+		// Newest VMs go first
+		for _, vm := range active[:len(active)-pool.Replicas] {
+			removePoolVM(pool, vm)
+		}
+	}
+}
+
+// poolCreatingJobs returns the jobs creating VMs of a pool
+func poolCreatingJobs(pool string) []*Job {
+	poolsMu.Lock()
+	defer poolsMu.Unlock()
+	var creating []*Job
+	for _, job := range pools[pool].Creating {
+		creating = append(creating, job)
+	}
+	return creating
+}
+
+// recordPoolCreation resets the backoff of a pool after a successful creation, or doubles it
+// (from POOL_SYNC_INTERVAL up to POOL_RETRY_MAX_DELAY) after a failed one
+func recordPoolCreation(name string, err error) {
+	poolsMu.Lock()
+	defer poolsMu.Unlock()
+	state := pools[name]
+	if err == nil {
+		state.Failures, state.RetryAt = 0, time.Time{}
+		return
+	}
+	state.Failures++
+	delay := appConfig.PoolSyncInterval
+	for i := 1; i < state.Failures && delay < appConfig.PoolRetryMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > appConfig.PoolRetryMaxDelay {
+		delay = appConfig.PoolRetryMaxDelay
+	}
+	state.RetryAt = time.Now().Add(delay)
+	logger.Info("Pool %s: %d failed creation(s) in a row, retrying in %v", name, state.Failures, delay)
+}
+
+func isPoolVMDeleting(pool string, vmName string) bool {
+	poolsMu.Lock()
+	defer poolsMu.Unlock()
+	return pools[pool].Deleting[vmName]
+}
+
+// createPoolVMs places count VMs of a pool and creates them in the background through the create pipeline
+func createPoolVMs(pool Pool, count int) {
+	p := &createParams{
+		BaseTemplateName: pool.BaseTemplate,
+		VmTemplate:       *findVmTemplate(pool.VmTemplate),
+		Placement:        pool.Placement,
+		OnFailure:        appConfig.OnFailure,
+		ApplyMode:        appConfig.TalosApplyMode,
+		WaitReady:        appConfig.WaitForReady && kubeEnabled() && appConfig.TalosApplyMode != "staged",
+		Vars:             map[string]string{},
+		Requestor:        "pool/" + pool.Name,
+		Pool:             pool.Name,
+		NamePrefix:       pool.NamePrefix,
+	}
+	if p.OnFailure == OnFailureKeep {
+		kept := inventory.list(func(vm *InventoryVM) bool { return vm.Pool == pool.Name && vm.State == InventoryKept })
+		if len(kept) >= appConfig.PoolMaxKeptVMs {
+			logger.Info("Pool %s: %d failed VM(s) kept already, destroying further ones", pool.Name, len(kept))
+			p.OnFailure = OnFailureDestroy
+		}
+	}
+	placed, err := placeVMs(context.Background(), p, count)
+	if err == nil {
+		err = checkMachineConfigs(placed)
+	}
+	if err != nil {
+		logger.Error("Pool %s: can't create %d VM(s): %s", pool.Name, count, err.Error())
+		reportError(err)
+		incErrorCounterHandler("pool/" + pool.Name)
+		recordPoolCreation(pool.Name, err)
+		return
+	}
+
+	logger.Info("Pool %s: creating %d VM(s) to reach %d replicas", pool.Name, count, pool.Replicas)
+	for _, vmParams := range placed {
+		job := newJob()
+		poolsMu.Lock()
+		pools[pool.Name].Creating[job.ID] = job
+		poolsMu.Unlock()
+		go func(vmParams *createParams, job *Job) {
+			defer func() {
+				poolsMu.Lock()
+				delete(pools[pool.Name].Creating, job.ID)
+				poolsMu.Unlock()
+			}()
+
+			bulkSlots <- struct{}{}
+			defer func() { <-bulkSlots }()
+
+			_, err := runCreatePipeline(context.Background(), vmParams, job)
+			if err != nil {
+				logger.Error("Pool %s: VM creation failed: job=%s: %s", pool.Name, job.ID, err.Error())
+			}
+			recordPoolCreation(pool.Name, err)
+		}(vmParams, job)
+	}
+}
+
+// removePoolVM removes a surplus VM of a pool in the background through the delete path
+func removePoolVM(pool Pool, vm InventoryVM) {
+	logger.Info("Pool %s: removing VM %s to reach %d replicas", pool.Name, vm.Name, pool.Replicas)
+	poolsMu.Lock()
+	pools[pool.Name].Deleting[vm.Name] = true
+	poolsMu.Unlock()
+
+	go func() {
+		defer func() {
+			poolsMu.Lock()
+			delete(pools[pool.Name].Deleting, vm.Name)
+			poolsMu.Unlock()
+		}()
+
+		d := &deletion{Node: vm.Node, VMID: vm.VMID, VMName: vm.Name}
+		if err := d.execute(context.Background(), "shutdown", appConfig.GracefulDelete && kubeEnabled()); err != nil {
+			logger.Error("Pool %s: failed to remove VM %s: %s", pool.Name, vm.Name, err.Error())
+			reportError(err)
+			incErrorCounterHandler("pool/" + pool.Name)
+		}
+	}()
+}
+
+var errPoolBelowMin = errors.New("pool would shrink below min_size")
+
+// deletePoolVMs removes the given VMs of a pool and lowers its replica count accordingly,
+// so the controller doesn't replace them
+func deletePoolVMs(name string, vms []InventoryVM) error {
+	poolSyncMu.Lock()
+	defer poolSyncMu.Unlock()
+
+	poolsMu.Lock()
+	state, ok := pools[name]
+	if !ok {
+		poolsMu.Unlock()
+		return errPoolNotFound
+	}
+	replicas := state.Replicas - len(vms)
+	minSize := state.MinSize
+	poolsMu.Unlock()
+	if replicas < minSize {
+		return fmt.Errorf("%w: %d < %d", errPoolBelowMin, replicas, minSize)
+	}
+
+	if err := scalePool(name, replicas); err != nil {
+		return err
+	}
+	pool := state.Pool
+	for _, vm := range vms {
+		if !isPoolVMDeleting(name, vm.Name) {
+			removePoolVM(pool, vm)
+		}
+	}
+	return nil
+}
+
+func poolStatus(name string) (PoolStatus, bool) {
+	poolsMu.Lock()
+	state, ok := pools[name]
+	if !ok {
+		poolsMu.Unlock()
+		return PoolStatus{}, false
+	}
+	status := PoolStatus{
+		Name:         state.Name,
+		BaseTemplate: state.BaseTemplate,
+		VmTemplate:   state.VmTemplate,
+		Placement:    state.Placement,
+		Replicas:     state.Replicas,
+		MinSize:      state.MinSize,
+		MaxSize:      state.MaxSize,
+		Creating:     len(state.Creating),
+		Deleting:     len(state.Deleting),
+		VMs:          []string{},
+	}
+	if !state.RetryAt.IsZero() {
+		retryAt := state.RetryAt
+		status.RetryAt = &retryAt
+	}
+	poolsMu.Unlock()
+
+	for _, vm := range poolMembers(name) {
+		status.VMs = append(status.VMs, vm.Name)
+	}
+	status.Current = len(status.VMs)
+	return status, true
+}
+
+// poolsHandler serves GET /api/v1/pools, GET /api/v1/pools/{name} and PUT /api/v1/pools/{name}/scale
+func poolsHandler(w http.ResponseWriter, r *http.Request) {
+	handlerName := "/api/v1/pools"
+	if r.Header.Get("X-Auth-Token") != authToken {
+		logger.Error("Unauthorized access to %s", handlerName)
+		incErrorCounterHandler(handlerName)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/pools"), "/")
+	name, action, _ := strings.Cut(path, "/")
+	switch {
+	case name == "" && r.Method == "GET":
+		statuses := []PoolStatus{}
+		for _, name := range poolNames() {
+			if status, ok := poolStatus(name); ok {
+				statuses = append(statuses, status)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"pools": statuses})
+		return
+	case name != "" && action == "" && r.Method == "GET":
+	case name != "" && action == "scale" && r.Method == "PUT":
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+		replicas, err := strconv.Atoi(r.FormValue("replicas"))
+		if err != nil || replicas < 0 {
+			incErrorCounterHandler(handlerName)
+			http.Error(w, "replicas must be a non-negative number", http.StatusBadRequest)
+			return
+		}
+		if status, ok := poolStatus(name); ok && status.MaxSize > 0 && (replicas < status.MinSize || replicas > status.MaxSize) {
+			incErrorCounterHandler(handlerName)
+			http.Error(w, fmt.Sprintf("replicas must be between min_size %d and max_size %d", status.MinSize, status.MaxSize), http.StatusBadRequest)
+			return
+		}
+		if err := scalePool(name, replicas); err != nil {
+			if errors.Is(err, errPoolNotFound) {
+				http.Error(w, "Pool not found", http.StatusNotFound)
+				return
+			}
+			logger.Error("Failed to scale pool %s: %s", name, err.Error())
+			reportError(err)
+			incErrorCounterHandler(handlerName)
+			http.Error(w, "Failed to save pool replicas", http.StatusInternalServerError)
+			return
+		}
+		go syncPool(name)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	status, ok := poolStatus(name)
+	if !ok {
+		http.Error(w, "Pool not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+var errPoolNotFound = errors.New("pool not found")
+
+// scalePool changes and persists the replica count of a pool
+func scalePool(name string, replicas int) error {
+	poolsMu.Lock()
+	defer poolsMu.Unlock()
+	state, ok := pools[name]
+	if !ok {
+		return errPoolNotFound
+	}
+	logger.Info("Pool %s: scaling from %d to %d replicas", name, state.Replicas, replicas)
+	state.Replicas = replicas
+	return savePoolReplicas()
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setupPool configures one pool and resets the pool controller state
+func setupPool(t *testing.T, pool Pool) {
+	t.Helper()
+	appConfig.PoolsStatePath = filepath.Join(t.TempDir(), "pools.json")
+	config.Pools = []Pool{pool}
+	pools = map[string]*poolState{}
+	t.Cleanup(func() { pools = map[string]*poolState{} })
+	if err := initPools(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// syncPoolAndWait runs one sync of the pool and waits for the creations it started
+func syncPoolAndWait(t *testing.T, name string) {
+	t.Helper()
+	syncPool(name)
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		status, _ := poolStatus(name)
+		if status.Creating == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("pool %s still creating %d VM(s)", name, status.Creating)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPoolBacksOffAfterFailedCreations(t *testing.T) {
+	fake := setupTest(t)
+	appConfig.OnFailure = OnFailureKeep
+	appConfig.PoolMaxKeptVMs = 1
+	fake.Fault(FakeFault{Path: "/status/start", TaskStatus: "start failed: QEMU exited with code 1"})
+	setupPool(t, Pool{Name: "workers", BaseTemplate: "talos", VmTemplate: "worker-small", Replicas: 1})
+
+	syncPoolAndWait(t, "workers")
+	status, _ := poolStatus("workers")
+	if status.RetryAt == nil || !status.RetryAt.After(time.Now()) {
+		t.Fatalf("expected a backoff after the failed creation, got %+v", status)
+	}
+	if kept := inventory.list(func(vm *InventoryVM) bool { return vm.State == InventoryKept }); len(kept) != 1 {
+		t.Fatalf("expected 1 kept VM, got %+v", kept)
+	}
+
+	// No new attempt while backing off
+	syncPoolAndWait(t, "workers")
+	if vms := fake.VMs("pve1"); len(vms) != 1 {
+		t.Fatalf("expected no new VM while backing off, got %v", vms)
+	}
+
+	// Once POOL_MAX_KEPT_VMS are kept, failed VMs are destroyed, and the backoff doubles
+	poolsMu.Lock()
+	pools["workers"].RetryAt = time.Now()
+	poolsMu.Unlock()
+	syncPoolAndWait(t, "workers")
+	if vms := fake.VMs("pve1"); len(vms) != 1 {
+		t.Errorf("expected the second failed VM to be destroyed, got %v", vms)
+	}
+	poolsMu.Lock()
+	failures, retryIn := pools["workers"].Failures, time.Until(pools["workers"].RetryAt)
+	poolsMu.Unlock()
+	if failures != 2 || retryIn <= appConfig.PoolSyncInterval {
+		t.Errorf("expected a doubled backoff after 2 failures, got %d failures, retry in %v", failures, retryIn)
+	}
+}
+
+func TestPoolReplacesMissingVM(t *testing.T) {
+	fake := setupTest(t)
+	setupPool(t, Pool{Name: "workers", BaseTemplate: "talos", VmTemplate: "worker-small", Replicas: 1})
+	inventory.put(InventoryVM{Name: "worker-small-a-200-gone00", Node: "pve1", VMID: 200, Pool: "workers"})
+
+	reconcile(context.Background())
+	if members := poolMembers("workers"); len(members) != 0 {
+		t.Fatalf("missing VM still counted as a member: %+v", members)
+	}
+
+	syncPoolAndWait(t, "workers")
+	if vms := fake.VMs("pve1"); len(vms) != 1 {
+		t.Errorf("expected the missing VM to be replaced, got %v", vms)
+	}
+}
+
+func TestPoolScaleBounds(t *testing.T) {
+	fake := setupTest(t)
+	setupPool(t, Pool{Name: "workers", BaseTemplate: "talos", VmTemplate: "worker-small", Replicas: 1, MinSize: 1, MaxSize: 3})
+	fake.AddVM(FakeVM{Node: "pve1", VMID: 200, Name: "worker-small-a-200-abcdef"})
+	inventory.put(InventoryVM{Name: "worker-small-a-200-abcdef", Node: "pve1", VMID: 200, Pool: "workers"})
+
+	scale := func(replicas string) *httptest.ResponseRecorder {
+		form := url.Values{"replicas": {replicas}}
+		req := httptest.NewRequest("PUT", "/api/v1/pools/workers/scale", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("X-Auth-Token", authToken)
+		rec := httptest.NewRecorder()
+		poolsHandler(rec, req)
+		return rec
+	}
+	for _, replicas := range []string{"0", "4"} {
+		if rec := scale(replicas); rec.Code != http.StatusBadRequest {
+			t.Errorf("replicas=%s: expected 400, got %d: %s", replicas, rec.Code, rec.Body.String())
+		}
+	}
+	if rec := scale("1"); rec.Code != http.StatusOK {
+		t.Errorf("replicas=1: expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
@@ -1,42 +1,22 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
-	"math/rand"
-	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
 	"time"
 )
 
-func getNextID() (int, error) {
-	endpoint := fmt.Sprintf("%s/cluster/nextid", proxmoxBaseAddr)
-	req, err := http.NewRequest("GET", endpoint, nil)
-	if err != nil {
+func getNextID(ctx context.Context) (int, error) {
+	var data string
+	if err := proxmox.get(ctx, "/cluster/nextid", &data); err != nil {
 		return 0, err
 	}
-	req.Header.Add("Authorization", "PVEAPIToken="+proxmoxToken)
-
-	resp, err := httpClient.Do(req)
-	if err != nil {
-		return 0, err
-	}
-	defer resp.Body.Close()
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return 0, err
-	}
-	logger.Debug("getNextID raw response: %s", string(body))
-	var result struct {
-		Data string `json:"data"`
-	}
-	if err := json.Unmarshal(body, &result); err != nil {
-		return 0, err
-	}
-	nextID, err := strconv.Atoi(result.Data)
+	nextID, err := strconv.Atoi(data)
 	if err != nil {
 		return 0, err
 	}
@@ -44,64 +24,34 @@ func getNextID() (int, error) {
 	return nextID, nil
 }
 
-func cloneVM(node string, templateID int, newid int, name string) (string, error) {
-	endpoint := fmt.Sprintf("%s/nodes/%s/qemu/%d/clone", proxmoxBaseAddr, node, templateID)
+func cloneVM(ctx context.Context, node string, templateID int, newid int, name string) (string, error) {
 	data := url.Values{}
 	data.Set("newid", strconv.Itoa(newid))
 	data.Set("name", name)
 	data.Set("full", "1")
 	data.Set("format", "raw")
 
-	req, err := http.NewRequest("POST", endpoint, strings.NewReader(data.Encode()))
+	upid, err := proxmox.task(ctx, "POST", vmPath(node, templateID)+"/clone", data)
 	if err != nil {
 		return "", err
 	}
-	req.Header.Add("Authorization", "PVEAPIToken="+proxmoxToken)
-	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	logger.Info("Clone task created successfully: %s", upid)
+	return upid, nil
+}
 
-	resp, err := httpClient.Do(req)
-	if err != nil {
-		return "", err
-	}
-	defer resp.Body.Close()
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", err
-	}
-	logger.Debug("cloneVM raw response: %s", string(body))
-	var result struct {
-		Data string `json:"data"`
-	}
-	if err := json.Unmarshal(body, &result); err != nil {
-		return "", err
-	}
-	logger.Info("Clone task created successfully: %s", result.Data)
-	return result.Data, nil
+// trackTask polls the task until it stopped or ctx is done. The task itself keeps running on
+// Proxmox when ctx is done.
+func trackTask(ctx context.Context, node string, upid string) error {
+	return trackTaskLog(ctx, node, upid, nil)
 }
 
-func trackTask(node string, upid string) error {
-	statusEndpoint := fmt.Sprintf("%s/nodes/%s/tasks/%s/status", proxmoxBaseAddr, node, upid)
+// trackTaskLog is trackTask passing new task log lines to onLog (if set) on every poll
+func trackTaskLog(ctx context.Context, node string, upid string, onLog func(lines []string)) error {
+	path := fmt.Sprintf("/nodes/%s/tasks/%s/status", node, url.PathEscape(upid))
+	logStart := 0
 	for {
-		req, err := http.NewRequest("GET", statusEndpoint, nil)
-		if err != nil {
-			return err
-		}
-		req.Header.Add("Authorization", "PVEAPIToken="+proxmoxToken)
-
-		resp, err := httpClient.Do(req)
-		if err != nil {
-			return err
-		}
-		body, err := io.ReadAll(resp.Body)
-		resp.Body.Close()
-		if err != nil {
-			return err
-		}
-		logger.Debug("trackTask raw response for %s: %s", upid, string(body))
-		var raw struct {
-			Data json.RawMessage `json:"data"`
-		}
-		if err := json.Unmarshal(body, &raw); err != nil {
+		var raw json.RawMessage
+		if err := proxmox.get(ctx, path, &raw); err != nil {
 			return err
 		}
 
@@ -109,16 +59,16 @@ func trackTask(node string, upid string) error {
 			Status     string `json:"status"`
 			ExitStatus string `json:"exitstatus"`
 		}
-		if len(raw.Data) > 0 && raw.Data[0] == '{' {
-			if err := json.Unmarshal(raw.Data, &statusObj); err != nil {
+		if len(raw) > 0 && raw[0] == '{' {
+			if err := json.Unmarshal(raw, &statusObj); err != nil {
 				return err
 			}
-		} else if len(raw.Data) > 0 && raw.Data[0] == '[' {
+		} else if len(raw) > 0 && raw[0] == '[' {
 			var statusArr []struct {
 				Status     string `json:"status"`
 				ExitStatus string `json:"exitstatus"`
 			}
-			if err := json.Unmarshal(raw.Data, &statusArr); err != nil {
+			if err := json.Unmarshal(raw, &statusArr); err != nil {
 				return err
 			}
 			if len(statusArr) == 0 {
@@ -129,8 +79,22 @@ func trackTask(node string, upid string) error {
 			return fmt.Errorf("unexpected task status format for %s", upid)
 		}
 
+		// Read the log after the status, so the last lines are passed on once the task stopped
+		if onLog != nil {
+			if lines, err := getTaskLog(ctx, node, upid, logStart); err == nil {
+				logStart += len(lines)
+				if len(lines) > 0 {
+					onLog(lines)
+				}
+			} else {
+				logger.Debug("Failed to read log of task %s: %s", upid, err.Error())
+			}
+		}
+
 		if statusObj.Status == "running" {
-			time.Sleep(2 * time.Second)
+			if err := sleepContext(ctx, 2*time.Second); err != nil {
+				return fmt.Errorf("task %s still running: %w", upid, err)
+			}
 			continue
 		}
 		if statusObj.Status == "stopped" {
@@ -138,47 +102,96 @@ func trackTask(node string, upid string) error {
 				logger.Info("Task %s completed successfully", upid)
 				return nil
 			}
-			return fmt.Errorf("task %s failed with exit status: %s", upid, statusObj.ExitStatus)
+			taskErr := &ProxmoxTaskError{Node: node, UPID: upid, ExitStatus: statusObj.ExitStatus}
+			var logErr error
+			if taskErr.Log, logErr = getTaskLogTail(ctx, node, upid, appConfig.TaskLogLines); logErr != nil {
+				logger.Error("Failed to read log of failed task %s: %s", upid, logErr.Error())
+			}
+			return taskErr
 		}
 		return fmt.Errorf("unknown task status for %s", upid)
 	}
 }
 
-func getVMConfig(node string, vmid int) (map[string]interface{}, error) {
-	endpoint := fmt.Sprintf("%s/nodes/%s/qemu/%d/config", proxmoxBaseAddr, node, vmid)
-	req, err := http.NewRequest("GET", endpoint, nil)
-	if err != nil {
-		return nil, err
-	}
-	req.Header.Add("Authorization", "PVEAPIToken="+proxmoxToken)
+// ProxmoxTaskError is a task that stopped with an exit status other than OK, with the
+// last lines of its log, which usually tell more than the exit status
+type ProxmoxTaskError struct {
+	Node       string
+	UPID       string
+	ExitStatus string
+	Log        []string
+}
 
-	resp, err := httpClient.Do(req)
-	if err != nil {
-		return nil, err
+func (e *ProxmoxTaskError) Error() string {
+	return fmt.Sprintf("task %s failed with exit status: %s", e.UPID, e.ExitStatus)
+}
+
+// proxmoxTaskDetails returns the failed task within err for API responses, or nil
+func proxmoxTaskDetails(err error) map[string]interface{} {
+	var taskErr *ProxmoxTaskError
+	if !errors.As(err, &taskErr) {
+		return nil
 	}
-	defer resp.Body.Close()
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
+	return map[string]interface{}{
+		"upid":        taskErr.UPID,
+		"exit_status": taskErr.ExitStatus,
+		"log":         taskErr.Log,
 	}
-	logger.Debug("getVMConfig raw response: %s", string(body))
-	var result struct {
-		Data map[string]interface{} `json:"data"`
+}
+
+// taskLogPage is how many lines are read from a task log per call
+const taskLogPage = 500
+
+// getTaskLog returns the lines of a task log from line start on
+func getTaskLog(ctx context.Context, node string, upid string, start int) ([]string, error) {
+	path := fmt.Sprintf("/nodes/%s/tasks/%s/log", node, url.PathEscape(upid))
+	var lines []string
+	for {
+		var page []struct {
+			N int    `json:"n"`
+			T string `json:"t"`
+		}
+		params := url.Values{}
+		params.Set("start", strconv.Itoa(start+len(lines)))
+		params.Set("limit", strconv.Itoa(taskLogPage))
+		if err := proxmox.do(ctx, "GET", path, params, &page); err != nil {
+			return lines, err
+		}
+		for _, line := range page {
+			// A running task reports "no content" for lines it hasn't written yet
+			if line.T != "no content" {
+				lines = append(lines, line.T)
+			}
+		}
+		if len(page) < taskLogPage {
+			return lines, nil
+		}
 	}
-	if err := json.Unmarshal(body, &result); err != nil {
-		return nil, err
+}
+
+// getTaskLogTail returns the last n lines of a task log
+func getTaskLogTail(ctx context.Context, node string, upid string, n int) ([]string, error) {
+	lines, err := getTaskLog(ctx, node, upid, 0)
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
 	}
+	return lines, err
+}
 
-	return result.Data, nil
+func getVMConfig(ctx context.Context, node string, vmid int) (map[string]interface{}, error) {
+	var vmConfig map[string]interface{}
+	if err := proxmox.get(ctx, vmPath(node, vmid)+"/config", &vmConfig); err != nil {
+		return nil, err
+	}
+	return vmConfig, nil
 }
 
-func configureVM(node string, vmid int, cores int, memory int, cpuModel string, numa string, phyCores string, htCores string, phyOnly bool, htOnly bool, nodeConfig *NodeConfig) (string, error) {
-	currentConfig, err := getVMConfig(node, vmid)
+func configureVM(ctx context.Context, node string, vmid int, cores int, memory int, cpuModel string, numa string, phyCores string, htCores string, phyOnly bool, htOnly bool, nodeConfig *NodeConfig) (string, error) {
+	currentConfig, err := getVMConfig(ctx, node, vmid)
 	if err != nil {
 		logger.Error("Failed to get current VM config: %s", err.Error())
 	}
 
-	endpoint := fmt.Sprintf("%s/nodes/%s/qemu/%d/config", proxmoxBaseAddr, node, vmid)
 	data := url.Values{}
 
 	if cpuModel != "" {
@@ -220,36 +233,33 @@ func configureVM(node string, vmid int, cores int, memory int, cpuModel string,
 		return "", fmt.Errorf("node configuration not found for %s", node)
 	}
 
-	var numaNode *NumaNode
-
+	// numa may list several host NUMA nodes ("0,1") to span the VM across them
+	var requestedNuma []NumaNode
 	if numa != "" {
-		numaID, err := strconv.Atoi(numa)
-		if err != nil {
-			logger.Error("Invalid NUMA node ID: %s", numa)
-			return "", err
-		}
+		for _, part := range strings.Split(numa, ",") {
+			numaID, err := strconv.Atoi(part)
+			if err != nil {
+				logger.Error("Invalid NUMA node ID: %s", part)
+				return "", err
+			}
 
-		for i, node := range nodeConfig.NUMA {
-			if node.ID == numaID {
-				numaNode = &nodeConfig.NUMA[i]
-				break
+			var numaNode *NumaNode
+			for i, node := range nodeConfig.NUMA {
+				if node.ID == numaID {
+					numaNode = &nodeConfig.NUMA[i]
+					break
+				}
 			}
-		}
 
-		if numaNode == nil {
-			logger.Error("NUMA node %d not found", numaID)
-			return "", fmt.Errorf("NUMA node %d not found", numaID)
-		}
-	} else {
-		numaNode, err = selectRandomNumaNode(node)
-		if err != nil {
-			logger.Error("Failed to select NUMA node: %s", err.Error())
-			return "", err
+			if numaNode == nil {
+				logger.Error("NUMA node %d not found", numaID)
+				return "", fmt.Errorf("NUMA node %d not found", numaID)
+			}
+			requestedNuma = append(requestedNuma, *numaNode)
 		}
-		logger.Info("Auto-selected NUMA node ID: %d", numaNode.ID)
 	}
 
-	var selectedCores string
+	var allocation *coreAllocation
 	if phyCores != "" || htCores != "" {
 		var coreParts []string
 		if phyCores != "" {
@@ -258,211 +268,124 @@ func configureVM(node string, vmid int, cores int, memory int, cpuModel string,
 		if htCores != "" {
 			coreParts = append(coreParts, htCores)
 		}
-		selectedCores = strings.Join(coreParts, ",")
+		selectedCores := strings.Join(coreParts, ",")
 
 		totalCores := countCoresFromRange(phyCores) + countCoresFromRange(htCores)
 		if totalCores != cores {
 			logger.Info("Total specified cores (%d) doesn't match VM template cores (%d)", totalCores, cores)
 		}
+
+		allocation, err = pinnedAllocation(nodeConfig, requestedNuma, parseCoreRange(selectedCores), cores, memory)
+		if err != nil {
+			logger.Error("Failed to map pinned cores to NUMA nodes: %s", err.Error())
+			return "", err
+		}
 	} else {
-		selectedCores = autoSelectCores(numaNode, phyOnly, htOnly)
+		allocation, err = allocateCores(ctx, nodeConfig, vmid, requestedNuma, cores, memory, phyOnly, htOnly)
+		if err != nil {
+			logger.Error("Failed to allocate cores: %s", err.Error())
+			return "", err
+		}
 	}
 
-	if selectedCores != "" {
-		data.Set("affinity", selectedCores)
-		logger.Info("Setting CPU affinity: %s", selectedCores)
+	if affinity := allocation.affinity(); affinity != "" {
+		data.Set("affinity", affinity)
+		logger.Info("Setting CPU affinity: %s", affinity)
 	}
 
-	data.Set("sockets", "1")
-	data.Set("cores", strconv.Itoa(cores))
+	// One guest socket and NUMA node per host NUMA node the VM is bound to
+	sockets := len(allocation.Nodes)
+	data.Set("sockets", strconv.Itoa(sockets))
+	data.Set("cores", strconv.Itoa(cores/sockets))
 	data.Set("numa", "1")
 
-	virtualCoresList := fmt.Sprintf("0-%d", cores-1)
+	guestCPU := 0
+	for i, slice := range allocation.Nodes {
+		numaConfig := fmt.Sprintf("cpus=%s,memory=%d,hostnodes=%d,policy=bind", guestCPUList(guestCPU, slice.VCPUs), slice.Memory, slice.NumaNode.ID)
+		data.Set(fmt.Sprintf("numa%d", i), numaConfig)
+		logger.Info("Setting guest NUMA topology: numa%d=%s", i, numaConfig)
+		guestCPU += slice.VCPUs
+	}
 
-	numaConfig := fmt.Sprintf("cpus=%s,memory=%d,hostnodes=%d,policy=bind", virtualCoresList, memory, numaNode.ID)
-	data.Set("numa0", numaConfig)
-	logger.Info("Setting guest NUMA topology: numa0=%s", numaConfig)
+	// Drop guest NUMA nodes inherited from the base template that are beyond the new topology
+	var staleNuma []string
+	for key := range currentConfig {
+		if !strings.HasPrefix(key, "numa") || key == "numa" {
+			continue
+		}
+		if index, err := strconv.Atoi(strings.TrimPrefix(key, "numa")); err == nil && index >= sockets {
+			staleNuma = append(staleNuma, key)
+		}
+	}
+	if len(staleNuma) > 0 {
+		data.Set("delete", strings.Join(staleNuma, ","))
+	}
 
 	logURLValues("VM Configure", data)
 
-	encodedData := data.Encode()
-	req, err := http.NewRequest("POST", endpoint, strings.NewReader(encodedData))
+	upid, err := proxmox.task(ctx, "POST", vmPath(node, vmid)+"/config", data)
 	if err != nil {
 		return "", err
 	}
-	req.Header.Add("Authorization", "PVEAPIToken="+proxmoxToken)
-	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-
-	resp, err := httpClient.Do(req)
-	if err != nil {
-		return "", err
-	}
-	defer resp.Body.Close()
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", err
-	}
-	logger.Debug("configureVM raw response: %s", string(body))
-	var result struct {
-		Data string `json:"data"`
-	}
-	if err := json.Unmarshal(body, &result); err != nil {
-		return "", err
-	}
-	logger.Info("Configure VM task created successfully: %s", result.Data)
-	return result.Data, nil
+	logger.Info("Configure VM task created successfully: %s", upid)
+	return upid, nil
 }
 
-func resizeDisk(node string, vmid int, diskSize int) (string, error) {
-	endpoint := fmt.Sprintf("%s/nodes/%s/qemu/%d/resize", proxmoxBaseAddr, node, vmid)
+func resizeDisk(ctx context.Context, node string, vmid int, diskSize int) (string, error) {
 	data := url.Values{}
 	data.Set("disk", "virtio0")
 	data.Set("size", fmt.Sprintf("%dG", diskSize))
 
-	req, err := http.NewRequest("PUT", endpoint, strings.NewReader(data.Encode()))
-	if err != nil {
-		return "", err
-	}
-	req.Header.Add("Authorization", "PVEAPIToken="+proxmoxToken)
-	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-
-	resp, err := httpClient.Do(req)
-	if err != nil {
-		return "", err
-	}
-	defer resp.Body.Close()
-	body, err := io.ReadAll(resp.Body)
+	upid, err := proxmox.task(ctx, "PUT", vmPath(node, vmid)+"/resize", data)
 	if err != nil {
 		return "", err
 	}
-	logger.Debug("resizeDisk raw response: %s", string(body))
-	var result struct {
-		Data *string `json:"data"`
-	}
-	if err := json.Unmarshal(body, &result); err != nil {
-		return "", err
-	}
-	if result.Data == nil || *result.Data == "" {
+	if upid == "" {
 		logger.Info("Resize disk completed successfully (synchronous operation)")
 		return "", nil
 	}
-	logger.Info("Resize disk task created successfully: %s", *result.Data)
-	return *result.Data, nil
+	logger.Info("Resize disk task created successfully: %s", upid)
+	return upid, nil
 }
 
-func startVM(node string, vmid int) (string, error) {
-	endpoint := fmt.Sprintf("%s/nodes/%s/qemu/%d/status/start", proxmoxBaseAddr, node, vmid)
-	req, err := http.NewRequest("POST", endpoint, nil)
-	if err != nil {
-		return "", err
-	}
-	req.Header.Add("Authorization", "PVEAPIToken="+proxmoxToken)
-
-	resp, err := httpClient.Do(req)
-	if err != nil {
-		return "", err
-	}
-	defer resp.Body.Close()
-	body, err := io.ReadAll(resp.Body)
+func startVM(ctx context.Context, node string, vmid int) (string, error) {
+	upid, err := proxmox.task(ctx, "POST", vmPath(node, vmid)+"/status/start", nil)
 	if err != nil {
 		return "", err
 	}
-	logger.Debug("startVM raw response: %s", string(body))
-	var result struct {
-		Data string `json:"data"`
-	}
-	if err := json.Unmarshal(body, &result); err != nil {
-		return "", err
-	}
-	logger.Info("Start VM task created successfully: %s", result.Data)
-	return result.Data, nil
+	logger.Info("Start VM task created successfully: %s", upid)
+	return upid, nil
 }
 
-func stopVM(node string, vmid int, method string) (string, error) {
-	var endpoint string
+func stopVM(ctx context.Context, node string, vmid int, method string) (string, error) {
+	action := "shutdown"
 	if method == "stop" {
-		endpoint = fmt.Sprintf("%s/nodes/%s/qemu/%d/status/stop", proxmoxBaseAddr, node, vmid)
-	} else {
-		endpoint = fmt.Sprintf("%s/nodes/%s/qemu/%d/status/shutdown", proxmoxBaseAddr, node, vmid)
+		action = "stop"
 	}
-	req, err := http.NewRequest("POST", endpoint, nil)
+	upid, err := proxmox.task(ctx, "POST", vmPath(node, vmid)+"/status/"+action, nil)
 	if err != nil {
 		return "", err
 	}
-	req.Header.Add("Authorization", "PVEAPIToken="+proxmoxToken)
-	resp, err := httpClient.Do(req)
-	if err != nil {
-		return "", err
-	}
-	defer resp.Body.Close()
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", err
-	}
-	logger.Debug("stopVM raw response: %s", string(body))
-	var result struct {
-		Data string `json:"data"`
-	}
-	if err := json.Unmarshal(body, &result); err != nil {
-		return "", err
-	}
-	logger.Info("Stop VM task created successfully: %s", result.Data)
-	return result.Data, nil
+	logger.Info("Stop VM task created successfully: %s", upid)
+	return upid, nil
 }
 
-func deleteVM(node string, vmid int) (string, error) {
-	endpoint := fmt.Sprintf("%s/nodes/%s/qemu/%d", proxmoxBaseAddr, node, vmid)
-	req, err := http.NewRequest("DELETE", endpoint, nil)
-	if err != nil {
-		return "", err
-	}
-	req.Header.Add("Authorization", "PVEAPIToken="+proxmoxToken)
-	resp, err := httpClient.Do(req)
-	if err != nil {
-		return "", err
-	}
-	defer resp.Body.Close()
-	body, err := io.ReadAll(resp.Body)
+func deleteVM(ctx context.Context, node string, vmid int) (string, error) {
+	upid, err := proxmox.task(ctx, "DELETE", vmPath(node, vmid), nil)
 	if err != nil {
 		return "", err
 	}
-	logger.Debug("deleteVM raw response: %s", string(body))
-	var result struct {
-		Data string `json:"data"`
-	}
-	if err := json.Unmarshal(body, &result); err != nil {
-		return "", err
-	}
-	logger.Info("Delete VM task created successfully: %s", result.Data)
-	return result.Data, nil
+	logger.Info("Delete VM task created successfully: %s", upid)
+	return upid, nil
 }
 
-func resetVM(node string, vmid int) (string, error) {
-	endpoint := fmt.Sprintf("%s/nodes/%s/qemu/%d/status/reset", proxmoxBaseAddr, node, vmid)
-	req, err := http.NewRequest("POST", endpoint, nil)
-	if err != nil {
-		return "", err
-	}
-	req.Header.Add("Authorization", "PVEAPIToken="+proxmoxToken)
-
-	resp, err := httpClient.Do(req)
-	if err != nil {
-		return "", err
-	}
-	defer resp.Body.Close()
-	body, err := io.ReadAll(resp.Body)
+func resetVM(ctx context.Context, node string, vmid int) (string, error) {
+	upid, err := proxmox.task(ctx, "POST", vmPath(node, vmid)+"/status/reset", nil)
 	if err != nil {
 		return "", err
 	}
-	logger.Debug("resetVM raw response: %s", string(body))
-	var result struct {
-		Data string `json:"data"`
-	}
-	if err := json.Unmarshal(body, &result); err != nil {
-		return "", err
-	}
-	logger.Info("Reset VM task created successfully: %s", result.Data)
-	return result.Data, nil
+	logger.Info("Reset VM task created successfully: %s", upid)
+	return upid, nil
 }
 
 func getNodeConfigByName(nodeName string) *NodeConfig {
@@ -511,47 +434,28 @@ func countCoresFromRange(coreRange string) int {
 	return count
 }
 
-func selectRandomNumaNode(nodeName string) (*NumaNode, error) {
-	nodeConfig := getNodeConfigByName(nodeName)
-	if nodeConfig == nil {
-		return nil, fmt.Errorf("node configuration not found for %s", nodeName)
-	}
+type VMListEntry struct {
+	VMID     int    `json:"vmid"`
+	Name     string `json:"name"`
+	Status   string `json:"status"`
+	Template int    `json:"template"`
+}
 
-	if len(nodeConfig.NUMA) == 0 {
-		return nil, fmt.Errorf("no NUMA nodes defined for node %s", nodeName)
+// listVMs returns all QEMU VMs (including templates) on a node
+func listVMs(ctx context.Context, node string) ([]VMListEntry, error) {
+	var vms []VMListEntry
+	if err := proxmox.get(ctx, "/nodes/"+node+"/qemu", &vms); err != nil {
+		return nil, err
 	}
-
-	numaIndex := rand.Intn(len(nodeConfig.NUMA))
-	return &nodeConfig.NUMA[numaIndex], nil
+	return vms, nil
 }
 
-func findVMByName(node string, vmName string) (int, error) {
-	endpoint := fmt.Sprintf("%s/nodes/%s/qemu", proxmoxBaseAddr, node)
-	req, err := http.NewRequest("GET", endpoint, nil)
+func findVMByName(ctx context.Context, node string, vmName string) (int, error) {
+	vms, err := listVMs(ctx, node)
 	if err != nil {
 		return 0, err
 	}
-	req.Header.Add("Authorization", "PVEAPIToken="+proxmoxToken)
-	resp, err := httpClient.Do(req)
-	if err != nil {
-		return 0, err
-	}
-	defer resp.Body.Close()
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return 0, err
-	}
-	logger.Debug("findVMByName raw response: %s", string(body))
-	var result struct {
-		Data []struct {
-			VMID int    `json:"vmid"`
-			Name string `json:"name"`
-		} `json:"data"`
-	}
-	if err := json.Unmarshal(body, &result); err != nil {
-		return 0, err
-	}
-	for _, vm := range result.Data {
+	for _, vm := range vms {
 		if vm.Name == vmName {
 			return vm.VMID, nil
 		}
@@ -559,62 +463,33 @@ func findVMByName(node string, vmName string) (int, error) {
 	return 0, fmt.Errorf("VM with name %s not found on node %s", vmName, node)
 }
 
-// getVMIPAddressFromGuestAgent gets VM IP address using qemu-guest-agent
-func getVMIPAddressFromGuestAgent(node string, vmid int) (string, error) {
-	endpoint := fmt.Sprintf("%s/nodes/%s/qemu/%d/agent/network-get-interfaces", proxmoxBaseAddr, node, vmid)
-
-	req, err := http.NewRequest("GET", endpoint, nil)
-	if err != nil {
-		return "", err
-	}
-	req.Header.Add("Authorization", "PVEAPIToken="+proxmoxToken)
+// getVMIPAddressFromGuestAgent gets VM IP address using qemu-guest-agent. With maxRetries 0
+// it retries until ctx is done.
+func getVMIPAddressFromGuestAgent(ctx context.Context, node string, vmid int, maxRetries int) (string, error) {
+	path := vmPath(node, vmid) + "/agent/network-get-interfaces"
 
 	// Retry logic for getting IP address as guest agent might need time to start
-	maxRetries := 100
 	retryDelay := 3 * time.Second
 
-	for attempt := 1; attempt <= maxRetries; attempt++ {
-		resp, err := httpClient.Do(req)
-		if err != nil {
-			if attempt == maxRetries {
-				return "", fmt.Errorf("failed to connect to guest agent after %d attempts: %w", maxRetries, err)
-			}
-			logger.Info("Attempt %d/%d: Guest agent not ready, retrying in %v: %v", attempt, maxRetries, retryDelay, err)
-			time.Sleep(retryDelay)
-			continue
-		}
-		defer resp.Body.Close()
-
-		body, err := io.ReadAll(resp.Body)
-		if err != nil {
-			if attempt == maxRetries {
-				return "", fmt.Errorf("failed to read guest agent response after %d attempts: %w", maxRetries, err)
-			}
-			logger.Info("Attempt %d/%d: Failed to read response, retrying in %v: %v", attempt, maxRetries, retryDelay, err)
-			time.Sleep(retryDelay)
-			continue
-		}
-
-		logger.Debug("Guest agent network interfaces response: %s", string(body))
-
+	for attempt := 1; maxRetries == 0 || attempt <= maxRetries; attempt++ {
 		var result struct {
-			Data struct {
-				Result []struct {
-					Name        string `json:"name"`
-					IPAddresses []struct {
-						IPAddress     string `json:"ip-address"`
-						IPAddressType string `json:"ip-address-type"`
-					} `json:"ip-addresses"`
-				} `json:"result"`
-			} `json:"data"`
+			Result []struct {
+				Name        string `json:"name"`
+				IPAddresses []struct {
+					IPAddress     string `json:"ip-address"`
+					IPAddressType string `json:"ip-address-type"`
+				} `json:"ip-addresses"`
+			} `json:"result"`
 		}
-
-		if err := json.Unmarshal(body, &result); err != nil {
-			if attempt == maxRetries {
-				return "", fmt.Errorf("failed to parse guest agent response after %d attempts: %w", maxRetries, err)
+		if err := proxmox.get(ctx, path, &result); err != nil {
+			// Retrying won't help without the permission or the VM
+			if attempt == maxRetries || ctx.Err() != nil || errors.Is(err, errProxmoxPermissionDenied) || errors.Is(err, errProxmoxNotFound) {
+				return "", fmt.Errorf("failed to query guest agent after %d attempt(s): %w", attempt, err)
+			}
+			logger.Info("Attempt %d: Guest agent not ready, retrying in %v: %v", attempt, retryDelay, err)
+			if err := sleepContext(ctx, retryDelay); err != nil {
+				return "", fmt.Errorf("guest agent not ready after %d attempt(s): %w", attempt, err)
 			}
-			logger.Info("Attempt %d/%d: Failed to parse response, retrying in %v: %v", attempt, maxRetries, retryDelay, err)
-			time.Sleep(retryDelay)
 			continue
 		}
 
@@ -624,7 +499,7 @@ func getVMIPAddressFromGuestAgent(node string, vmid int) (string, error) {
 			targetInterface = "eth0" // fallback default
 		}
 
-		for _, iface := range result.Data.Result {
+		for _, iface := range result.Result {
 			// Skip loopback interface
 			if iface.Name == "lo" {
 				continue
@@ -643,7 +518,7 @@ func getVMIPAddressFromGuestAgent(node string, vmid int) (string, error) {
 
 		// If target interface not found, try any non-loopback interface as fallback
 		logger.Debug("Target interface %s not found, trying any available interface", targetInterface)
-		for _, iface := range result.Data.Result {
+		for _, iface := range result.Result {
 			if iface.Name == "lo" {
 				continue // Skip loopback interface
 			}
@@ -659,15 +534,84 @@ func getVMIPAddressFromGuestAgent(node string, vmid int) (string, error) {
 			return "", fmt.Errorf("no valid IPv4 address found in guest agent response after %d attempts", maxRetries)
 		}
 
-		logger.Info("Attempt %d/%d: No valid IP found, retrying in %v", attempt, maxRetries, retryDelay)
-		time.Sleep(retryDelay)
+		logger.Info("Attempt %d: No valid IP found, retrying in %v", attempt, retryDelay)
+		if err := sleepContext(ctx, retryDelay); err != nil {
+			return "", fmt.Errorf("no valid IPv4 address found in guest agent response after %d attempt(s): %w", attempt, err)
+		}
 	}
 
 	return "", fmt.Errorf("failed to get VM IP address from guest agent after %d attempts", maxRetries)
 }
 
-// getVMIPAddress gets VM IP address using qemu-guest-agent
-func getVMIPAddress(node string, vmid int) (string, error) {
+// getVMIPAddress gets VM IP address using qemu-guest-agent, waiting up to IP_TIMEOUT
+func getVMIPAddress(ctx context.Context, node string, vmid int) (string, error) {
 	logger.Info("Getting VM IP using qemu-guest-agent...")
-	return getVMIPAddressFromGuestAgent(node, vmid)
+	ctx, cancel := context.WithTimeout(ctx, appConfig.IPTimeout)
+	defer cancel()
+	return getVMIPAddressFromGuestAgent(ctx, node, vmid, 0)
+}
+
+type NodeStatus struct {
+	CPUInfo struct {
+		CPUs int `json:"cpus"`
+	} `json:"cpuinfo"`
+	Memory struct {
+		Total int64 `json:"total"`
+		Used  int64 `json:"used"`
+		Free  int64 `json:"free"`
+	} `json:"memory"`
+}
+
+// getNodeStatus returns CPU and memory usage of a Proxmox node
+func getNodeStatus(ctx context.Context, node string) (*NodeStatus, error) {
+	var status *NodeStatus
+	if err := proxmox.get(ctx, "/nodes/"+node+"/status", &status); err != nil {
+		return nil, err
+	}
+	if status == nil {
+		return nil, fmt.Errorf("empty status for node %s", node)
+	}
+	return status, nil
+}
+
+type StorageStatus struct {
+	Total int64 `json:"total"`
+	Used  int64 `json:"used"`
+	Avail int64 `json:"avail"`
+}
+
+// getStorageStatus returns usage of a storage as seen from a Proxmox node
+func getStorageStatus(ctx context.Context, node string, storage string) (*StorageStatus, error) {
+	var status *StorageStatus
+	if err := proxmox.get(ctx, fmt.Sprintf("/nodes/%s/storage/%s/status", node, storage), &status); err != nil {
+		return nil, err
+	}
+	if status == nil {
+		return nil, fmt.Errorf("empty status for storage %s on node %s", storage, node)
+	}
+	return status, nil
+}
+
+// getVMDiskStorage returns the storage holding the virtio0 disk of a VM (or template)
+func getVMDiskStorage(ctx context.Context, node string, vmid int) (string, error) {
+	vmConfig, err := getVMConfig(ctx, node, vmid)
+	if err != nil {
+		return "", err
+	}
+	virtio0, ok := vmConfig["virtio0"].(string)
+	if !ok || !strings.Contains(virtio0, ":") {
+		return "", fmt.Errorf("VM %d on node %s has no virtio0 disk", vmid, node)
+	}
+	return strings.SplitN(virtio0, ":", 2)[0], nil
+}
+
+// getVMStatus returns the current power state of a VM, e.g. running or stopped
+func getVMStatus(ctx context.Context, node string, vmid int) (string, error) {
+	var status struct {
+		Status string `json:"status"`
+	}
+	if err := proxmox.get(ctx, vmPath(node, vmid)+"/status/current", &status); err != nil {
+		return "", err
+	}
+	return status.Status, nil
 }
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Kinds of Proxmox API errors, matched with errors.Is
+var (
+	errProxmoxPermissionDenied = errors.New("permission denied")
+	errProxmoxNotFound         = errors.New("not found")
+	errProxmoxLockTimeout      = errors.New("lock timeout")
+	errProxmoxValidation       = errors.New("validation error")
+	errProxmoxServer           = errors.New("server error")
+)
+
+// ProxmoxError is a non-2xx response of the Proxmox API
+type ProxmoxError struct {
+	Method  string
+	Path    string
+	Status  int
+	Message string
+	Errors  map[string]string // per-parameter messages of validation errors
+	Kind    error
+}
+
+func (e *ProxmoxError) Error() string {
+	msg := fmt.Sprintf("Proxmox %s %s returned %d (%s): %s", e.Method, e.Path, e.Status, e.Kind, e.Message)
+	if len(e.Errors) > 0 {
+		params := make([]string, 0, len(e.Errors))
+		for param := range e.Errors {
+			params = append(params, param)
+		}
+		sort.Strings(params)
+		for _, param := range params {
+			msg += fmt.Sprintf("; %s: %s", param, strings.TrimSpace(e.Errors[param]))
+		}
+	}
+	return msg
+}
+
+func (e *ProxmoxError) Unwrap() error {
+	return e.Kind
+}
+
+// proxmoxErrorDetails returns the Proxmox error within err for API responses, or nil
+func proxmoxErrorDetails(err error) map[string]interface{} {
+	var proxmoxErr *ProxmoxError
+	if !errors.As(err, &proxmoxErr) {
+		return nil
+	}
+	details := map[string]interface{}{
+		"status":  proxmoxErr.Status,
+		"kind":    proxmoxErr.Kind.Error(),
+		"message": proxmoxErr.Message,
+	}
+	if len(proxmoxErr.Errors) > 0 {
+		details["errors"] = proxmoxErr.Errors
+	}
+	return details
+}
+
+// ProxmoxClient calls the Proxmox VE API with an API token
+type ProxmoxClient struct {
+	BaseURL string
+	Token   string
+	HTTP    *http.Client
+	Retry   RetryPolicy
+}
+
+var proxmox *ProxmoxClient
+
+// do sends params (form encoded) and decodes the data field of the response into out (if any),
+// retrying transient failures according to the retry policy. The request is aborted when ctx is done.
+func (c *ProxmoxClient) do(ctx context.Context, method string, path string, params url.Values, out interface{}) error {
+	for attempt := 1; ; attempt++ {
+		err := c.send(ctx, method, path, params, out)
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+		class, applied := retryClass(err)
+		if class == "" || !c.Retry.Classes[class] || (applied && method != "GET") {
+			return err
+		}
+		labels := prometheus.Labels{"method": method, "class": class}
+		if attempt >= c.Retry.MaxAttempts {
+			if attempt > 1 {
+				proxmoxRetriesExhaustedCounter.With(labels).Inc()
+			}
+			return err
+		}
+
+		delay := c.Retry.backoff(attempt)
+		logger.Info("Proxmox %s %s failed (%s), retrying in %v (attempt %d/%d): %s", method, path, class, delay, attempt, c.Retry.MaxAttempts, err.Error())
+		proxmoxRetryCounter.With(labels).Inc()
+		if sleepContext(ctx, delay) != nil {
+			return err
+		}
+	}
+}
+
+// send makes a single attempt of a call
+func (c *ProxmoxClient) send(ctx context.Context, method string, path string, params url.Values, out interface{}) error {
+	var body io.Reader
+	if len(params) > 0 && method != "GET" {
+		body = strings.NewReader(params.Encode())
+	} else if len(params) > 0 {
+		path += "?" + params.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "PVEAPIToken="+c.Token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	logger.Debug("Proxmox %s %s raw response: %s %s", method, path, resp.Status, string(respBody))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return newProxmoxError(method, path, resp, respBody)
+	}
+	if out == nil {
+		return nil
+	}
+	var result struct {
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(respBody, &result); err != nil {
+		return fmt.Errorf("Proxmox %s %s: invalid response: %w", method, path, err)
+	}
+	if len(result.Data) == 0 || string(result.Data) == "null" {
+		return nil
+	}
+	if err := json.Unmarshal(result.Data, out); err != nil {
+		return fmt.Errorf("Proxmox %s %s: unexpected data: %w", method, path, err)
+	}
+	return nil
+}
+
+// newProxmoxError decodes an error response. Proxmox puts the message in the HTTP reason
+// phrase, newer versions also in the message field, and parameter errors in errors.
+func newProxmoxError(method string, path string, resp *http.Response, body []byte) *ProxmoxError {
+	e := &ProxmoxError{Method: method, Path: path, Status: resp.StatusCode}
+	var result struct {
+		Message string            `json:"message"`
+		Errors  map[string]string `json:"errors"`
+	}
+	json.Unmarshal(body, &result)
+	e.Message = strings.TrimSpace(result.Message)
+	e.Errors = result.Errors
+	if e.Message == "" {
+		e.Message = strings.TrimSpace(strings.TrimPrefix(resp.Status, strconv.Itoa(resp.StatusCode)))
+	}
+
+	message := strings.ToLower(e.Message)
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		e.Kind = errProxmoxPermissionDenied
+	case resp.StatusCode == http.StatusNotFound || strings.Contains(message, "does not exist") || strings.Contains(message, "no such"):
+		e.Kind = errProxmoxNotFound
+	case strings.Contains(message, "got timeout") || strings.Contains(message, "is locked"):
+		e.Kind = errProxmoxLockTimeout
+	case resp.StatusCode == http.StatusBadRequest || len(e.Errors) > 0:
+		e.Kind = errProxmoxValidation
+	default:
+		e.Kind = errProxmoxServer
+	}
+	return e
+}
+
+func (c *ProxmoxClient) get(ctx context.Context, path string, out interface{}) error {
+	return c.do(ctx, "GET", path, nil, out)
+}
+
+// task starts an asynchronous operation and returns its UPID. Some operations (e.g. resize or
+// config changes on stopped VMs) complete synchronously and return no UPID.
+func (c *ProxmoxClient) task(ctx context.Context, method string, path string, params url.Values) (string, error) {
+	var upid string
+	if err := c.do(ctx, method, path, params, &upid); err != nil {
+		return "", err
+	}
+	return upid, nil
+}
+
+func vmPath(node string, vmid int) string {
+	return fmt.Sprintf("/nodes/%s/qemu/%d", node, vmid)
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Reconciliation findings
+const (
+	ReconcileMissing  = "missing"  // in the inventory, but on no Proxmox node
+	ReconcileDrifted  = "drifted"  // on another node, with another id or IP than recorded
+	ReconcileOrphaned = "orphaned" // named like a deployer VM, but not in the inventory
+	ReconcileAdopted  = "adopted"  // named like a deployer VM and recorded when tracking started
+)
+
+type ReconcileFinding struct {
+	Name      string     `json:"name"`
+	Node      string     `json:"node,omitempty"`
+	VMID      int        `json:"vm_id,omitempty"`
+	Details   string     `json:"details,omitempty"`
+	FirstSeen time.Time  `json:"first_seen"`
+	CleanupAt *time.Time `json:"cleanup_at,omitempty"` // when an orphan will be deleted, with ORPHAN_CLEANUP
+}
+
+// ReconcileReport is the outcome of one reconciliation run
+type ReconcileReport struct {
+	StartedAt  time.Time          `json:"started_at"`
+	FinishedAt time.Time          `json:"finished_at"`
+	Missing    []ReconcileFinding `json:"missing"`
+	Drifted    []ReconcileFinding `json:"drifted"`
+	Orphaned   []ReconcileFinding `json:"orphaned"`
+	Adopted    []ReconcileFinding `json:"adopted"`
+	CleanedUp  []ReconcileFinding `json:"cleaned_up"`
+	Errors     []string           `json:"errors,omitempty"`
+}
+
+var (
+	reconcileRunMu  sync.Mutex               // serializes reconciliation runs
+	findingsFirstAt = map[string]time.Time{} // first time a finding was seen, by state/node/vmid
+
+	reconcileMu   sync.Mutex
+	lastReconcile *ReconcileReport
+)
+
+// runReconciler reconciles every RECONCILE_INTERVAL until the process exits
+func runReconciler(interval time.Duration) {
+	logger.Info("Reconciling inventory with Proxmox every %v", interval)
+	for {
+		report := reconcile(context.Background())
+		logger.Info("Reconciliation finished: missing=%d, drifted=%d, orphaned=%d, adopted=%d, cleaned_up=%d, errors=%d",
+			len(report.Missing), len(report.Drifted), len(report.Orphaned), len(report.Adopted), len(report.CleanedUp), len(report.Errors))
+		time.Sleep(interval)
+	}
+}
+
+// reconcile compares the inventory with the VMs on all configured Proxmox nodes
+func reconcile(ctx context.Context) *ReconcileReport {
+	reconcileRunMu.Lock()
+	defer reconcileRunMu.Unlock()
+	report := &ReconcileReport{
+		StartedAt: time.Now().UTC(),
+		Missing:   []ReconcileFinding{},
+		Drifted:   []ReconcileFinding{},
+		Orphaned:  []ReconcileFinding{},
+		Adopted:   []ReconcileFinding{},
+		CleanedUp: []ReconcileFinding{},
+	}
+
+	// 1. Collect the VMs on every node
+	type proxmoxVM struct {
+		Node string
+		VMListEntry
+	}
+	byName := map[string][]proxmoxVM{}
+	failedNodes := map[string]bool{}
+	for _, node := range config.Nodes {
+		vms, err := listVMs(ctx, node.Name)
+		if err != nil {
+			logger.Error("Reconciliation: failed to list VMs on node %s: %s", node.Name, err.Error())
+			report.Errors = append(report.Errors, node.Name+": "+err.Error())
+			failedNodes[node.Name] = true
+			continue
+		}
+		for _, vm := range vms {
+			if vm.Template == 0 {
+				byName[vm.Name] = append(byName[vm.Name], proxmoxVM{Node: node.Name, VMListEntry: vm})
+			}
+		}
+	}
+
+	seen := map[string]bool{}
+	finding := func(state string, name string, node string, vmid int, details string) ReconcileFinding {
+		key := fmt.Sprintf("%s/%s/%d", state, node, vmid)
+		seen[key] = true
+		if _, ok := findingsFirstAt[key]; !ok {
+			findingsFirstAt[key] = report.StartedAt
+		}
+		return ReconcileFinding{Name: name, Node: node, VMID: vmid, Details: details, FirstSeen: findingsFirstAt[key]}
+	}
+
+	// 2. Check every inventory VM against Proxmox
+	for _, vm := range inventory.list(nil) {
+		found := byName[vm.Name]
+		if len(found) == 0 && vm.State == InventoryKept && !failedNodes[vm.Node] {
+			// Deleting a kept VM by hand ends its debugging
+			logger.Info("Forgetting kept VM %s, it was deleted", vm.Name)
+			if err := inventory.remove(vm.Name); err != nil {
+				logger.Error("Failed to remove VM %s from inventory: %s", vm.Name, err.Error())
+				reportError(err)
+			}
+			continue
+		}
+		if len(found) == 0 {
+			if !failedNodes[vm.Node] {
+				report.Missing = append(report.Missing, finding(ReconcileMissing, vm.Name, vm.Node, vm.VMID, "not found on any node"))
+			}
+			continue
+		}
+
+		actual := found[0]
+		ip := vm.IP
+		var drift []string
+		if actual.Node != vm.Node {
+			drift = append(drift, fmt.Sprintf("node %s -> %s", vm.Node, actual.Node))
+		}
+		if actual.VMID != vm.VMID {
+			drift = append(drift, fmt.Sprintf("vm_id %d -> %d", vm.VMID, actual.VMID))
+		}
+		if actual.Status == "running" {
+			if agentIP, err := getVMIPAddressFromGuestAgent(ctx, actual.Node, actual.VMID, 1); err == nil && agentIP != vm.IP {
+				drift = append(drift, fmt.Sprintf("ip %s -> %s", vm.IP, agentIP))
+				ip = agentIP
+			}
+		}
+		if len(drift) > 0 {
+			// Deletes, pools and the autoscaler trust the inventory, so it follows the VM
+			report.Drifted = append(report.Drifted, finding(ReconcileDrifted, vm.Name, actual.Node, actual.VMID, strings.Join(drift, ", ")))
+			err := inventory.update(vm.Name, func(vm *InventoryVM) {
+				vm.Node, vm.VMID, vm.IP = actual.Node, actual.VMID, ip
+			})
+			if err != nil {
+				logger.Error("Failed to update VM %s in inventory: %s", vm.Name, err.Error())
+				reportError(err)
+				report.Errors = append(report.Errors, vm.Name+": "+err.Error())
+			}
+		}
+	}
+
+	// 3. Look for untracked VMs named like the deployer names them. When tracking just started
+	// (no inventory file yet, e.g. after an upgrade or if it was lost), they are adopted instead:
+	// the deployer can't tell them from orphans. Nothing is cleaned up without an inventory.
+	adopt := inventory.isFresh()
+	cleanup := appConfig.OrphanCleanup && !adopt && len(inventory.list(nil)) > 0
+	if appConfig.OrphanCleanup && !cleanup && !adopt {
+		logger.Info("Orphan cleanup skipped: the inventory is empty")
+	}
+	namePattern := deployerNamePattern()
+	for name, vms := range byName {
+		if _, ok := inventory.get(name); ok || namePattern == nil {
+			continue
+		}
+		match := namePattern.FindStringSubmatch(name)
+		if match == nil {
+			continue
+		}
+		for _, vm := range vms {
+			if strconv.Itoa(vm.VMID) != match[1] || vmBeingCreated(vm.Node, vm.VMID) {
+				continue
+			}
+			if adopt {
+				logger.Info("Adopting VM %s: id=%d, node=%s", name, vm.VMID, vm.Node)
+				err := inventory.put(InventoryVM{VMID: vm.VMID, Node: vm.Node, Name: name, CreatedAt: report.StartedAt, State: InventoryAdopted})
+				if err != nil {
+					logger.Error("Failed to adopt VM %s: %s", name, err.Error())
+					reportError(err)
+					report.Errors = append(report.Errors, name+": "+err.Error())
+					continue
+				}
+				report.Adopted = append(report.Adopted, ReconcileFinding{Name: name, Node: vm.Node, VMID: vm.VMID, Details: "status " + vm.Status, FirstSeen: report.StartedAt})
+				break
+			}
+			orphan := finding(ReconcileOrphaned, name, vm.Node, vm.VMID, "status "+vm.Status)
+			if cleanup {
+				cleanupAt := orphan.FirstSeen.Add(appConfig.OrphanGracePeriod)
+				orphan.CleanupAt = &cleanupAt
+				if !report.StartedAt.Before(cleanupAt) {
+					logger.Info("Deleting orphaned VM %s: id=%d, node=%s", name, vm.VMID, vm.Node)
+					if err := rollbackVM(ctx, vm.Node, vm.VMID, vm.Status == "running", ""); err != nil {
+						logger.Error("Failed to delete orphaned VM %s: %s", name, err.Error())
+						reportError(err)
+						report.Errors = append(report.Errors, name+": "+err.Error())
+					} else {
+						orphanCleanupCounter.With(prometheus.Labels{"node": vm.Node}).Inc()
+						report.CleanedUp = append(report.CleanedUp, orphan)
+						continue
+					}
+				}
+			}
+			report.Orphaned = append(report.Orphaned, orphan)
+		}
+	}
+
+	// Adoption is done once every node could be listed
+	if adopt && len(failedNodes) == 0 {
+		if err := inventory.adopted(); err != nil {
+			logger.Error("Failed to save inventory: %s", err.Error())
+			reportError(err)
+			report.Errors = append(report.Errors, err.Error())
+		}
+	}
+
+	// Forget findings that went away
+	for key := range findingsFirstAt {
+		if !seen[key] {
+			delete(findingsFirstAt, key)
+		}
+	}
+
+	report.FinishedAt = time.Now().UTC()
+	reconcileGauge.With(prometheus.Labels{"state": ReconcileMissing}).Set(float64(len(report.Missing)))
+	reconcileGauge.With(prometheus.Labels{"state": ReconcileDrifted}).Set(float64(len(report.Drifted)))
+	reconcileGauge.With(prometheus.Labels{"state": ReconcileOrphaned}).Set(float64(len(report.Orphaned)))
+	reconcileTimestamp.Set(float64(report.FinishedAt.Unix()))
+	reconcileMu.Lock()
+	lastReconcile = report
+	reconcileMu.Unlock()
+	return report
+}
+
+// missingVMs returns the names of the inventory VMs the last reconciliation found missing
+func missingVMs() map[string]bool {
+	reconcileMu.Lock()
+	defer reconcileMu.Unlock()
+	missing := map[string]bool{}
+	if lastReconcile != nil {
+		for _, finding := range lastReconcile.Missing {
+			missing[finding.Name] = true
+		}
+	}
+	return missing
+}
+
+// deployerNamePattern matches generated VM names (<vm_template or pool name_prefix>-<suffix>-<vmid>-<random>),
+// capturing the vmid; nil without VM templates or nodes
+func deployerNamePattern() *regexp.Regexp {
+	var templates, suffixes []string
+	for _, t := range config.VmTemplates {
+		templates = append(templates, regexp.QuoteMeta(t.Name))
+	}
+	for _, pool := range config.Pools {
+		if pool.NamePrefix != "" {
+			templates = append(templates, regexp.QuoteMeta(pool.NamePrefix))
+		}
+	}
+	for _, n := range config.Nodes {
+		suffixes = append(suffixes, regexp.QuoteMeta(n.Suffix))
+	}
+	if len(templates) == 0 || len(suffixes) == 0 {
+		return nil
+	}
+	return regexp.MustCompile(fmt.Sprintf(`^(?:%s)-(?:%s)-(\d+)-[a-z0-9]{6}$`, strings.Join(templates, "|"), strings.Join(suffixes, "|")))
+}
+
+// reconcileHandler serves GET /api/v1/reconcile with the last report, POST runs a reconciliation now
+func reconcileHandler(w http.ResponseWriter, r *http.Request) {
+	handlerName := "/api/v1/reconcile"
+	if r.Method != "GET" && r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if r.Header.Get("X-Auth-Token") != authToken {
+		logger.Error("Unauthorized access to %s", handlerName)
+		incErrorCounterHandler(handlerName)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var report *ReconcileReport
+	if r.Method == "POST" {
+		report = reconcile(r.Context())
+	} else {
+		reconcileMu.Lock()
+		report = lastReconcile
+		reconcileMu.Unlock()
+	}
+	if report == nil {
+		http.Error(w, "No reconciliation has run yet", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
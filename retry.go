@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Classes of transient Proxmox failures, as listed in PROXMOX_RETRY_ON
+const (
+	RetryLockTimeout = "lock_timeout" // the VM config was locked by another task
+	RetryUnavailable = "unavailable"  // pveproxy couldn't reach the node (595) or a proxy in front answered 502/503/504
+	RetryConnection  = "connection"   // the connection failed or dropped
+)
+
+func isValidRetryClass(class string) bool {
+	return class == RetryLockTimeout || class == RetryUnavailable || class == RetryConnection
+}
+
+// RetryPolicy decides which failed Proxmox calls are repeated. Reads are repeated for every
+// enabled class; writes only when the failure shows Proxmox didn't act on them, so e.g. a
+// clone whose response got lost is never started twice.
+type RetryPolicy struct {
+	MaxAttempts int // including the first one; 1 or less disables retries
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	Classes     map[string]bool
+}
+
+// newRetryPolicy builds the policy from PROXMOX_RETRY_* settings
+func newRetryPolicy(maxAttempts int, baseDelay time.Duration, maxDelay time.Duration, classes []string) (RetryPolicy, error) {
+	policy := RetryPolicy{MaxAttempts: maxAttempts, BaseDelay: baseDelay, MaxDelay: maxDelay, Classes: map[string]bool{}}
+	for _, class := range classes {
+		if !isValidRetryClass(class) {
+			return policy, fmt.Errorf("unknown retry class %q", class)
+		}
+		policy.Classes[class] = true
+	}
+	return policy, nil
+}
+
+// backoff returns the delay before retry number attempt: exponential, capped at MaxDelay,
+// with jitter so pipelines failing together don't retry together
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	delay := p.BaseDelay
+	for i := 1; i < attempt && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// retryClass classifies a failed call. applied tells whether Proxmox may have acted on the
+// request anyway, which rules out repeating writes.
+func retryClass(err error) (class string, applied bool) {
+	var proxmoxErr *ProxmoxError
+	if errors.As(err, &proxmoxErr) {
+		switch {
+		case errors.Is(proxmoxErr.Kind, errProxmoxLockTimeout):
+			return RetryLockTimeout, false
+		case proxmoxErr.Status == 595 || proxmoxErr.Status == http.StatusServiceUnavailable:
+			return RetryUnavailable, false
+		case proxmoxErr.Status == http.StatusBadGateway || proxmoxErr.Status == http.StatusGatewayTimeout:
+			return RetryUnavailable, true
+		}
+		return "", false
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return RetryConnection, false
+	}
+	var urlErr *url.Error
+	var netErr net.Error
+	if errors.As(err, &urlErr) || errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return RetryConnection, true
+	}
+	return "", false
+}
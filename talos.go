@@ -1,15 +1,40 @@
 package main
 
 import (
-	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"net"
+	"net/http"
 	"os"
-	"os/exec"
 	"strings"
 	"time"
+
+	"gopkg.in/yaml.v2"
 )
 
+const talosAPIPort = "50000" // port of the Talos API on the VMs
+
+// contextDialer opens network connections, like net.Dialer
+type contextDialer interface {
+	DialContext(ctx context.Context, network string, address string) (net.Conn, error)
+}
+
+var (
+	talosClient    *http.Client // mTLS client from TALOSCONFIG, nil if not configured
+	talosEndpoints []string
+	// talosDialer connects to the Talos API of VMs, for API calls and readiness probes alike
+	talosDialer contextDialer = &net.Dialer{Timeout: 5 * time.Second}
+)
+
+// dialTalos is the DialContext of the Talos API transports
+func dialTalos(ctx context.Context, network string, address string) (net.Conn, error) {
+	return talosDialer.DialContext(ctx, network, address)
+}
+
 // TalosConfig represents the structure for Talos machine configuration
 type TalosConfig struct {
 	Version string `yaml:"version"`
@@ -38,60 +63,384 @@ type TalosConfig struct {
 	} `yaml:"cluster"`
 }
 
-func generateTalosConfig(templatePath string, vmName string, vmIP string, role string, nodeName string, vmTemplate string, cpuModel string, memory int, suffix string, cpuCores int, disk string) (string, error) {
-	templateContent, err := os.ReadFile(templatePath)
-	if err != nil {
-		return "", fmt.Errorf("failed to read Talos template file %s: %v", templatePath, err)
+// Talos apply modes (machine.ApplyConfigurationRequest.Mode)
+var talosApplyModes = map[string]uint64{
+	"reboot":    0,
+	"auto":      1,
+	"no-reboot": 2,
+	"staged":    3,
+}
+
+func isValidTalosApplyMode(mode string) bool {
+	_, ok := talosApplyModes[mode]
+	return ok
+}
+
+func talosApplyModeName(value uint64) string {
+	for name, v := range talosApplyModes {
+		if v == value {
+			return name
+		}
 	}
+	return fmt.Sprintf("mode(%d)", value)
+}
+
+// TalosApplyResult is what the node reported back after applying the config
+type TalosApplyResult struct {
+	Mode        string   `json:"mode"`
+	ModeDetails string   `json:"mode_details,omitempty"`
+	Warnings    []string `json:"warnings,omitempty"`
+}
 
-	config := string(templateContent)
-	config = strings.ReplaceAll(config, "{role}", role)
-	config = strings.ReplaceAll(config, "{vm_name}", vmName)
-	config = strings.ReplaceAll(config, "{node}", nodeName)
-	config = strings.ReplaceAll(config, "{vm_template}", vmTemplate)
-	config = strings.ReplaceAll(config, "{cpu}", cpuModel)
-	config = strings.ReplaceAll(config, "{memory}", fmt.Sprintf("%d", memory))
-	config = strings.ReplaceAll(config, "{suffix}", suffix)
-	config = strings.ReplaceAll(config, "{cpu_cores}", fmt.Sprintf("%d", cpuCores))
-	config = strings.ReplaceAll(config, "{disk}", disk)
+// TalosAPIError is a structured error returned by the Talos API
+type TalosAPIError struct {
+	Node    string
+	Code    string
+	Message string
+}
 
-	return config, nil
+func (e *TalosAPIError) Error() string {
+	return fmt.Sprintf("Talos API on %s returned %s: %s", e.Node, e.Code, e.Message)
 }
 
-func registerTalosNode(vmIP string, talosConfig string, controlPlaneEndpoint string) error {
-	configFile := fmt.Sprintf("/tmp/talos-config-%s.yaml", strings.ReplaceAll(vmIP, ".", "-"))
-	if err := os.WriteFile(configFile, []byte(talosConfig), 0600); err != nil {
-		return fmt.Errorf("failed to write Talos config file: %v", err)
+// newTalosMaintenanceClient returns an HTTP/2 client for the maintenance API, which serves
+// a self-signed certificate until the node has a machine config (same as talosctl --insecure)
+func newTalosMaintenanceClient() *http.Client {
+	return &http.Client{
+		Timeout: 60 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: true,
+				NextProtos:         []string{"h2"},
+			},
+			DialContext:       dialTalos,
+			ForceAttemptHTTP2: true,
+		},
 	}
+}
 
-	cmd := exec.Command("talosctl", "apply-config", "--insecure", "--nodes", vmIP, "--file", configFile)
-	cmd.Env = os.Environ()
+// registerTalosNode applies the machine config through the Talos maintenance API (MachineService/ApplyConfiguration)
+func registerTalosNode(ctx context.Context, vmIP string, talosConfig string, mode string) (*TalosApplyResult, error) {
+	modeValue, ok := talosApplyModes[mode]
+	if !ok {
+		return nil, fmt.Errorf("invalid Talos apply mode: %s", mode)
+	}
 
-	var stdout, stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
+	baseURL := "https://" + net.JoinHostPort(vmIP, talosAPIPort)
+	message := encodeApplyConfigurationRequest(talosConfig, modeValue)
+	respMessage, err := grpcInvoke(ctx, newTalosMaintenanceClient(), baseURL, "/machine.MachineService/ApplyConfiguration", message)
+	if err != nil {
+		var grpcErr *GRPCError
+		if errors.As(err, &grpcErr) {
+			return nil, &TalosAPIError{Node: vmIP, Code: grpcErr.CodeName(), Message: grpcErr.Message}
+		}
+		return nil, fmt.Errorf("failed to apply Talos config: %w", err)
+	}
 
-	if err := cmd.Run(); err != nil {
-		logger.Error("talosctl failed: %v\nstdout: %s\nstderr: %s", err, stdout.String(), stderr.String())
-		return fmt.Errorf("failed to apply Talos config: %v", err)
+	result, err := parseApplyConfigurationResponse(respMessage)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse ApplyConfiguration response: %w", err)
+	}
+	if result.Mode == "" {
+		result.Mode = mode
+	}
+	for _, warning := range result.Warnings {
+		logger.Info("Talos config warning for node %s: %s", vmIP, warning)
 	}
 
-	logger.Info("Applied Talos config to node: %s", vmIP)
-	return nil
+	logger.Info("Applied Talos config to node: %s, mode=%s %s", vmIP, result.Mode, result.ModeDetails)
+	return result, nil
 }
 
-func waitForTalosNode(vmIP string) error {
-	for attempt := 1; attempt <= 30; attempt++ {
-		conn, err := net.DialTimeout("tcp", fmt.Sprintf("%s:50000", vmIP), 5*time.Second)
+// encodeApplyConfigurationRequest encodes ApplyConfigurationRequest{data = 1, mode = 4}
+func encodeApplyConfigurationRequest(talosConfig string, mode uint64) []byte {
+	var message []byte
+	message = protoAppendBytes(message, 1, []byte(talosConfig))
+	return protoAppendVarint(message, 4, mode)
+}
+
+// parseApplyConfigurationResponse decodes ApplyConfigurationResponse{messages = 1} with
+// ApplyConfiguration{metadata = 1, warnings = 2, mode = 3, mode_details = 4}
+func parseApplyConfigurationResponse(data []byte) (*TalosApplyResult, error) {
+	result := &TalosApplyResult{}
+	fields, err := protoParse(data)
+	if err != nil {
+		return nil, err
+	}
+	for _, field := range fields {
+		if field.Num != 1 || field.Type != protoBytes {
+			continue
+		}
+		applyFields, err := protoParse(field.Bytes)
 		if err != nil {
-			if attempt == 30 {
-				return fmt.Errorf("Talos node not ready after 30 attempts: %v", err)
+			return nil, err
+		}
+		for _, f := range applyFields {
+			switch f.Num {
+			case 1:
+				if metadataErr := parseTalosMetadataError(f.Bytes); metadataErr != "" {
+					return nil, errors.New(metadataErr)
+				}
+			case 2:
+				result.Warnings = append(result.Warnings, string(f.Bytes))
+			case 3:
+				result.Mode = talosApplyModeName(f.Varint)
+			case 4:
+				result.ModeDetails = string(f.Bytes)
 			}
-			time.Sleep(10 * time.Second)
+		}
+	}
+	return result, nil
+}
+
+// parseTalosMetadataError returns the error of common.Metadata{error = 2, status = 3}, falling
+// back to the message of the google.rpc.Status{code = 1, message = 2}
+func parseTalosMetadataError(data []byte) string {
+	fields, err := protoParse(data)
+	if err != nil {
+		return ""
+	}
+	var statusMessage string
+	for _, field := range fields {
+		if field.Type != protoBytes {
 			continue
 		}
-		conn.Close()
+		switch field.Num {
+		case 2:
+			if len(field.Bytes) > 0 {
+				return string(field.Bytes)
+			}
+		case 3:
+			statusFields, err := protoParse(field.Bytes)
+			if err != nil {
+				continue
+			}
+			for _, f := range statusFields {
+				if f.Num == 2 && f.Type == protoBytes {
+					statusMessage = string(f.Bytes)
+				}
+			}
+		}
+	}
+	return statusMessage
+}
+
+// talosconfig file layout, as written by talosctl
+type talosConfigFile struct {
+	Context  string `yaml:"context"`
+	Contexts map[string]struct {
+		Endpoints []string `yaml:"endpoints"`
+		CA        string   `yaml:"ca"`
+		Crt       string   `yaml:"crt"`
+		Key       string   `yaml:"key"`
+	} `yaml:"contexts"`
+}
+
+// initTalosClient loads client credentials from TALOSCONFIG for calls to configured Talos nodes.
+// Without it, only the unauthenticated maintenance API is used.
+func initTalosClient() error {
+	if appConfig.TalosConfigPath == "" {
 		return nil
 	}
-	return fmt.Errorf("Talos node not ready after 30 attempts")
+
+	data, err := os.ReadFile(appConfig.TalosConfigPath)
+	if err != nil {
+		return fmt.Errorf("failed to read talosconfig: %w", err)
+	}
+	var talosconfig talosConfigFile
+	if err := yaml.Unmarshal(data, &talosconfig); err != nil {
+		return fmt.Errorf("failed to parse talosconfig: %w", err)
+	}
+	context, ok := talosconfig.Contexts[talosconfig.Context]
+	if !ok {
+		return fmt.Errorf("context %q not found in talosconfig", talosconfig.Context)
+	}
+
+	caPEM, err := base64.StdEncoding.DecodeString(context.CA)
+	if err != nil {
+		return fmt.Errorf("invalid ca in talosconfig: %w", err)
+	}
+	crtPEM, err := base64.StdEncoding.DecodeString(context.Crt)
+	if err != nil {
+		return fmt.Errorf("invalid crt in talosconfig: %w", err)
+	}
+	keyPEM, err := base64.StdEncoding.DecodeString(context.Key)
+	if err != nil {
+		return fmt.Errorf("invalid key in talosconfig: %w", err)
+	}
+	certificate, err := tls.X509KeyPair(crtPEM, keyPEM)
+	if err != nil {
+		return fmt.Errorf("invalid client certificate in talosconfig: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return fmt.Errorf("no certificates found in talosconfig ca")
+	}
+
+	talosClient = &http.Client{
+		Timeout: 60 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				Certificates: []tls.Certificate{certificate},
+				RootCAs:      pool,
+				NextProtos:   []string{"h2"},
+			},
+			DialContext:       dialTalos,
+			ForceAttemptHTTP2: true,
+		},
+	}
+	talosEndpoints = context.Endpoints
+	logger.Info("Talos client configured from %s (context %s)", appConfig.TalosConfigPath, talosconfig.Context)
+	return nil
+}
+
+// talosVersion calls MachineService/Version with client credentials; it only succeeds
+// once the node runs with its machine config (after install and reboot)
+func talosVersion(ctx context.Context, vmIP string) error {
+	baseURL := "https://" + net.JoinHostPort(vmIP, talosAPIPort)
+	_, err := grpcInvoke(ctx, talosClient, baseURL, "/machine.MachineService/Version", nil)
+	return err
+}
+
+// talosEtcdLeave makes a control plane node leave the etcd cluster
+func talosEtcdLeave(ctx context.Context, vmIP string) error {
+	baseURL := "https://" + net.JoinHostPort(vmIP, talosAPIPort)
+	_, err := grpcInvoke(ctx, talosClient, baseURL, "/machine.MachineService/EtcdLeaveCluster", nil)
+	return err
+}
+
+// talosEtcdRemoveMember removes the etcd member named hostname through another control plane
+// endpoint from TALOSCONFIG, for nodes that can't leave by themselves
+func talosEtcdRemoveMember(ctx context.Context, hostname string, excludeIP string) error {
+	var errs []string
+	for _, endpoint := range talosEndpoints {
+		if endpoint == excludeIP {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(endpoint); err != nil {
+			endpoint = net.JoinHostPort(endpoint, talosAPIPort)
+		}
+		// EtcdRemoveMemberRequest{member=1}
+		message := protoAppendString(nil, 1, hostname)
+		_, err := grpcInvoke(ctx, talosClient, "https://"+endpoint, "/machine.MachineService/EtcdRemoveMember", message)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, endpoint+": "+err.Error())
+	}
+	if len(errs) == 0 {
+		return fmt.Errorf("no other control plane endpoint in talosconfig")
+	}
+	return errors.New(strings.Join(errs, "; "))
+}
+
+// talosReset gracefully wipes the node and powers it off: Talos cordons and drains it and
+// leaves etcd itself before wiping, on top of what the caller already did
+func talosReset(ctx context.Context, vmIP string) error {
+	baseURL := "https://" + net.JoinHostPort(vmIP, talosAPIPort)
+	_, err := grpcInvoke(ctx, talosClient, baseURL, "/machine.MachineService/Reset", encodeResetRequest(true))
+	return err
+}
+
+// encodeResetRequest encodes ResetRequest{graceful = 1, reboot = 2}; without reboot the node powers off
+func encodeResetRequest(graceful bool) []byte {
+	return protoAppendBool(nil, 1, graceful)
+}
+
+// Stages of waitForNodeReady, named after what is being waited for
+const (
+	ReadyStageInstalling  = "installing"  // Talos installs, reboots and starts with the machine config
+	ReadyStageRegistering = "registering" // kubelet registers the Kubernetes Node
+	ReadyStageNodeReady   = "node_ready"  // Kubernetes Node reports Ready
+)
+
+// nodeReadyError tells at which stage waiting for a node timed out
+type nodeReadyError struct {
+	Stage   string
+	Timeout time.Duration
+	Err     error
+}
+
+func (e *nodeReadyError) Error() string {
+	msg := fmt.Sprintf("node stalled at stage %s after %v", e.Stage, e.Timeout)
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *nodeReadyError) Unwrap() error {
+	return e.Err
+}
+
+// waitForNodeReady waits until the freshly configured node runs Talos with its machine config
+// and the Kubernetes Node vmName is Ready. The current stage is reported to the job.
+func waitForNodeReady(ctx context.Context, vmIP string, vmName string, timeout time.Duration, job *Job) error {
+	deadline := time.Now().Add(timeout)
+	stage := ReadyStageInstalling
+	maintenanceDown := false
+	var lastErr error
+
+	for {
+		job.setStepDetail(stage)
+
+		// A Kubernetes Node implies Talos is installed and running
+		node, err := getKubeNode(ctx, vmName)
+		switch {
+		case err == nil && node.isReady():
+			logger.Info("Node %s (%s) is Ready", vmName, vmIP)
+			return nil
+		case err == nil:
+			stage = ReadyStageNodeReady
+			lastErr = fmt.Errorf("Kubernetes node %s is not Ready", vmName)
+		case !isKubeNotFound(err):
+			lastErr = err
+		case stage == ReadyStageInstalling && talosClient != nil:
+			if err := talosVersion(ctx, vmIP); err != nil {
+				lastErr = fmt.Errorf("Talos API not up with machine config yet: %w", err)
+			} else {
+				stage = ReadyStageRegistering
+				lastErr = fmt.Errorf("Kubernetes node %s not registered yet", vmName)
+			}
+		case stage == ReadyStageInstalling:
+			// Without client credentials, watch the API go down for the reboot and come back
+			conn, err := talosDialer.DialContext(ctx, "tcp", net.JoinHostPort(vmIP, talosAPIPort))
+			if err != nil {
+				maintenanceDown = true
+				lastErr = fmt.Errorf("Talos API unreachable: %w", err)
+			} else {
+				conn.Close()
+				if maintenanceDown {
+					stage = ReadyStageRegistering
+				}
+				lastErr = fmt.Errorf("Talos API still in maintenance mode or rebooting")
+			}
+		default:
+			lastErr = fmt.Errorf("Kubernetes node %s not registered yet", vmName)
+		}
+
+		if time.Now().After(deadline) {
+			return &nodeReadyError{Stage: stage, Timeout: timeout, Err: lastErr}
+		}
+		logger.Debug("Waiting for node %s (%s): stage=%s: %v", vmName, vmIP, stage, lastErr)
+		if err := sleepContext(ctx, 5*time.Second); err != nil {
+			return fmt.Errorf("waiting for node stopped at stage %s: %w", stage, err)
+		}
+	}
+}
+
+// waitForTalosNode waits up to TALOS_READY_TIMEOUT for the maintenance API to accept connections
+func waitForTalosNode(ctx context.Context, vmIP string) error {
+	ctx, cancel := context.WithTimeout(ctx, appConfig.TalosReadyTimeout)
+	defer cancel()
+	for attempt := 1; ; attempt++ {
+		conn, dialErr := talosDialer.DialContext(ctx, "tcp", net.JoinHostPort(vmIP, talosAPIPort))
+		if dialErr == nil {
+			conn.Close()
+			return nil
+		}
+		if err := sleepContext(ctx, 10*time.Second); err != nil {
+			return fmt.Errorf("Talos node not ready after %d attempt(s): %v: %w", attempt, dialErr, err)
+		}
+	}
 }
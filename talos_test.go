@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// Values of machine.ApplyConfigurationRequest.Mode in the Talos API
+func TestTalosApplyModes(t *testing.T) {
+	want := map[string]uint64{"reboot": 0, "auto": 1, "no-reboot": 2, "staged": 3}
+	if len(talosApplyModes) != len(want) {
+		t.Fatalf("talosApplyModes = %v, want %v", talosApplyModes, want)
+	}
+	for name, value := range want {
+		if talosApplyModes[name] != value {
+			t.Errorf("mode %s = %d, want %d", name, talosApplyModes[name], value)
+		}
+	}
+}
+
+func TestEncodeApplyConfigurationRequest(t *testing.T) {
+	// data = 1 (bytes), mode = 4 (varint)
+	message := encodeApplyConfigurationRequest("a: b", talosApplyModes["no-reboot"])
+	want := []byte{0x0a, 0x04, 'a', ':', ' ', 'b', 0x20, 0x02}
+	if !bytes.Equal(message, want) {
+		t.Errorf("encoded %x, want %x", message, want)
+	}
+
+	// REBOOT is the zero value and left out
+	message = encodeApplyConfigurationRequest("a: b", talosApplyModes["reboot"])
+	if want := want[:6]; !bytes.Equal(message, want) {
+		t.Errorf("encoded %x, want %x", message, want)
+	}
+}
+
+func TestEncodeResetRequest(t *testing.T) {
+	// graceful = 1 (bool), reboot = 2 left out so the node powers off
+	if message, want := encodeResetRequest(true), []byte{0x08, 0x01}; !bytes.Equal(message, want) {
+		t.Errorf("encoded %x, want %x", message, want)
+	}
+}
+
+func TestParseApplyConfigurationResponse(t *testing.T) {
+	// ApplyConfigurationResponse{messages = 1: ApplyConfiguration{warnings = 2, mode = 3, mode_details = 4}}
+	applied := []byte{
+		0x12, 0x02, 'w', '1',
+		0x18, 0x02,
+		0x22, 0x07, 'a', 'p', 'p', 'l', 'i', 'e', 'd',
+	}
+	result, err := parseApplyConfigurationResponse(append([]byte{0x0a, byte(len(applied))}, applied...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Mode != "no-reboot" || result.ModeDetails != "applied" || len(result.Warnings) != 1 || result.Warnings[0] != "w1" {
+		t.Errorf("unexpected result: %+v", result)
+	}
+
+	// ApplyConfiguration{metadata = 1: common.Metadata{hostname = 1, error = 2}}
+	metadata := []byte{0x0a, 0x01, 'n', 0x12, 0x04, 'b', 'o', 'o', 'm'}
+	failed := append([]byte{0x0a, byte(len(metadata))}, metadata...)
+	if _, err := parseApplyConfigurationResponse(append([]byte{0x0a, byte(len(failed))}, failed...)); err == nil || err.Error() != "boom" {
+		t.Errorf("expected the metadata error, got %v", err)
+	}
+
+	// common.Metadata{status = 3: google.rpc.Status{code = 1, message = 2}}
+	status := []byte{0x08, 0x03, 0x12, 0x03, 'b', 'a', 'd'}
+	metadata = append([]byte{0x1a, byte(len(status))}, status...)
+	failed = append([]byte{0x0a, byte(len(metadata))}, metadata...)
+	if _, err := parseApplyConfigurationResponse(append([]byte{0x0a, byte(len(failed))}, failed...)); err == nil || err.Error() != "bad" {
+		t.Errorf("expected the status message, got %v", err)
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"math/rand"
 	"net/url"
@@ -15,7 +17,6 @@ import (
 const letterBytes = "abcdefghijklmnopqrstuvwxyz0123456789"
 
 func generateRandomString(n int) string {
-	rand.Seed(time.Now().UnixNano())
 	b := make([]byte, n)
 	for i := range b {
 		b[i] = letterBytes[rand.Intn(len(letterBytes))]
@@ -24,7 +25,33 @@ func generateRandomString(n int) string {
 }
 
 func reportError(err error) {
-	sentry.CaptureException(err)
+	var taskErr *ProxmoxTaskError
+	if !errors.As(err, &taskErr) {
+		sentry.CaptureException(err)
+		return
+	}
+	// Failed tasks carry their log, which the exit status alone doesn't tell
+	sentry.WithScope(func(scope *sentry.Scope) {
+		scope.SetContext("proxmox_task", map[string]interface{}{
+			"node":        taskErr.Node,
+			"upid":        taskErr.UPID,
+			"exit_status": taskErr.ExitStatus,
+			"log":         strings.Join(taskErr.Log, "\n"),
+		})
+		sentry.CaptureException(err)
+	})
+}
+
+// sleepContext waits for d, or returns the error of ctx once it is done
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
 }
 
 func selectWeightedNode(nodes []NodeConfig) *NodeConfig {
@@ -32,6 +59,9 @@ func selectWeightedNode(nodes []NodeConfig) *NodeConfig {
 	for _, node := range nodes {
 		totalWeight += node.Weight
 	}
+	if totalWeight <= 0 {
+		return nil
+	}
 	randNum := rand.Intn(totalWeight)
 	for i, node := range nodes {
 		if randNum < node.Weight {
@@ -165,37 +195,3 @@ func parseRangeComponent(rangeStr string) (int, int, error) {
 		return value, value, nil
 	}
 }
-
-func autoSelectCores(numaNode *NumaNode, phyOnly bool, htOnly bool) string {
-	if numaNode == nil {
-		logger.Error("NUMA node is nil")
-		return ""
-	}
-
-	phyCores := parseCoreRange(numaNode.Cores.Phy)
-	htCores := parseCoreRange(numaNode.Cores.HT)
-
-	logger.Info("Available physical cores: %s (%d cores)", numaNode.Cores.Phy, len(phyCores))
-	logger.Info("Available HT cores: %s (%d cores)", numaNode.Cores.HT, len(htCores))
-
-	var selectedCores []int
-
-	if phyOnly {
-		logger.Info("Using only physical cores as requested")
-		selectedCores = phyCores
-	} else if htOnly {
-		logger.Info("Using only HT cores as requested")
-		selectedCores = htCores
-	} else {
-		logger.Info("Using both physical and HT cores")
-		selectedCores = append(selectedCores, phyCores...)
-		selectedCores = append(selectedCores, htCores...)
-	}
-
-	sort.Ints(selectedCores)
-
-	result := formatCoreRange(selectedCores)
-	logger.Info("Selected cores: %s (%d cores)", result, len(selectedCores))
-
-	return result
-}